@@ -8,7 +8,12 @@ https://developers.google.com/open-source/licenses/bsd
 
 package reftable
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+)
 
 // BlockSource is an interface for reading reftable bytes.
 type BlockSource interface {
@@ -37,6 +42,8 @@ var SHA1ID = HashID([4]byte{'s', 'h', 'a', '1'})
 var SHA256ID = HashID([4]byte{'s', '2', '5', '6'})
 var NullHashID = HashID([4]byte{0, 0, 0, 0})
 
+// Size returns the size of the object IDs in bytes, or 0 for an
+// unknown hash.
 func (i HashID) Size() int {
 	switch i {
 	case NullHashID, SHA1ID:
@@ -44,7 +51,7 @@ func (i HashID) Size() int {
 	case SHA256ID:
 		return 32
 	}
-	panic("unknown hash")
+	return 0
 }
 
 // Table is a read interface for reftables, either file reftables or merged reftables.
@@ -53,12 +60,73 @@ type Table interface {
 	// key specified by the record
 	seekRecord(rec record) (iterator, error)
 
+	// seekRecordReverse returns an iterator that walks backwards,
+	// starting at the last record with a key <= the key of rec.
+	seekRecordReverse(rec record) (iterator, error)
+
+	// seekRange returns an iterator starting at the key of rec,
+	// that stops before the end key. An empty end key means no
+	// bound.
+	seekRange(rec record, end string) (iterator, error)
+
 	MaxUpdateIndex() uint64
 	MinUpdateIndex() uint64
 	HashID() HashID
 	SeekRef(refName string) (*Iterator, error)
 	SeekLog(refName string, updateIndex uint64) (*Iterator, error)
+	SeekRefReverse(refName string) (*Iterator, error)
+	SeekLogReverse(refName string, updateIndex uint64) (*Iterator, error)
+
+	// SeekRefPrefix returns an iterator over the refs whose name
+	// starts with prefix.
+	SeekRefPrefix(prefix string) (*Iterator, error)
+
+	// SeekRefRange returns an iterator over the refs with start <=
+	// name < end. An empty end means no bound.
+	SeekRefRange(start, end string) (*Iterator, error)
+
+	// SeekRefLog returns an iterator over the log records of a
+	// single ref, newest first.
+	SeekRefLog(refName string) (*Iterator, error)
+
+	// SeekLogByTime returns an iterator over the log records of a
+	// single ref, newest first, starting at the newest record with
+	// Time <= t. It assumes that times grow with the update index;
+	// if clocks were skewed, it may start at an older record that
+	// also has Time <= t.
+	SeekLogByTime(refName string, t uint64) (*Iterator, error)
 	RefsFor(oid []byte) (*Iterator, error)
+
+	// RefsForPrefix returns an iterator over the refs that point to
+	// an object ID starting with abbrev, in name order.
+	RefsForPrefix(abbrev []byte) (*Iterator, error)
+
+	// LogsFor returns an iterator over the log records whose New or
+	// Old is oid, in log order.
+	LogsFor(oid []byte) (*Iterator, error)
+
+	// SeekRefContext, SeekLogContext and RefsForContext are like
+	// SeekRef, SeekLog and RefsFor, but the iterators they return
+	// stop with ctx.Err() once ctx is done.
+	SeekRefContext(ctx context.Context, refName string) (*Iterator, error)
+	SeekLogContext(ctx context.Context, refName string, updateIndex uint64) (*Iterator, error)
+	RefsForContext(ctx context.Context, oid []byte) (*Iterator, error)
+
+	// Refs and Logs return the refs and log records of the refs
+	// whose name starts with prefix, for use in range loops.
+	Refs(prefix string) iter.Seq2[RefRecord, error]
+	Logs(prefix string) iter.Seq2[LogRecord, error]
+
+	// SeekCustom and Custom read the records of a registered
+	// custom type, starting at key, or with keys starting with
+	// prefix. See RegisterRecordType.
+	SeekCustom(typ byte, key string) (*Iterator, error)
+	Custom(typ byte, prefix string) iter.Seq2[CustomRecord, error]
+
+	// customTypesIn returns the types of the custom records in the
+	// table, registered or not, in ascending order.
+	customTypesIn() ([]byte, error)
+
 	Name() string
 }
 
@@ -83,6 +151,20 @@ type Config struct {
 	SkipIndexObjects bool
 	RestartInterval  int
 
+	// The block sizes and restart intervals of the separate
+	// sections. If not set, BlockSize and RestartInterval. The
+	// table header records the largest of the ref, obj and index
+	// block sizes. Blocks of a section with a smaller block size
+	// are not padded.
+	RefBlockSize         uint32
+	LogBlockSize         uint32
+	ObjBlockSize         uint32
+	IndexBlockSize       uint32
+	RefRestartInterval   int
+	LogRestartInterval   int
+	ObjRestartInterval   int
+	IndexRestartInterval int
+
 	// Hash identifier. Unset means sha1.
 	HashID HashID
 
@@ -92,6 +174,48 @@ type Config struct {
 	// If set, store reflog messages exactly. If unset, only allow
 	// a single line, and a trailing '\n' is added if it is missing.
 	ExactLogMessage bool
+
+	// If set, a Stack opens its tables with NewMmapBlockSource
+	// rather than NewFileBlockSource.
+	Mmap bool
+
+	// If set, a Stack reads its tables through this cache. The
+	// cache may be shared between stacks.
+	BlockCache *BlockCache
+
+	// The codec for log blocks. If unset, zlib at its best
+	// compression. Only zlib tables can be read by other reftable
+	// implementations. FormatV2 supports zlib and NoCompression.
+	LogCodec Codec
+
+	// The number of goroutines that compress log blocks. If 0 or 1,
+	// log blocks are compressed while adding records. Blocks are
+	// written in order either way, so the table does not change.
+	LogCompressionWorkers int
+
+	// If set, the table gets a Bloom filter over the ref names,
+	// using this many bits per ref. ReadRef uses it to skip tables
+	// that do not have the ref. 10 bits give about 1% false
+	// positives. Readers that don't know the filter ignore it.
+	RefFilterBitsPerKey int
+
+	// If set, the table gets an index from the object IDs of the
+	// log records, New and Old, to the log blocks that have them,
+	// so LogsFor need not read all logs. Readers that don't know
+	// the index ignore it.
+	IndexLogObjects bool
+
+	// If set, the table gets a CRC32C checksum of every block, in
+	// a section that readers which don't know it ignore.
+	BlockChecksums bool
+
+	// When readers opened by a Stack or NewReaderConfig check the
+	// block checksums.
+	ChecksumVerification ChecksumVerification
+
+	// The format of the tables written. Tables of either format can
+	// be merged within a Stack.
+	Format TableFormat
 }
 
 // RefRecord is a Record from the ref database.
@@ -136,6 +260,10 @@ type Stats struct {
 	LogStats BlockStats
 	idxStats BlockStats
 
+	// CustomStats has the statistics of the custom records, by
+	// type.
+	CustomStats map[byte]*BlockStats
+
 	Blocks int
 
 	ObjectIDLen int
@@ -144,3 +272,38 @@ type Stats struct {
 // ErrEmptyTable indicates that a writer tried to create a table
 // without blocks.
 var ErrEmptyTable = errors.New("reftable: table is empty")
+
+// ErrKeyOrder indicates that records were not written in ascending
+// key order, or that a ref was written after a log.
+var ErrKeyOrder = errors.New("reftable: keys must be ascending")
+
+// ErrRecordTooLarge indicates that a record does not fit in a block.
+var ErrRecordTooLarge = errors.New("reftable: record too large for block size")
+
+// ErrHashSize indicates an unknown hash ID, or an object ID whose
+// size does not match the hash.
+var ErrHashSize = errors.New("reftable: invalid hash size")
+
+// CorruptTableError is returned for tables that violate the format.
+type CorruptTableError struct {
+	Table string
+
+	// Offset of the offending block, or of the footer.
+	Offset uint64
+
+	// Type of the offending block, or 0 if unknown.
+	BlockType byte
+
+	Err error
+}
+
+func (e *CorruptTableError) Error() string {
+	if e.BlockType == 0 {
+		return fmt.Sprintf("reftable: %s: corrupt table at 0x%x: %v", e.Table, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("reftable: %s: corrupt %q block at 0x%x: %v", e.Table, e.BlockType, e.Offset, e.Err)
+}
+
+func (e *CorruptTableError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"fmt"
+	"math"
+)
+
+// AsOf returns a read-only view of the stack as it was after the
+// transaction with the given update index. The view leaves out the
+// tables that start after updateIndex, and the newer refs and logs
+// of the tables that span it.
+//
+// Compaction collapses the history of the tables it merges. A ref
+// that such a table has updated after updateIndex, or that it has
+// dropped for a later deletion, gets the value of its newest log
+// record up to updateIndex. If that log record deletes the ref, or
+// the ref has no such log record, the view does not have the ref.
+// The peeled values of these refs are not known. Custom records have
+// no update index, so the view has those of all the tables it keeps.
+func (m *Merged) AsOf(updateIndex uint64) (*Merged, error) {
+	if len(m.stack) > 0 && updateIndex < m.stack[0].MinUpdateIndex() {
+		return nil, fmt.Errorf("reftable: update index %d predates the tables, which start at %d",
+			updateIndex, m.stack[0].MinUpdateIndex())
+	}
+
+	var tabs []Table
+	for _, t := range m.stack {
+		if t.MinUpdateIndex() > updateIndex {
+			break
+		}
+		tabs = append(tabs, t)
+	}
+	return &Merged{
+		stack:             tabs,
+		hashID:            m.hashID,
+		suppressDeletions: m.suppressDeletions,
+		view:              true,
+		asOf:              updateIndex,
+	}, nil
+}
+
+// AsOf returns a view of the merged stack as it was after the given
+// update index. See Merged.AsOf. Like Acquire, the view keeps its
+// tables open across writes; call Close on it to release them.
+func (st *Stack) AsOf(updateIndex uint64) (*Merged, error) {
+	m, release := st.Acquire()
+	view, err := m.AsOf(updateIndex)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	view.release = release
+	return view, nil
+}
+
+// Close releases the tables of a view that Stack.AsOf returned. For
+// other merged stacks, it does nothing.
+func (m *Merged) Close() {
+	if m.release != nil {
+		m.release()
+	}
+}
+
+// asOfRecord adjusts rec, which a merged iteration over the view
+// returned, to the update index of the view. It returns false if the
+// view does not have the record.
+func (m *Merged) asOfRecord(rec record) (bool, error) {
+	switch r := rec.(type) {
+	case *LogRecord:
+		return r.UpdateIndex <= m.asOf, nil
+	case *RefRecord:
+		if r.UpdateIndex <= m.asOf {
+			return true, nil
+		}
+		ref, err := m.loggedRef(r.RefName)
+		if err != nil || ref == nil {
+			return false, err
+		}
+		*r = *ref
+	}
+	return true, nil
+}
+
+// loggedRef returns the ref as the newest log record of the view
+// has it, or nil if it did not exist.
+func (m *Merged) loggedRef(name string) (*RefRecord, error) {
+	log, err := ReadLogAt(m, name, m.asOf)
+	if err != nil || log == nil || isNullHash(log.New) {
+		return nil, err
+	}
+	return &RefRecord{
+		RefName:     name,
+		UpdateIndex: log.UpdateIndex,
+		Value:       log.New,
+	}, nil
+}
+
+// isNullHash returns whether oid is missing or all zeros, which log
+// records use for refs that do not exist.
+func isNullHash(oid []byte) bool {
+	for _, b := range oid {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// spanningTable returns the table of the view that has updates both
+// up to and after the update index of the view, or nil.
+func (m *Merged) spanningTable() Table {
+	if len(m.stack) == 0 {
+		return nil
+	}
+	last := m.stack[len(m.stack)-1]
+	if last.MaxUpdateIndex() <= m.asOf {
+		return nil
+	}
+	return last
+}
+
+// seekLoggedRefs returns the refs that the logs of the spanning table
+// have, starting at start, in the given direction. A compaction that
+// includes the oldest table drops deleted refs with all their older
+// records, but keeps their logs, so the view merges these refs below
+// those of the tables.
+func (m *Merged) seekLoggedRefs(span Table, start string, reverse bool, end string) (iterator, error) {
+	var logs iterator
+	var err error
+	if reverse {
+		// The oldest record of start comes last.
+		logs, err = span.seekRecordReverse(&LogRecord{RefName: start})
+	} else {
+		logs, err = span.seekRecord(&LogRecord{RefName: start, UpdateIndex: math.MaxUint64})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &loggedRefIter{view: m, logs: logs, end: end}, nil
+}
+
+// loggedRefIter returns a ref for each ref name of a log iterator,
+// with the value it had in the view.
+type loggedRefIter struct {
+	view *Merged
+	logs iterator
+
+	// end bounds forward iteration, if set.
+	end string
+
+	last string
+}
+
+// Next implements the Iterator interface.
+func (i *loggedRefIter) Next(rec record) (bool, error) {
+	ref := rec.(*RefRecord)
+	for {
+		var log LogRecord
+		ok, err := i.logs.Next(&log)
+		if err != nil || !ok {
+			return false, err
+		}
+		if log.RefName == i.last {
+			continue
+		}
+		i.last = log.RefName
+		if i.end != "" && log.RefName >= i.end {
+			return false, nil
+		}
+
+		logged, err := i.view.loggedRef(log.RefName)
+		if err != nil {
+			return false, err
+		}
+		if logged != nil {
+			*ref = *logged
+			return true, nil
+		}
+	}
+}
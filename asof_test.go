@@ -0,0 +1,234 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"testing"
+)
+
+// writeAsOfTestStack writes a table per update index 1..n, and
+// returns the branches after each of them. Index 1 creates the
+// branches and a tag without log. Later ones update a branch, except
+// that index 6 deletes branch c, which index 8 creates again, and
+// index 9 deletes branch d.
+func writeAsOfTestStack(t *testing.T, st *Stack, n int) []map[string]string {
+	branches := []string{"refs/heads/a", "refs/heads/b", "refs/heads/c", "refs/heads/d"}
+	states := []map[string]string{{}}
+	for idx := uint64(1); idx <= uint64(n); idx++ {
+		state := map[string]string{}
+		for k, v := range states[idx-1] {
+			state[k] = v
+		}
+
+		var refs []RefRecord
+		var logs []LogRecord
+		update := func(name string, value []byte) {
+			refs = append(refs, RefRecord{RefName: name, UpdateIndex: idx, Value: value})
+			log := LogRecord{
+				RefName:     name,
+				UpdateIndex: idx,
+				New:         value,
+				Message:     fmt.Sprintf("update %d", idx),
+			}
+			if old, ok := state[name]; ok {
+				log.Old = []byte(old)
+			}
+			logs = append(logs, log)
+			if value == nil {
+				delete(state, name)
+			} else {
+				state[name] = string(value)
+			}
+		}
+		switch idx {
+		case 1:
+			refs = append(refs, RefRecord{RefName: "refs/tags/v1", UpdateIndex: idx, Value: testHash(1)})
+			for i, name := range branches {
+				update(name, testHash(100+i))
+			}
+		case 6:
+			update("refs/heads/c", nil)
+		case 9:
+			update("refs/heads/d", nil)
+		default:
+			update(branches[idx%4], testHash(int(idx)*10))
+		}
+		sort.Slice(refs, func(i, j int) bool { return refs[i].RefName < refs[j].RefName })
+
+		if err := st.Add(func(w *Writer) error {
+			w.SetLimits(idx, idx)
+			for _, r := range refs {
+				if err := w.AddRef(&r); err != nil {
+					return err
+				}
+			}
+			for _, l := range logs {
+				if err := w.AddLog(&l); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("Add %d: %v", idx, err)
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+func checkAsOf(t *testing.T, st *Stack, idx uint64, want map[string]string, desc string) {
+	t.Helper()
+	view, err := st.AsOf(idx)
+	if err != nil {
+		t.Fatalf("%s: AsOf(%d): %v", desc, idx, err)
+	}
+	defer view.Close()
+	if view.MaxUpdateIndex() != idx {
+		t.Errorf("%s: AsOf(%d): got max update index %d", desc, idx, view.MaxUpdateIndex())
+	}
+
+	got := map[string]string{}
+	for ref, err := range view.Refs("refs/heads/") {
+		if err != nil {
+			t.Fatalf("%s: Refs: %v", desc, err)
+		}
+		got[ref.RefName] = string(ref.Value)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: AsOf(%d): got %d refs %v, want %d", desc, idx, len(got), got, len(want))
+	}
+
+	var wantNames []string
+	for name := range want {
+		wantNames = append(wantNames, name)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(wantNames)))
+	it, err := view.SeekRefReverse("refs/heads/z")
+	if err != nil {
+		t.Fatalf("%s: SeekRefReverse: %v", desc, err)
+	}
+	var names []string
+	for {
+		var ref RefRecord
+		ok, err := it.NextRef(&ref)
+		if err != nil {
+			t.Fatalf("%s: NextRef: %v", desc, err)
+		}
+		if !ok || ref.RefName < "refs/heads/" {
+			break
+		}
+		names = append(names, ref.RefName)
+	}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("%s: AsOf(%d): got reverse %v, want %v", desc, idx, names, wantNames)
+	}
+
+	ref, err := ReadRef(view, "refs/heads/c")
+	if err != nil {
+		t.Fatalf("%s: ReadRef: %v", desc, err)
+	}
+	if v, ok := want["refs/heads/c"]; ok != (ref != nil) || (ok && string(ref.Value) != v) {
+		t.Errorf("%s: AsOf(%d): got %v for branch c", desc, idx, ref)
+	}
+	if ref, err := ReadRef(view, "refs/tags/v1"); err != nil || ref == nil {
+		t.Errorf("%s: AsOf(%d): got tag %v, %v", desc, idx, ref, err)
+	}
+
+	for log, err := range view.Logs("") {
+		if err != nil {
+			t.Fatalf("%s: Logs: %v", desc, err)
+		}
+		if log.UpdateIndex > idx {
+			t.Errorf("%s: AsOf(%d): got log %v", desc, idx, &log)
+		}
+	}
+}
+
+func TestStackAsOf(t *testing.T) {
+	for _, format := range []TableFormat{FormatV1, FormatV2} {
+		st, err := NewStack(t.TempDir(), Config{BlockSize: 256, Format: format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer st.Close()
+		st.disableAutoCompact = true
+
+		const N = 10
+		states := writeAsOfTestStack(t, st, N)
+		if got := st.Merged().MaxUpdateIndex(); got != N {
+			t.Errorf("got max update index %d, want %d", got, N)
+		}
+		if _, err := st.AsOf(0); err == nil {
+			t.Errorf("AsOf(0) succeeded")
+		}
+
+		for idx := uint64(1); idx <= N; idx++ {
+			checkAsOf(t, st, idx, states[idx], fmt.Sprintf("format %d", format))
+		}
+
+		if err := st.CompactAll(nil); err != nil {
+			t.Fatalf("CompactAll: %v", err)
+		}
+		if len(st.stack) != 1 {
+			t.Fatalf("got %d tables after compaction", len(st.stack))
+		}
+		for idx := uint64(1); idx <= N; idx++ {
+			checkAsOf(t, st, idx, states[idx], fmt.Sprintf("format %d, compacted", format))
+		}
+	}
+}
+
+func TestStackAsOfOutlivesCompaction(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		st, err := NewStack(t.TempDir(), Config{Mmap: mmap})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer st.Close()
+		st.disableAutoCompact = true
+
+		states := writeAsOfTestStack(t, st, 3)
+		view, err := st.AsOf(2)
+		if err != nil {
+			t.Fatalf("AsOf: %v", err)
+		}
+		tabs := st.stack[:2]
+		if err := st.Add(func(w *Writer) error {
+			idx := st.NextUpdateIndex()
+			w.SetLimits(idx, idx)
+			return w.AddRef(&RefRecord{RefName: "refs/heads/e", UpdateIndex: idx, Value: testHash(4)})
+		}); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+		if err := st.CompactAll(nil); err != nil {
+			t.Fatalf("CompactAll: %v", err)
+		}
+		runtime.GC()
+
+		for name, want := range states[2] {
+			ref, err := ReadRef(view, name)
+			if err != nil || ref == nil || !bytes.Equal(ref.Value, []byte(want)) {
+				t.Errorf("mmap %v: ReadRef(%s): got %v, %v", mmap, name, ref, err)
+			}
+		}
+
+		view.Close()
+		for _, r := range tabs {
+			if refs := atomic.LoadInt32(&r.refs); refs != 0 {
+				t.Errorf("mmap %v: %s: got %d references after Close, want 0", mmap, r.Name(), refs)
+			}
+		}
+	}
+}
@@ -15,6 +15,8 @@ import (
 	"fmt"
 	"io"
 	"sort"
+
+	"github.com/google/reftable/sst"
 )
 
 func isBlockType(typ byte) bool {
@@ -34,6 +36,9 @@ type blockWriter struct {
 	restartInterval int
 	hashSize        int
 
+	// codec compresses log blocks. If nil, zlib is used.
+	codec Codec
+
 	// mutable
 	next     uint32
 	restarts []uint32
@@ -88,7 +93,7 @@ func (w *blockWriter) add(r record) bool {
 
 func (w *blockWriter) registerRestart(n int, restart bool, key string) bool {
 	rlen := len(w.restarts)
-	if rlen >= maxRestarts {
+	if rlen >= sst.MaxRestarts {
 		restart = false
 	}
 
@@ -107,45 +112,112 @@ func (w *blockWriter) registerRestart(n int, restart bool, key string) bool {
 	return true
 }
 
-func putU24(out []byte, i uint32) {
-	out[0] = byte((i >> 16) & 0xff)
-	out[1] = byte((i >> 8) & 0xff)
-	out[2] = byte((i) & 0xff)
+// finish finalizes the block, and returns the unpadded block.
+func (w *blockWriter) finish() (data []byte) {
+	data = w.finishRaw()
+	if w.getType() == blockTypeLog {
+		return compressLogBlock(w.codec, data, w.headerOff)
+	}
+
+	return data
 }
 
-func getU24(in []byte) uint32 {
-	return uint32(in[0])<<16 | uint32(in[1])<<8 | uint32(in[2])
+// finishRaw finalizes the block, and returns it without compression.
+// The result aliases the buffer of the writer.
+func (w *blockWriter) finishRaw() []byte {
+	// registerRestart left room for the restart table.
+	w.next = uint32(len(sst.AppendRestarts(w.buf[:w.next], w.restarts)))
+	sst.PutU24(w.buf[w.headerOff+1:], w.next)
+
+	return w.buf[:w.next]
 }
 
-// finish finalizes the block, and returns the unpadded block.
-func (w *blockWriter) finish() (data []byte) {
-	for _, r := range w.restarts {
-		putU24(w.buf[w.next:], r)
-		w.next += 3
+// compressLogBlock compresses the records of a log block.
+func compressLogBlock(codec Codec, data []byte, headerOff uint32) []byte {
+	if codec == nil {
+		codec = defaultCodec
+	}
+	out := append([]byte{}, data[:headerOff+4]...)
+	if _, ok := codec.(zlibCodec); ok {
+		return codec.Compress(out, data[headerOff+4:])
 	}
-	binary.BigEndian.PutUint16(w.buf[w.next:], uint16(len(w.restarts)))
-	w.next += 2
-	putU24(w.buf[w.headerOff+1:], w.next)
 
-	data = w.buf[:w.next]
+	payload := codec.Compress(nil, data[headerOff+4:])
+	out = append(out, codec.ID())
+	out = binary.AppendUvarint(out, uint64(len(payload)))
+	return append(out, payload...)
+}
 
-	if w.getType() == blockTypeLog {
-		compressed := bytes.Buffer{}
-		compressed.Write(data[:w.headerOff+4])
+// logBlockSize returns the size of a log block written with a codec
+// other than zlib, given at least its first bytes, or 0 if it is
+// compressed with zlib, or too short to tell.
+func logBlockSize(block []byte, headerOff uint32) int {
+	start := int(headerOff) + 4
+	if len(block) <= start || isZlib(block[start]) {
+		return 0
+	}
+	n, m := binary.Uvarint(block[start+1:])
+	if m <= 0 {
+		return 0
+	}
+	return start + 1 + m + int(n)
+}
+
+// decompressLogBlock returns the decompressed log block, and the size
+// it takes in the file.
+func decompressLogBlock(block []byte, headerOff uint32, sz uint32) ([]byte, uint32, error) {
+	start := int(headerOff) + 4
+	if len(block) <= start {
+		return nil, 0, fmtError
+	}
 
-		zw, _ := zlib.NewWriterLevel(&compressed, 9)
-		_, err := zw.Write(data[w.headerOff+4:])
+	if !isZlib(block[start]) {
+		codec := lookupCodec(block[start])
+		if codec == nil {
+			return nil, 0, fmt.Errorf("reftable: unknown codec 0x%02x", block[start])
+		}
+		n, m := binary.Uvarint(block[start+1:])
+		end := start + 1 + m + int(n)
+		if m <= 0 || end > len(block) || end < start {
+			return nil, 0, fmtError
+		}
+		out := make([]byte, 0, sz)
+		out = append(out, block[:start]...)
+		out, err := codec.Decompress(out, block[start+1+m:end])
 		if err != nil {
-			panic("in mem zlib write")
+			return nil, 0, err
 		}
-		if err := zw.Close(); err != nil {
-			panic("in mem zlib close")
+		if len(out) != int(sz) {
+			return nil, 0, fmtError
 		}
-		c := compressed.Bytes()
-		return c
+		return out, uint32(end), nil
 	}
 
-	return data
+	decompress := make([]byte, 0, sz)
+	buf := bytes.NewBuffer(block)
+	out := bytes.NewBuffer(decompress)
+
+	before := buf.Len()
+
+	// Consume header
+	io.CopyN(out, buf, int64(start))
+	r, err := zlib.NewReader(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Have to use io.Copy. zlib stream has a terminator,
+	// which we must consume, so go until EOF.
+	if _, err := io.Copy(out, r); err != nil {
+		return nil, 0, err
+	}
+
+	r.Close()
+
+	if out.Len() != int(sz) {
+		return nil, 0, fmtError
+	}
+
+	return out.Bytes(), uint32(before - buf.Len()), nil
 }
 
 // blockReader holds data for reading a block. It is immutable, so it
@@ -178,43 +250,24 @@ func (br *blockReader) getType() byte {
 // newBlockWriter prepares for reading a block.
 func newBlockReader(block []byte, headerOff uint32, tableBlockSize uint32, hashSize int) (*blockReader, error) {
 
+	// The caller checks the type, as custom types depend on the
+	// table.
 	fullBlockSize := tableBlockSize
-	typ := block[headerOff]
-	if !isBlockType(typ) {
-		return nil, fmt.Errorf("reftable: unknown block type %c", typ)
+	if len(block) < int(headerOff)+4 {
+		return nil, fmtError
 	}
-
-	sz := getU24(block[headerOff+1:])
+	typ := block[headerOff]
+	sz := sst.U24(block[headerOff+1:])
 
 	if typ == blockTypeLog {
-		decompress := make([]byte, 0, sz)
-		buf := bytes.NewBuffer(block)
-		out := bytes.NewBuffer(decompress)
-
-		before := buf.Len()
-
-		// Consume header
-		io.CopyN(out, buf, int64(headerOff+4))
-		r, err := zlib.NewReader(buf)
+		var err error
+		block, fullBlockSize, err = decompressLogBlock(block, headerOff, sz)
 		if err != nil {
 			return nil, err
 		}
-		// Have to use io.Copy. zlib stream has a terminator,
-		// which we must consume, so go until EOF.
-		if _, err := io.Copy(out, r); err != nil {
-			return nil, err
-		}
-
-		r.Close()
-
-		if out.Len() != int(sz) {
-			return nil, fmtError
-		}
-
-		block = out.Bytes()
-		fullBlockSize = uint32(before - buf.Len())
-	} else if fullBlockSize == 0 {
-		// unaligned table.
+	} else if fullBlockSize == 0 || sz > fullBlockSize {
+		// unaligned table, or a block beyond the table block
+		// size, which cannot be padded.
 		fullBlockSize = sz
 	} else if sz < fullBlockSize && int(sz) < len(block) && block[sz] != 0 {
 		// If the block is smaller than the full block size,
@@ -224,12 +277,19 @@ func newBlockReader(block []byte, headerOff uint32, tableBlockSize uint32, hashS
 		// the caller must also handle zlib (de)compression.
 		fullBlockSize = sz
 	}
+	// The records start after the block header, and are followed
+	// by the restarts and their count.
+	first := int(headerOff) + 4
+	if int(sz) > len(block) || int(sz) < first+2 {
+		return nil, fmt.Errorf("%w: block size %d", fmtError, sz)
+	}
 	block = block[:sz]
 
-	restartCount := binary.BigEndian.Uint16(block[len(block)-2:])
-	restartStart := len(block) - 2 - 3*int(restartCount)
-	restartBytes := block[restartStart:]
-	block = block[:restartStart]
+	block, restartBytes, ok := sst.SplitRestarts(block)
+	if !ok || len(block) < first {
+		return nil, fmt.Errorf("%w: bad restart table in block of %d bytes", fmtError, sz)
+	}
+	restartCount := uint16(len(restartBytes) / 3)
 
 	br := &blockReader{
 		block:         block,
@@ -246,7 +306,7 @@ func newBlockReader(block []byte, headerOff uint32, tableBlockSize uint32, hashS
 // restart returns the offset within the block of the i-th key
 // restart.
 func (br *blockReader) restartOffset(i int) uint32 {
-	return getU24(br.restartBytes[3*i:])
+	return sst.Restart(br.restartBytes, i)
 }
 
 // blockIter iterates over the block. A blockIter is a value type, so
@@ -345,3 +405,136 @@ func (bi *blockIter) Next(r record) (bool, error) {
 	bi.nextOffset += uint32(len(start) - len(buf))
 	return true, nil
 }
+
+// reverseBlockIter iterates over a block backwards. As keys are
+// prefix compressed, it decodes one restart segment at a time.
+type reverseBlockIter struct {
+	br *blockReader
+
+	// segment is the restart index of the records in recs.
+	segment int
+	recs    []record
+
+	// recs[:pos] are yet to be returned.
+	pos int
+}
+
+// load decodes the records of the given restart segment.
+func (ri *reverseBlockIter) load(segment int) error {
+	br := ri.br
+	end := uint32(len(br.block))
+	if segment+1 < int(br.restartCount) {
+		end = br.restartOffset(segment + 1)
+	}
+
+	bi := blockIter{
+		br:         br,
+		nextOffset: br.restartOffset(segment),
+	}
+	ri.segment = segment
+	ri.recs = ri.recs[:0]
+	for bi.nextOffset < end {
+		rec := newRecord(br.getType(), "")
+		ok, err := bi.Next(rec)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		ri.recs = append(ri.recs, rec)
+	}
+	ri.pos = len(ri.recs)
+	return nil
+}
+
+// seekEnd positions the iterator after the last record of the block.
+func (ri *reverseBlockIter) seekEnd() error {
+	if ri.br.restartCount == 0 {
+		ri.recs, ri.pos = nil, 0
+		ri.segment = 0
+		return nil
+	}
+	return ri.load(int(ri.br.restartCount) - 1)
+}
+
+// seek positions the iterator so it first returns the last record
+// with a key <= the given key. If orNext is set, it first returns the
+// first record with a key >= the given key instead, or the last
+// record if there is no such record.
+func (ri *reverseBlockIter) seek(key string, orNext bool) error {
+	br := ri.br
+	var decodeErr error
+	j := sort.Search(int(br.restartCount),
+		func(i int) bool {
+			rkey, err := decodeRestartKey(br.block, br.restartOffset(i))
+			if err != nil {
+				decodeErr = err
+			}
+			if orNext {
+				return key <= rkey
+			}
+			return key < rkey
+		})
+	if decodeErr != nil {
+		return decodeErr
+	}
+
+	if !orNext {
+		if j == 0 {
+			// All keys are beyond the wanted one.
+			ri.recs, ri.pos = nil, 0
+			ri.segment = 0
+			return nil
+		}
+		if err := ri.load(j - 1); err != nil {
+			return err
+		}
+		for ri.pos > 0 && ri.recs[ri.pos-1].key() > key {
+			ri.pos--
+		}
+		return nil
+	}
+
+	if j > 0 {
+		if err := ri.load(j - 1); err != nil {
+			return err
+		}
+		for i, rec := range ri.recs {
+			if rec.key() >= key {
+				ri.pos = i + 1
+				return nil
+			}
+		}
+		if j == int(br.restartCount) {
+			// No key is at or beyond the wanted one, so
+			// start at the last record.
+			return nil
+		}
+	}
+	if j == int(br.restartCount) {
+		return ri.seekEnd()
+	}
+
+	// The first record of restart j is the one.
+	if err := ri.load(j); err != nil {
+		return err
+	}
+	ri.pos = 1
+	return nil
+}
+
+// Next returns the previous record in the block.
+func (ri *reverseBlockIter) Next(r record) (bool, error) {
+	for ri.pos == 0 {
+		if ri.segment == 0 {
+			return false, nil
+		}
+		if err := ri.load(ri.segment - 1); err != nil {
+			return false, err
+		}
+	}
+	ri.pos--
+	r.copyFrom(ri.recs[ri.pos])
+	return true, nil
+}
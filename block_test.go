@@ -11,6 +11,7 @@ package reftable
 import (
 	"crypto/sha1"
 	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -181,6 +182,68 @@ func TestBlockSeekFirstLog(t *testing.T) {
 	testBlockSeekFirst(t, blockTypeLog)
 }
 
+func TestBlockSeekReverseRef(t *testing.T) {
+	testBlockSeekReverse(t, blockTypeRef)
+}
+
+func TestBlockSeekReverseLog(t *testing.T) {
+	testBlockSeekReverse(t, blockTypeLog)
+}
+
+func testBlockSeekReverse(t *testing.T, typ byte) {
+	names, br := createSeekReader(t, typ, 10240)
+
+	var keys []string
+	for _, nm := range names {
+		keys = append(keys, nm, nm[:len(nm)-1], nm+"z")
+	}
+	keys = append(keys, "", "\xff")
+
+	for _, key := range keys {
+		for _, orNext := range []bool{false, true} {
+			var want []string
+			start := -1
+			for i, nm := range names {
+				if nm <= key {
+					start = i
+				}
+			}
+			if orNext {
+				start = len(names) - 1
+				for i := len(names) - 1; i >= 0; i-- {
+					if names[i] >= key {
+						start = i
+					}
+				}
+			}
+			for i := start; i >= 0; i-- {
+				want = append(want, names[i])
+			}
+
+			ri := reverseBlockIter{br: br}
+			if err := ri.seek(key, orNext); err != nil {
+				t.Fatalf("seek %q: %v", key, err)
+			}
+			var got []string
+			for {
+				rec := newRecord(typ, "")
+				ok, err := ri.Next(rec)
+				if err != nil {
+					t.Fatalf("Next: %v", err)
+				}
+				if !ok {
+					break
+				}
+				got = append(got, rec.key())
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("seek(%q, %v): got %q, want %q", key, orNext, got, want)
+			}
+		}
+	}
+}
+
 func readIter(typ byte, bi iterator) ([]record, error) {
 	var result []record
 	for {
@@ -0,0 +1,221 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"container/list"
+	"sync"
+)
+
+// BlockCacheStats holds statistics of a BlockCache.
+type BlockCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+
+	// Entries and Bytes describe the current contents of the cache.
+	Entries int
+	Bytes   int64
+}
+
+// BlockCache is an LRU cache of blocks, bounded by a byte budget. It
+// can be shared between many BlockSources, and is safe for concurrent
+// use. Besides raw bytes, it holds inflated log blocks, so these are
+// not decompressed again on every read.
+type BlockCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+
+	// front is most recently used.
+	lru     *list.List
+	entries map[cacheKey]*list.Element
+	nextID  uint64
+
+	stats BlockCacheStats
+}
+
+// cacheKey identifies a block in the cache.
+type cacheKey struct {
+	name     string
+	off      uint64
+	inflated bool
+}
+
+type cacheEntry struct {
+	key cacheKey
+
+	// owner identifies the cachedBlockSource that inserted the
+	// entry. A table may be replaced by a different file of the
+	// same name, so entries of other owners are treated as misses.
+	owner uint64
+
+	// data holds raw block data; br holds an inflated log block.
+	data []byte
+	br   *blockReader
+	size int64
+}
+
+// NewBlockCache returns a cache that holds up to maxBytes of blocks.
+func NewBlockCache(maxBytes int64) *BlockCache {
+	return &BlockCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[cacheKey]*list.Element{},
+	}
+}
+
+// Stats returns a snapshot of the cache statistics.
+func (c *BlockCache) Stats() BlockCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = c.lru.Len()
+	return s
+}
+
+func (c *BlockCache) newOwner() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	return c.nextID
+}
+
+// lookup returns the entry for key if it belongs to owner, and
+// updates the hit/miss counters.
+func (c *BlockCache) lookup(key cacheKey, owner uint64, usable func(*cacheEntry) bool) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elt, ok := c.entries[key]; ok {
+		e := elt.Value.(*cacheEntry)
+		if e.owner == owner && usable(e) {
+			c.lru.MoveToFront(elt)
+			c.stats.Hits++
+			return e
+		}
+	}
+	c.stats.Misses++
+	return nil
+}
+
+func (c *BlockCache) insert(e *cacheEntry) {
+	if e.size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elt, ok := c.entries[e.key]; ok {
+		c.removeLocked(elt)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.stats.Bytes += e.size
+
+	for c.stats.Bytes > c.maxBytes {
+		c.removeLocked(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *BlockCache) removeLocked(elt *list.Element) {
+	e := c.lru.Remove(elt).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.stats.Bytes -= e.size
+}
+
+// purge drops all entries inserted by owner.
+func (c *BlockCache) purge(owner uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for elt := c.lru.Front(); elt != nil; {
+		next := elt.Next()
+		if elt.Value.(*cacheEntry).owner == owner {
+			c.removeLocked(elt)
+		}
+		elt = next
+	}
+}
+
+// cachedBlockSource is a BlockSource that serves reads from a
+// BlockCache.
+type cachedBlockSource struct {
+	src   BlockSource
+	cache *BlockCache
+	name  string
+	owner uint64
+}
+
+// NewCachedBlockSource returns a BlockSource that caches blocks read
+// from src in cache, keyed by the table name and block offset. A
+// Reader on the returned source also caches inflated log blocks.
+func NewCachedBlockSource(src BlockSource, cache *BlockCache, name string) BlockSource {
+	return &cachedBlockSource{
+		src:   src,
+		cache: cache,
+		name:  name,
+		owner: cache.newOwner(),
+	}
+}
+
+func (bs *cachedBlockSource) Size() uint64 {
+	return bs.src.Size()
+}
+
+func (bs *cachedBlockSource) ReadBlock(off uint64, size int) ([]byte, error) {
+	key := cacheKey{name: bs.name, off: off}
+	e := bs.cache.lookup(key, bs.owner, func(e *cacheEntry) bool {
+		// A short entry is usable if it extends to the end of
+		// the file.
+		return len(e.data) >= size || off+uint64(len(e.data)) >= bs.src.Size()
+	})
+	if e != nil {
+		if len(e.data) > size {
+			return e.data[:size], nil
+		}
+		return e.data, nil
+	}
+
+	data, err := bs.src.ReadBlock(off, size)
+	if err != nil {
+		return nil, err
+	}
+	bs.cache.insert(&cacheEntry{
+		key:   key,
+		owner: bs.owner,
+		data:  data,
+		size:  int64(len(data)),
+	})
+	return data, nil
+}
+
+// getInflated returns a cached inflated log block at off, or nil.
+func (bs *cachedBlockSource) getInflated(off uint64) *blockReader {
+	key := cacheKey{name: bs.name, off: off, inflated: true}
+	e := bs.cache.lookup(key, bs.owner, func(*cacheEntry) bool { return true })
+	if e == nil {
+		return nil
+	}
+	return e.br
+}
+
+// putInflated caches an inflated log block.
+func (bs *cachedBlockSource) putInflated(off uint64, br *blockReader) {
+	bs.cache.insert(&cacheEntry{
+		key:   cacheKey{name: bs.name, off: off, inflated: true},
+		owner: bs.owner,
+		br:    br,
+		size:  int64(len(br.block) + len(br.restartBytes)),
+	})
+}
+
+// Close drops the cached blocks of this source, and closes the
+// underlying source.
+func (bs *cachedBlockSource) Close() error {
+	bs.cache.purge(bs.owner)
+	return bs.src.Close()
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestBlockCacheLRU(t *testing.T) {
+	src := &ByteBlockSource{bytes.Repeat([]byte("x"), 1000)}
+	cache := NewBlockCache(250)
+	bs := NewCachedBlockSource(src, cache, "tab")
+
+	for _, off := range []uint64{0, 100, 0, 200, 300, 0} {
+		if _, err := bs.ReadBlock(off, 100); err != nil {
+			t.Fatalf("ReadBlock(%d): %v", off, err)
+		}
+	}
+
+	got := cache.Stats()
+	want := BlockCacheStats{
+		Hits:      1,
+		Misses:    5,
+		Evictions: 3,
+		Entries:   2,
+		Bytes:     200,
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if err := bs.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := cache.Stats(); got.Entries != 0 || got.Bytes != 0 {
+		t.Errorf("after Close: got %+v", got)
+	}
+}
+
+func TestBlockCacheReplacedTable(t *testing.T) {
+	cache := NewBlockCache(1 << 20)
+	old := NewCachedBlockSource(&ByteBlockSource{[]byte("old data")}, cache, "tab")
+	cur := NewCachedBlockSource(&ByteBlockSource{[]byte("new data")}, cache, "tab")
+
+	if _, err := old.ReadBlock(0, 3); err != nil {
+		t.Fatal(err)
+	}
+	got, err := cur.ReadBlock(0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "new" {
+		t.Errorf("got %q, want %q", got, "new")
+	}
+}
+
+func TestBlockCacheInflatedLogs(t *testing.T) {
+	var logs []LogRecord
+	for i := 0; i < 50; i++ {
+		logs = append(logs, LogRecord{
+			RefName: fmt.Sprintf("branch%02d", i),
+			Message: "message",
+		})
+	}
+	_, reader := constructTestTable(t, nil, logs, Config{
+		BlockSize: 256,
+	})
+
+	cache := NewBlockCache(1 << 20)
+	cached, err := NewReader(NewCachedBlockSource(reader.src, cache, "tab"), "tab")
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		it, err := cached.SeekLog("", math.MaxUint64)
+		if err != nil {
+			t.Fatalf("SeekLog: %v", err)
+		}
+		recs, err := readIter(blockTypeLog, it.impl)
+		if err != nil {
+			t.Fatalf("readIter: %v", err)
+		}
+		if len(recs) != len(logs) {
+			t.Fatalf("got %d logs, want %d", len(recs), len(logs))
+		}
+	}
+
+	inflated := 0
+	cache.mu.Lock()
+	for k := range cache.entries {
+		if k.inflated {
+			inflated++
+		}
+	}
+	cache.mu.Unlock()
+	if inflated == 0 {
+		t.Errorf("no inflated log blocks in cache")
+	}
+	if st := cache.Stats(); st.Hits == 0 {
+		t.Errorf("got no hits: %+v", st)
+	}
+}
+
+func TestStackBlockCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := NewBlockCache(1 << 20)
+	st, err := NewStack(dir, Config{BlockCache: cache})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	st.disableAutoCompact = true
+
+	for i := 0; i < 3; i++ {
+		if err := st.Add(func(w *Writer) error {
+			next := st.NextUpdateIndex()
+			w.SetLimits(next, next)
+			return w.AddRef(&RefRecord{
+				RefName:     fmt.Sprintf("branch%02d", i),
+				UpdateIndex: next,
+				Value:       testHash(i),
+			})
+		}); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+
+	before := cache.Stats()
+	for i := 0; i < 3; i++ {
+		if r, err := ReadRef(st.Merged(), fmt.Sprintf("branch%02d", i)); err != nil || r == nil {
+			t.Fatalf("ReadRef: %v, %v", r, err)
+		}
+	}
+	after := cache.Stats()
+	if after.Hits <= before.Hits {
+		t.Errorf("got no cache hits: before %+v after %+v", before, after)
+	}
+
+	if err := st.CompactAll(nil); err != nil {
+		t.Fatalf("CompactAll: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if r, err := ReadRef(st.Merged(), fmt.Sprintf("branch%02d", i)); err != nil || r == nil {
+			t.Fatalf("ReadRef after compaction: %v, %v", r, err)
+		}
+	}
+}
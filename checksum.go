@@ -0,0 +1,156 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+// The checksums hold a CRC32C checksum of every other block,
+// including the other extensions. They are the extension (see
+// extension.go) that ends at the footer, with the payload
+//
+//	(uint64(off) | uint32(len) | uint32(crc))*
+//
+// The checksum of the first block excludes the file header, which may
+// be rewritten after the block.
+const checksumEntrySize = 16
+
+// ErrChecksum indicates that a block does not match its checksum.
+var ErrChecksum = errors.New("reftable: checksum mismatch")
+
+// ChecksumVerification selects when a reader checks block checksums.
+// Tables written without Config.BlockChecksums are never checked.
+type ChecksumVerification int
+
+const (
+	// ChecksumSkip ignores the checksums.
+	ChecksumSkip ChecksumVerification = iota
+
+	// ChecksumLazy checks each block when it is read.
+	ChecksumLazy
+
+	// ChecksumOnOpen reads and checks all blocks when the table is
+	// opened.
+	ChecksumOnOpen
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// blockChecksum is the checksum of len bytes at off.
+type blockChecksum struct {
+	off uint64
+	len uint32
+	crc uint32
+}
+
+// addChecksum records the checksum of a block written at off, if
+// checksums are enabled.
+func (w *Writer) addChecksum(off uint64, data []byte) {
+	if !w.cfg.BlockChecksums {
+		return
+	}
+	w.checksums = append(w.checksums, blockChecksum{
+		off: off,
+		len: uint32(len(data)),
+		crc: crc32.Checksum(data, castagnoli),
+	})
+}
+
+// writeChecksums writes the checksums of the blocks written so far.
+func (w *Writer) writeChecksums() error {
+	buf := make([]byte, 0, checksumEntrySize*len(w.checksums))
+	for _, c := range w.checksums {
+		buf = binary.BigEndian.AppendUint64(buf, c.off)
+		buf = binary.BigEndian.AppendUint32(buf, c.len)
+		buf = binary.BigEndian.AppendUint32(buf, c.crc)
+	}
+	w.checksums = nil
+	return w.writeExtension(extensionChecksums, buf)
+}
+
+// readChecksums reads the checksums, and returns where they start, or
+// r.size if there are none.
+func (r *Reader) readChecksums() (uint64, error) {
+	payload, start, err := r.readExtension(extensionChecksums, r.size)
+	if err != nil {
+		return 0, err
+	}
+	if payload == nil || len(payload)%checksumEntrySize != 0 {
+		return r.size, nil
+	}
+
+	var sums []blockChecksum
+	for b := payload; len(b) > 0; b = b[checksumEntrySize:] {
+		sums = append(sums, blockChecksum{
+			off: binary.BigEndian.Uint64(b),
+			len: binary.BigEndian.Uint32(b[8:]),
+			crc: binary.BigEndian.Uint32(b[12:]),
+		})
+	}
+	if !sort.SliceIsSorted(sums, func(i, j int) bool { return sums[i].off < sums[j].off }) {
+		return r.size, nil
+	}
+	r.checksums = sums
+	return start, nil
+}
+
+// checkBlock checks the block starting at off, given its first
+// bytes. It returns the block, read further if that was needed to
+// cover the checksummed bytes.
+func (r *Reader) checkBlock(off uint64, block []byte) ([]byte, error) {
+	dataOff := off
+	if off == 0 {
+		dataOff = uint64(headerSize(r.version))
+	}
+	i := sort.Search(len(r.checksums), func(i int) bool { return r.checksums[i].off >= dataOff })
+	if i == len(r.checksums) || r.checksums[i].off != dataOff {
+		return nil, r.corrupt(off, 0, fmt.Errorf("%w: block has no checksum", ErrChecksum))
+	}
+	c := r.checksums[i]
+
+	end := dataOff - off + uint64(c.len)
+	if uint64(len(block)) < end {
+		var err error
+		if block, err = r.getBlock(off, uint32(end)); err != nil {
+			return nil, err
+		}
+		if uint64(len(block)) < end {
+			return nil, r.corrupt(off, 0, fmt.Errorf("%w: block is truncated", ErrChecksum))
+		}
+	}
+
+	if got := crc32.Checksum(block[dataOff-off:end], castagnoli); got != c.crc {
+		return nil, r.corrupt(off, 0, fmt.Errorf("%w: got CRC32C %08x, want %08x", ErrChecksum, got, c.crc))
+	}
+	return block, nil
+}
+
+// blockStart returns the offset of the block that c covers.
+func (r *Reader) blockStart(c blockChecksum) uint64 {
+	if c.off == uint64(headerSize(r.version)) {
+		return 0
+	}
+	return c.off
+}
+
+// checkAllBlocks checks every block that has a checksum, and returns
+// the first error.
+func (r *Reader) checkAllBlocks() error {
+	for _, c := range r.checksums {
+		if _, err := r.checkBlock(r.blockStart(c), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func checksumTestRecords(n int) ([]RefRecord, []LogRecord) {
+	var refs []RefRecord
+	var logs []LogRecord
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("refs/heads/branch%04d", i)
+		refs = append(refs, RefRecord{
+			RefName:     name,
+			UpdateIndex: 1,
+			Value:       testHash(i),
+		})
+		logs = append(logs, LogRecord{
+			RefName:     name,
+			UpdateIndex: 1,
+			New:         testHash(i),
+			Message:     fmt.Sprintf("message %d\n", i),
+		})
+	}
+	return refs, logs
+}
+
+func TestTableChecksums(t *testing.T) {
+	refs, logs := checksumTestRecords(300)
+
+	for i, cfg := range []Config{
+		{BlockSize: 256, BlockChecksums: true},
+		{BlockSize: 256, BlockChecksums: true, Unaligned: true},
+		{BlockSize: 256, BlockChecksums: true, RefFilterBitsPerKey: 10},
+		{BlockSize: 4096, BlockChecksums: true, SkipIndexObjects: true},
+	} {
+		for _, contents := range []string{"refs", "logs", "both"} {
+			var rs []RefRecord
+			var ls []LogRecord
+			if contents != "logs" {
+				rs = refs
+			}
+			if contents != "refs" {
+				ls = logs
+			}
+			w, r := constructTestTable(t, rs, ls, cfg)
+			table := w.paddedWriter.out.(*bytes.Buffer).Bytes()
+
+			wantSums := w.Stats.Blocks
+			if r.refFilter != nil {
+				wantSums++
+			}
+			if len(r.checksums) != wantSums {
+				t.Fatalf("%d %s: got %d checksums, want %d", i, contents, len(r.checksums), wantSums)
+			}
+			if errs := r.Verify(); len(errs) > 0 {
+				t.Fatalf("%d %s: Verify: %v", i, contents, errs)
+			}
+
+			for _, mode := range []ChecksumVerification{ChecksumSkip, ChecksumLazy, ChecksumOnOpen} {
+				r, err := NewReaderConfig(&ByteBlockSource{table}, "buffer", &Config{ChecksumVerification: mode})
+				if err != nil {
+					t.Fatalf("%d %s: NewReaderConfig(%d): %v", i, contents, mode, err)
+				}
+				if n, err := countRecords(r); err != nil || n != len(rs)+len(ls) {
+					t.Fatalf("%d %s: got %d records, %v, want %d", i, contents, n, err, len(rs)+len(ls))
+				}
+			}
+		}
+	}
+}
+
+func TestTableWithoutChecksums(t *testing.T) {
+	refs, logs := checksumTestRecords(50)
+	w, _ := constructTestTable(t, refs, logs, Config{BlockSize: 256})
+	table := w.paddedWriter.out.(*bytes.Buffer).Bytes()
+
+	for _, mode := range []ChecksumVerification{ChecksumLazy, ChecksumOnOpen} {
+		r, err := NewReaderConfig(&ByteBlockSource{table}, "buffer", &Config{ChecksumVerification: mode})
+		if err != nil {
+			t.Fatalf("NewReaderConfig(%d): %v", mode, err)
+		}
+		if n, err := countRecords(r); err != nil || n != len(refs)+len(logs) {
+			t.Fatalf("%d: got %d records, %v, want %d", mode, n, err, len(refs)+len(logs))
+		}
+	}
+}
+
+// countRecords reads all refs and logs of a table.
+func countRecords(tab Table) (int, error) {
+	n := 0
+	for _, err := range tab.Refs("") {
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	for _, err := range tab.Logs("") {
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func TestTableChecksumMismatch(t *testing.T) {
+	refs, logs := checksumTestRecords(300)
+	w, r := constructTestTable(t, refs, logs, Config{BlockSize: 256, BlockChecksums: true})
+	table := w.paddedWriter.out.(*bytes.Buffer).Bytes()
+
+	for _, off := range []uint64{
+		uint64(headerSize(1)) + 10,
+		r.offsets[blockTypeLog].Offset + 10,
+	} {
+		corrupt := append([]byte{}, table...)
+		corrupt[off] ^= 0x01
+
+		if _, err := NewReaderConfig(&ByteBlockSource{corrupt}, "buffer", &Config{ChecksumVerification: ChecksumOnOpen}); !errors.Is(err, ErrChecksum) {
+			t.Errorf("0x%x: got error %v on open, want ErrChecksum", off, err)
+		}
+
+		r, err := NewReaderConfig(&ByteBlockSource{corrupt}, "buffer", &Config{ChecksumVerification: ChecksumLazy})
+		if err != nil {
+			t.Fatalf("0x%x: NewReaderConfig: %v", off, err)
+		}
+		if _, err := countRecords(r); !errors.Is(err, ErrChecksum) {
+			t.Errorf("0x%x: got error %v reading, want ErrChecksum", off, err)
+		}
+
+		r, err = NewReader(&ByteBlockSource{corrupt}, "buffer")
+		if err != nil {
+			t.Fatalf("0x%x: NewReader: %v", off, err)
+		}
+		found := false
+		for _, e := range r.Verify() {
+			found = found || bytes.Contains([]byte(e.Msg), []byte(ErrChecksum.Error()))
+		}
+		if !found {
+			t.Errorf("0x%x: Verify did not report the checksum mismatch", off)
+		}
+	}
+}
+
+func TestStackChecksumOnOpen(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{
+		BlockChecksums:       true,
+		ChecksumVerification: ChecksumOnOpen,
+	}
+	st, err := NewStack(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	if err := st.Add(func(w *Writer) error {
+		w.SetLimits(1, 1)
+		return w.AddRef(&RefRecord{RefName: "refs/heads/main", UpdateIndex: 1, Value: testHash(1)})
+	}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if ref, err := ReadRef(st.Merged(), "refs/heads/main"); err != nil || ref == nil {
+		t.Fatalf("ReadRef: %v, %v", ref, err)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.ref"))
+	if err != nil || len(names) != 1 {
+		t.Fatalf("Glob: %v, %v", names, err)
+	}
+	table, err := os.ReadFile(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	table[headerSize(1)+6] ^= 0x01
+	if err := os.WriteFile(names[0], table, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewStack(dir, cfg); !errors.Is(err, ErrChecksum) {
+		t.Errorf("NewStack: got %v, want ErrChecksum", err)
+	}
+}
@@ -20,8 +20,14 @@ import (
 func main() {
 	optDumpTab := flag.Bool("table", false, "dump single reftable")
 	optDumpStack := flag.Bool("stack", true, "dump a stack of reftables")
+	optSHA256 := flag.Bool("sha256", false, "the stack uses SHA-256 object IDs")
 	flag.Parse()
 
+	cfg := reftable.Config{}
+	if *optSHA256 {
+		cfg.HashID = reftable.SHA256ID
+	}
+
 	if len(flag.Args()) != 1 {
 		log.Fatalf("Need 1 argument.")
 	}
@@ -32,18 +38,18 @@ func main() {
 			log.Fatalf("dumpTableFile(%s): %v", arg, err)
 		}
 	} else if *optDumpStack {
-		if err := dumpStack(arg); err != nil {
+		if err := dumpStack(arg, cfg); err != nil {
 			log.Fatal(err)
 		}
 	} else if _, err := os.Lstat(".git"); err == nil {
-		if err := dumpStack(".git/reftable"); err != nil {
+		if err := dumpStack(".git/reftable", cfg); err != nil {
 			log.Fatal(err)
 		}
 	}
 }
 
-func dumpStack(dir string) error {
-	st, err := reftable.NewStack(dir, reftable.Config{})
+func dumpStack(dir string, cfg reftable.Config) error {
+	st, err := reftable.NewStack(dir, cfg)
 	if err != nil {
 		return err
 	}
@@ -74,44 +80,22 @@ func dumpTableFile(nm string) error {
 }
 
 func dumpTable(tab reftable.Table) error {
-	iter, err := tab.SeekRef("")
-	if err != nil {
-		return err
-	}
-
 	fmt.Printf("** REFS **\n")
 
-	for {
-		var rec reftable.RefRecord
-		ok, err := iter.NextRef(&rec)
+	for rec, err := range tab.Refs("") {
 		if err != nil {
 			return err
 		}
-		if !ok {
-			break
-		}
 
 		fmt.Printf("%#v\n", rec)
 	}
 
 	fmt.Printf("** LOGS **\n")
 
-	var neg int64
-	neg = -1
-	iter, err = tab.SeekLog("", uint64(neg))
-	if err != nil {
-		return err
-	}
-
-	for {
-		var rec reftable.LogRecord
-		ok, err := iter.NextLog(&rec)
+	for rec, err := range tab.Logs("") {
 		if err != nil {
 			return err
 		}
-		if !ok {
-			break
-		}
 
 		fmt.Printf("%#v\n", rec)
 	}
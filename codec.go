@@ -0,0 +1,165 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec compresses the records of log blocks.
+//
+// Log blocks compressed with zlib are stored as in the original
+// format. For other codecs, the block header is followed by the codec
+// ID, the varint-encoded size of the compressed data, and the data.
+// As the first byte of a zlib stream always has 8 in its low nibble,
+// codec IDs must not.
+//
+// If Config.LogCompressionWorkers is set, Compress is called from
+// several goroutines at once.
+type Codec interface {
+	// ID identifies the codec in the table.
+	ID() byte
+
+	// Compress appends the compressed form of src to dst.
+	Compress(dst, src []byte) []byte
+
+	// Decompress appends the decompressed form of src to dst.
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+// IDs of the builtin codecs. zlib has no ID, as it is stored in the
+// original format.
+const (
+	CodecIDNone   = 0x00
+	CodecIDSnappy = 0x01
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[byte]Codec{
+		CodecIDNone:   noneCodec{},
+		CodecIDSnappy: snappyCodec{},
+	}
+)
+
+// RegisterCodec makes a codec known to readers, so they can read
+// tables that were written with it. This allows for codecs outside
+// this package, such as zstd.
+func RegisterCodec(c Codec) error {
+	id := c.ID()
+	if id&0x0f == zlibMethod {
+		return fmt.Errorf("reftable: codec ID 0x%02x is ambiguous with zlib", id)
+	}
+
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, ok := codecs[id]; ok {
+		return fmt.Errorf("reftable: codec ID 0x%02x already registered", id)
+	}
+	codecs[id] = c
+	return nil
+}
+
+func lookupCodec(id byte) Codec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	return codecs[id]
+}
+
+// zlibMethod is the compression method of zlib streams, in the low
+// nibble of their first byte.
+const zlibMethod = 8
+
+// isZlib returns whether a compressed log block starting with b is a
+// zlib stream.
+func isZlib(b byte) bool {
+	return b&0x0f == zlibMethod
+}
+
+// NoCompression stores log blocks uncompressed.
+var NoCompression Codec = noneCodec{}
+
+// SnappyCompression compresses log blocks with the snappy block
+// format. It is faster than zlib, but compresses less.
+var SnappyCompression Codec = snappyCodec{}
+
+// ZlibCompression returns a codec that compresses log blocks with
+// zlib at the given level. Tables written with it can be read by any
+// reftable implementation.
+func ZlibCompression(level int) Codec {
+	return zlibCodec{level}
+}
+
+// defaultCodec is used if Config.LogCodec is unset.
+var defaultCodec = zlibCodec{zlib.BestCompression}
+
+type noneCodec struct{}
+
+func (noneCodec) ID() byte { return CodecIDNone }
+
+func (noneCodec) Compress(dst, src []byte) []byte {
+	return append(dst, src...)
+}
+
+func (noneCodec) Decompress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) ID() byte { return CodecIDSnappy }
+
+func (snappyCodec) Compress(dst, src []byte) []byte {
+	return snappyEncode(dst, src)
+}
+
+func (snappyCodec) Decompress(dst, src []byte) ([]byte, error) {
+	return snappyDecode(dst, src)
+}
+
+type zlibCodec struct {
+	level int
+}
+
+func (c zlibCodec) ID() byte {
+	// zlib streams identify themselves.
+	return zlibMethod
+}
+
+func (c zlibCodec) Compress(dst, src []byte) []byte {
+	buf := bytes.NewBuffer(dst)
+	zw, err := zlib.NewWriterLevel(buf, c.level)
+	if err != nil {
+		zw, _ = zlib.NewWriterLevel(buf, zlib.BestCompression)
+	}
+	if _, err := zw.Write(src); err != nil {
+		panic("in mem zlib write")
+	}
+	if err := zw.Close(); err != nil {
+		panic("in mem zlib close")
+	}
+	return buf.Bytes()
+}
+
+func (c zlibCodec) Decompress(dst, src []byte) ([]byte, error) {
+	out := bytes.NewBuffer(dst)
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if _, err := io.Copy(out, r); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSnappyRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 100000)
+	rnd.Read(random)
+
+	for _, in := range [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte("abcd"),
+		bytes.Repeat([]byte("a"), 1000),
+		bytes.Repeat([]byte("abcdefgh"), 1000),
+		[]byte(strings.Repeat("refs/heads/branch message\n", 300)),
+		random,
+		append(random[:70000:70000], random[:70000]...),
+	} {
+		enc := snappyEncode(nil, in)
+		dec, err := snappyDecode([]byte("prefix"), enc)
+		if err != nil {
+			t.Fatalf("len %d: snappyDecode: %v", len(in), err)
+		}
+		if !bytes.Equal(dec[6:], in) || string(dec[:6]) != "prefix" {
+			t.Fatalf("len %d: round trip mismatch", len(in))
+		}
+
+		for _, cut := range []int{1, len(enc) / 2} {
+			if cut == 0 || cut >= len(enc) {
+				continue
+			}
+			if _, err := snappyDecode(nil, enc[:len(enc)-cut]); err == nil {
+				t.Errorf("len %d: decoding truncated data succeeded", len(in))
+			}
+		}
+	}
+
+	if enc := snappyEncode(nil, bytes.Repeat([]byte("x"), 10000)); len(enc) > 500 {
+		t.Errorf("repetitive data compressed to %d bytes", len(enc))
+	}
+}
+
+// xorCodec is a toy codec for testing registration.
+type xorCodec struct{}
+
+func (xorCodec) ID() byte { return 0x42 }
+
+func (xorCodec) Compress(dst, src []byte) []byte {
+	for _, b := range src {
+		dst = append(dst, b^0xff)
+	}
+	return dst
+}
+
+func (c xorCodec) Decompress(dst, src []byte) ([]byte, error) {
+	return c.Compress(dst, src), nil
+}
+
+type ambiguousCodec struct{ xorCodec }
+
+func (ambiguousCodec) ID() byte { return 0x78 }
+
+// impostorCodec takes the ID of snappy.
+type impostorCodec struct{ xorCodec }
+
+func (impostorCodec) ID() byte { return CodecIDSnappy }
+
+func TestRegisterCodec(t *testing.T) {
+	if err := RegisterCodec(ambiguousCodec{}); err == nil {
+		t.Errorf("registered codec with zlib-like ID")
+	}
+	if err := RegisterCodec(SnappyCompression); err == nil {
+		t.Errorf("registered snappy twice")
+	}
+	if _, err := NewWriter(&bytes.Buffer{}, &Config{LogCodec: xorCodec{}}); err == nil {
+		t.Errorf("NewWriter accepted unregistered codec")
+	}
+	if _, err := NewWriter(&bytes.Buffer{}, &Config{LogCodec: impostorCodec{}}); err == nil {
+		t.Errorf("NewWriter accepted codec with the ID of snappy")
+	}
+	if _, err := NewWriter(&bytes.Buffer{}, &Config{LogCodec: ZlibCompression(10)}); err == nil {
+		t.Errorf("NewWriter accepted zlib level 10")
+	}
+	if err := RegisterCodec(xorCodec{}); err != nil {
+		t.Fatalf("RegisterCodec: %v", err)
+	}
+}
+
+func TestTableLogCodecs(t *testing.T) {
+	if lookupCodec(xorCodec{}.ID()) == nil {
+		RegisterCodec(xorCodec{})
+	}
+
+	var logs []LogRecord
+	for i := 0; i < 200; i++ {
+		logs = append(logs, LogRecord{
+			RefName:     fmt.Sprintf("refs/heads/branch%03d", i),
+			UpdateIndex: 1,
+			New:         testHash(i),
+			Old:         testHash(i + 1),
+			Name:        "Jane Doe",
+			Email:       "jane@example.com",
+			Message:     strings.Repeat("commit: some message ", 1+i%5) + "end\n",
+		})
+	}
+
+	sizes := map[string]int{}
+	for _, codec := range []Codec{nil, NoCompression, ZlibCompression(1), SnappyCompression, xorCodec{}} {
+		name := fmt.Sprintf("%T", codec)
+		for _, unaligned := range []bool{false, true} {
+			cfg := Config{
+				BlockSize: 512,
+				LogCodec:  codec,
+				Unaligned: unaligned,
+			}
+			w, reader := constructTestTable(t, nil, logs, cfg)
+			sizes[name] = w.paddedWriter.out.(*bytes.Buffer).Len()
+
+			if errs := reader.Verify(); len(errs) > 0 {
+				t.Fatalf("%s: Verify: %v", name, errs)
+			}
+
+			it, err := reader.SeekLog("", math.MaxUint64)
+			if err != nil {
+				t.Fatalf("%s: SeekLog: %v", name, err)
+			}
+			got, err := readIter(blockTypeLog, it.impl)
+			if err != nil {
+				t.Fatalf("%s: readIter: %v", name, err)
+			}
+			var want []record
+			for i := range logs {
+				want = append(want, &logs[i])
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: got %d logs, want %d", name, len(got), len(want))
+			}
+
+			for _, i := range []int{0, 77, 199} {
+				it, err := reader.SeekLog(logs[i].RefName, math.MaxUint64)
+				if err != nil {
+					t.Fatalf("SeekLog: %v", err)
+				}
+				var l LogRecord
+				if ok, err := it.NextLog(&l); !ok || err != nil || !reflect.DeepEqual(&l, &logs[i]) {
+					t.Fatalf("%s: SeekLog(%q): %v, %v, %v", name, logs[i].RefName, &l, ok, err)
+				}
+			}
+		}
+	}
+
+	if sizes["reftable.snappyCodec"] >= sizes["reftable.noneCodec"] {
+		t.Errorf("snappy did not compress: sizes %v", sizes)
+	}
+}
@@ -33,5 +33,3 @@ const blockTypeIndex = 'i'
 const blockTypeRef = 'r'
 const blockTypeObj = 'o'
 const blockTypeAny = 0
-
-const maxRestarts = (1 << 16) - 1
@@ -0,0 +1,436 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"iter"
+	"sort"
+	"sync"
+
+	"github.com/google/reftable/sst"
+)
+
+// Custom records are application-defined data, such as per-ref
+// metadata, stored alongside the refs and logs. Each record type has
+// its own block type byte and key space. In FormatV1 tables, each
+// type gets a section after the log section, with an index like the
+// other sections. The custom sections start with a marker block and
+// are followed by the custom directory, the extension (see
+// extension.go) with the payload
+//
+//	uint64(start) | (uint8(type) | uint64(off) | uint64(index off))*
+//
+// Start is the offset of the marker block. Readers skip the sections
+// of the types they don't ask for, and compaction carries all of
+// them, registered or not.
+const (
+	customMarkerSize = 4
+	customEntrySize  = 17
+)
+
+// CustomRecord is a record of an application-defined type. See
+// RegisterRecordType.
+type CustomRecord struct {
+	Type byte
+	Key  string
+
+	// Value is the payload of the record. A nil Value marks a
+	// deletion, which shadows the record in older tables.
+	Value []byte
+}
+
+var (
+	recordTypesMu sync.RWMutex
+	recordTypes   = map[byte]string{}
+)
+
+// RegisterRecordType reserves a block type byte for application-defined
+// records, which Writer.AddCustom and SeekCustom then accept. The name
+// is only used to describe the records. The types of this package,
+// 'r', 'g', 'o', 'i' and 0x01, cannot be registered.
+func RegisterRecordType(typ byte, name string) error {
+	if typ == blockTypeAny || typ == blockTypeLogObj || isBlockType(typ) {
+		return fmt.Errorf("reftable: record type 0x%02x is reserved", typ)
+	}
+
+	recordTypesMu.Lock()
+	defer recordTypesMu.Unlock()
+	if _, ok := recordTypes[typ]; ok {
+		return fmt.Errorf("reftable: record type 0x%02x already registered", typ)
+	}
+	recordTypes[typ] = name
+	return nil
+}
+
+func lookupRecordType(typ byte) (string, bool) {
+	recordTypesMu.RLock()
+	defer recordTypesMu.RUnlock()
+	name, ok := recordTypes[typ]
+	return name, ok
+}
+
+// checkRecordType returns an error unless typ is registered.
+func checkRecordType(typ byte) error {
+	if _, ok := lookupRecordType(typ); !ok {
+		return fmt.Errorf("reftable: record type 0x%02x is not registered", typ)
+	}
+	return nil
+}
+
+func (r *CustomRecord) typ() byte {
+	return r.Type
+}
+
+func (r *CustomRecord) key() string {
+	return r.Key
+}
+
+func (r *CustomRecord) copyFrom(in record) {
+	*r = *in.(*CustomRecord)
+}
+
+func (r *CustomRecord) IsDeletion() bool {
+	return r.Value == nil
+}
+
+func (r *CustomRecord) String() string {
+	name, ok := lookupRecordType(r.Type)
+	if !ok {
+		name = fmt.Sprintf("0x%02x", r.Type)
+	}
+	if r.IsDeletion() {
+		return fmt.Sprintf("%s{%s deleted}", name, r.Key)
+	}
+	return fmt.Sprintf("%s{%s %q}", name, r.Key, r.Value)
+}
+
+func (r *CustomRecord) valType() uint8 {
+	if r.IsDeletion() {
+		return 0
+	}
+	return 1
+}
+
+func (r *CustomRecord) encode(buf []byte, hashSize int) (n int, fits bool) {
+	if r.IsDeletion() {
+		return 0, true
+	}
+	n, ok := putVarInt(buf, uint64(len(r.Value)))
+	if !ok || len(buf[n:]) < len(r.Value) {
+		return 0, false
+	}
+	copy(buf[n:], r.Value)
+	return n + len(r.Value), true
+}
+
+func (r *CustomRecord) decode(buf []byte, key string, valType uint8, hashSize int) (n int, ok bool) {
+	r.Key = key
+	switch valType {
+	case 0:
+		r.Value = nil
+		return 0, true
+	case 1:
+		sz, n := sst.Varint(buf)
+		if n < 0 || sz > uint64(len(buf[n:])) {
+			return 0, false
+		}
+		r.Value = append(make([]byte, 0, sz), buf[n:n+int(sz)]...)
+		return n + int(sz), true
+	}
+	return 0, false
+}
+
+// AddCustom adds a record of a registered type to the table. Custom
+// records must be added after the refs and logs, grouped by type in
+// ascending order of the type byte, and in ascending key order within
+// a type.
+func (w *Writer) AddCustom(rec *CustomRecord) error {
+	if err := checkRecordType(rec.Type); err != nil {
+		return err
+	}
+	return w.addCustom(rec)
+}
+
+// addCustom adds a custom record of any type, so compaction can carry
+// types that are not registered.
+func (w *Writer) addCustom(rec *CustomRecord) error {
+	if rec.Key == "" {
+		return errors.New("reftable: must specify Key")
+	}
+	if rec.Type < w.customType {
+		return fmt.Errorf("%w: add %v after type 0x%02x", ErrKeyOrder, rec, w.customType)
+	}
+
+	if rec.Type != w.customType {
+		if w.customType == 0 && rec.Type != blockTypeLogObj {
+			if err := w.writeLogObjIndex(); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		if w.sst != nil {
+			err = w.startSSTSection(rec.Type)
+		} else {
+			err = w.startCustomSection()
+		}
+		if err != nil {
+			return err
+		}
+		w.customType = rec.Type
+	}
+
+	cpy := *rec
+	return w.add(&cpy)
+}
+
+// startCustomSection finishes the current section, so the next one
+// can start. Before the first custom section, it writes the marker.
+func (w *Writer) startCustomSection() error {
+	if err := w.finishPublicSection(); err != nil {
+		return err
+	}
+	if w.customType != 0 {
+		return nil
+	}
+
+	w.customStart = w.next
+	if w.next == 0 {
+		// There is no section to end, and the first block
+		// must carry the file header.
+		return nil
+	}
+
+	marker := make([]byte, customMarkerSize)
+	marker[0] = extensionBlockType(w.lastBlockType)
+	sst.PutU24(marker[1:], customMarkerSize)
+	w.addChecksum(w.next, marker)
+	w.lastBlockType = marker[0]
+	n, err := w.paddedWriter.Write(marker, 0)
+	if err != nil {
+		return err
+	}
+	w.next += uint64(n)
+	return nil
+}
+
+// customBlockStats returns the statistics for custom records of the
+// given type.
+func (w *Writer) customBlockStats(typ byte) *BlockStats {
+	if w.Stats.CustomStats == nil {
+		w.Stats.CustomStats = map[byte]*BlockStats{}
+	}
+	s := w.Stats.CustomStats[typ]
+	if s == nil {
+		s = &BlockStats{}
+		w.Stats.CustomStats[typ] = s
+	}
+	return s
+}
+
+// writeCustomDirectory writes the directory of the custom sections.
+func (w *Writer) writeCustomDirectory() error {
+	var types []byte
+	for typ := range w.Stats.CustomStats {
+		types = append(types, typ)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	buf := make([]byte, 0, 8+customEntrySize*len(types))
+	buf = binary.BigEndian.AppendUint64(buf, w.customStart)
+	for _, typ := range types {
+		s := w.Stats.CustomStats[typ]
+		buf = append(buf, typ)
+		buf = binary.BigEndian.AppendUint64(buf, s.Offset)
+		buf = binary.BigEndian.AppendUint64(buf, s.IndexOffset)
+	}
+	return w.writeExtension(extensionCustom, buf)
+}
+
+// readCustomSections reads the custom directory, which ends at end.
+// It returns where the custom sections start, or end if there are
+// none.
+func (r *Reader) readCustomSections(end uint64) (uint64, error) {
+	payload, dirStart, err := r.readExtension(extensionCustom, end)
+	if err != nil {
+		return 0, err
+	}
+	if payload == nil {
+		return end, nil
+	}
+	if len(payload) < 8 || (len(payload)-8)%customEntrySize != 0 {
+		return 0, r.corrupt(dirStart, 0, fmt.Errorf("custom directory has %d bytes", len(payload)))
+	}
+
+	start := binary.BigEndian.Uint64(payload)
+	if start > dirStart {
+		return 0, r.corrupt(dirStart, 0, fmt.Errorf("custom sections start at 0x%x", start))
+	}
+	var last byte
+	for b := payload[8:]; len(b) > 0; b = b[customEntrySize:] {
+		typ := b[0]
+		offs := readerOffsets{
+			Present:     true,
+			Offset:      binary.BigEndian.Uint64(b[1:]),
+			IndexOffset: binary.BigEndian.Uint64(b[9:]),
+		}
+		if typ <= last || isBlockType(typ) {
+			return 0, r.corrupt(dirStart, 0, fmt.Errorf("custom section of type 0x%02x out of order", typ))
+		}
+		if offs.Offset < start || offs.Offset >= dirStart || offs.IndexOffset >= dirStart {
+			return 0, r.corrupt(dirStart, 0, fmt.Errorf("custom section of type 0x%02x at 0x%x is outside [0x%x, 0x%x)",
+				typ, offs.Offset, start, dirStart))
+		}
+		r.offsets[typ] = offs
+		r.customTypes = append(r.customTypes, typ)
+		last = typ
+	}
+	return start, nil
+}
+
+// customTypesIn returns the types of the custom records in a table.
+func (r *Reader) customTypesIn() ([]byte, error) {
+	if r.sst != nil {
+		return r.customTypesSST()
+	}
+	return r.customTypes, nil
+}
+
+// customTypesIn implements the Table interface, returning the types
+// of all tables.
+func (m *Merged) customTypesIn() ([]byte, error) {
+	var present [256]bool
+	for _, t := range m.stack {
+		types, err := t.customTypesIn()
+		if err != nil {
+			return nil, fmt.Errorf("reftable: %s: %w", t.Name(), err)
+		}
+		for _, typ := range types {
+			present[typ] = true
+		}
+	}
+
+	var types []byte
+	for typ, ok := range present {
+		if ok {
+			types = append(types, byte(typ))
+		}
+	}
+	return types, nil
+}
+
+// customIterator sets the type of the records read, so callers of
+// NextCustom need not.
+type customIterator struct {
+	typ byte
+	it  iterator
+}
+
+// Next implements the Iterator interface.
+func (ci *customIterator) Next(rec record) (bool, error) {
+	if c, ok := rec.(*CustomRecord); ok {
+		c.Type = ci.typ
+	}
+	return ci.it.Next(rec)
+}
+
+// seekCustom implements SeekCustom for any table.
+func seekCustom(tab Table, typ byte, key string) (*Iterator, error) {
+	if err := checkRecordType(typ); err != nil {
+		return nil, err
+	}
+	impl, err := tab.seekRecord(&CustomRecord{Type: typ, Key: key})
+	if err != nil {
+		return nil, err
+	}
+	return &Iterator{&customIterator{typ, impl}}, nil
+}
+
+func (r *Reader) SeekCustom(typ byte, key string) (*Iterator, error) {
+	return seekCustom(r, typ, key)
+}
+
+func (m *Merged) SeekCustom(typ byte, key string) (*Iterator, error) {
+	return seekCustom(m, typ, key)
+}
+
+// NextCustom reads the next record from an iterator returned by
+// SeekCustom.
+func (it *Iterator) NextCustom(rec *CustomRecord) (bool, error) {
+	return it.impl.Next(rec)
+}
+
+// NextCustomContext is like NextCustom, but returns ctx.Err() once ctx
+// is done.
+func (it *Iterator) NextCustomContext(ctx context.Context, rec *CustomRecord) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return it.impl.Next(rec)
+}
+
+// customSeq returns the records of the given type whose key starts
+// with prefix as a sequence. It does not check the registration. An
+// error ends the sequence.
+func customSeq(tab Table, typ byte, prefix string) iter.Seq2[CustomRecord, error] {
+	return func(yield func(CustomRecord, error) bool) {
+		impl, err := tab.seekRange(&CustomRecord{Type: typ, Key: prefix}, prefixEnd(prefix))
+		if err != nil {
+			yield(CustomRecord{}, err)
+			return
+		}
+		for {
+			rec := CustomRecord{Type: typ}
+			ok, err := impl.Next(&rec)
+			if err != nil {
+				yield(CustomRecord{}, err)
+				return
+			}
+			if !ok || !yield(rec, nil) {
+				return
+			}
+		}
+	}
+}
+
+// registeredCustomSeq is customSeq for registered types.
+func registeredCustomSeq(tab Table, typ byte, prefix string) iter.Seq2[CustomRecord, error] {
+	if err := checkRecordType(typ); err != nil {
+		return func(yield func(CustomRecord, error) bool) {
+			yield(CustomRecord{}, err)
+		}
+	}
+	return customSeq(tab, typ, prefix)
+}
+
+// Custom returns the records of a registered type whose key starts
+// with prefix, in order.
+func (r *Reader) Custom(typ byte, prefix string) iter.Seq2[CustomRecord, error] {
+	return registeredCustomSeq(r, typ, prefix)
+}
+
+// Custom returns the records of a registered type whose key starts
+// with prefix, in order.
+func (m *Merged) Custom(typ byte, prefix string) iter.Seq2[CustomRecord, error] {
+	return registeredCustomSeq(m, typ, prefix)
+}
+
+// Custom is like Merged.Custom. The tables of the stack stay open
+// until the loop ends, also when it breaks early.
+func (st *Stack) Custom(typ byte, prefix string) iter.Seq2[CustomRecord, error] {
+	return func(yield func(CustomRecord, error) bool) {
+		m, release := st.Acquire()
+		defer release()
+		registeredCustomSeq(m, typ, prefix)(yield)
+	}
+}
@@ -0,0 +1,315 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+const (
+	testMetaType = 'm'
+	testPushType = 'p'
+
+	// testUnknownType is never registered.
+	testUnknownType = 'u'
+)
+
+var registerTestTypes sync.Once
+
+func registerTestRecordTypes() {
+	registerTestTypes.Do(func() {
+		RegisterRecordType(testMetaType, "meta")
+		RegisterRecordType(testPushType, "push")
+	})
+}
+
+func customTestRecords(n int) []CustomRecord {
+	var recs []CustomRecord
+	for _, typ := range []byte{testMetaType, testPushType, testUnknownType} {
+		for i := 0; i < n; i++ {
+			rec := CustomRecord{
+				Type: typ,
+				Key:  fmt.Sprintf("refs/heads/%04d", i),
+			}
+			if i%7 != 3 {
+				rec.Value = []byte(fmt.Sprintf("%c-%d", typ, i))
+			}
+			recs = append(recs, rec)
+		}
+		n /= 4
+	}
+	return recs
+}
+
+// writeCustomTable writes a table with the given records, which may
+// have unregistered types.
+func writeCustomTable(t *testing.T, cfg Config, refs []RefRecord, logs []LogRecord, custom []CustomRecord) (*Writer, *Reader) {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, &cfg)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	w.SetLimits(0, 0)
+	for _, r := range refs {
+		if err := w.AddRef(&r); err != nil {
+			t.Fatalf("AddRef: %v", err)
+		}
+	}
+	for _, l := range logs {
+		if err := w.AddLog(&l); err != nil {
+			t.Fatalf("AddLog: %v", err)
+		}
+	}
+	for _, c := range custom {
+		if err := w.addCustom(&c); err != nil {
+			t.Fatalf("addCustom: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	r, err := NewReaderConfig(&ByteBlockSource{buf.Bytes()}, "buffer", &cfg)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	return w, r
+}
+
+func readCustom(tab Table, typ byte) ([]CustomRecord, error) {
+	var recs []CustomRecord
+	for rec, err := range customSeq(tab, typ, "") {
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+func filterCustom(recs []CustomRecord, typ byte) []CustomRecord {
+	var out []CustomRecord
+	for _, rec := range recs {
+		if rec.Type == typ {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+func TestTableCustomRoundTrip(t *testing.T) {
+	registerTestRecordTypes()
+	refs, logs := verifyTestRecords(100)
+	custom := customTestRecords(300)
+
+	for _, cfg := range []Config{
+		{BlockSize: 256},
+		{BlockSize: 256, Unaligned: true},
+		{BlockSize: 256, BlockChecksums: true, RefFilterBitsPerKey: 10, ChecksumVerification: ChecksumOnOpen},
+		{BlockSize: 256, Format: FormatV2},
+	} {
+		for _, tc := range []struct {
+			refs []RefRecord
+			logs []LogRecord
+		}{
+			{refs, logs},
+			{refs, nil},
+			{nil, nil},
+		} {
+			w, r := writeCustomTable(t, cfg, tc.refs, tc.logs, custom)
+			desc := fmt.Sprintf("cfg %+v, %d refs, %d logs", cfg, len(tc.refs), len(tc.logs))
+
+			if errs := r.Verify(); len(errs) > 0 {
+				t.Fatalf("%s: Verify: %v", desc, errs)
+			}
+			if n, err := countRecords(r); err != nil || n != len(tc.refs)+len(tc.logs) {
+				t.Fatalf("%s: got %d refs and logs, %v", desc, n, err)
+			}
+			if types, err := r.customTypesIn(); err != nil || string(types) != "mpu" {
+				t.Errorf("%s: got types %q, %v", desc, types, err)
+			}
+			if cfg.Format == FormatV1 && w.Stats.CustomStats[testMetaType].IndexOffset == 0 {
+				t.Errorf("%s: meta records have no index", desc)
+			}
+
+			for _, typ := range []byte{testMetaType, testPushType, testUnknownType} {
+				got, err := readCustom(r, typ)
+				if want := filterCustom(custom, typ); err != nil || !reflect.DeepEqual(got, want) {
+					t.Fatalf("%s: got %d %c records, %v, want %d", desc, len(got), typ, err, len(want))
+				}
+			}
+
+			it, err := r.SeekCustom(testMetaType, "refs/heads/0151")
+			if err != nil {
+				t.Fatalf("%s: SeekCustom: %v", desc, err)
+			}
+			var rec CustomRecord
+			if ok, err := it.NextCustom(&rec); !ok || err != nil || rec.Key != "refs/heads/0151" || string(rec.Value) != "m-151" {
+				t.Errorf("%s: NextCustom: %v, %v, %v", desc, rec, ok, err)
+			}
+
+			n := 0
+			for rec, err := range r.Custom(testPushType, "refs/heads/001") {
+				if err != nil {
+					t.Fatalf("%s: Custom: %v", desc, err)
+				}
+				if rec.Type != testPushType {
+					t.Fatalf("%s: got %v", desc, rec)
+				}
+				n++
+			}
+			if n != 10 {
+				t.Errorf("%s: got %d push records with prefix, want 10", desc, n)
+			}
+		}
+	}
+}
+
+func TestTableCustomUnregistered(t *testing.T) {
+	registerTestRecordTypes()
+	refs, logs := verifyTestRecords(10)
+	_, r := writeCustomTable(t, Config{BlockSize: 256}, refs, logs, customTestRecords(40))
+
+	if _, err := r.SeekCustom(testUnknownType, ""); err == nil {
+		t.Errorf("SeekCustom succeeded for unregistered type")
+	}
+	for _, err := range r.Custom(testUnknownType, "") {
+		if err == nil {
+			t.Errorf("Custom succeeded for unregistered type")
+		}
+	}
+
+	// Readers stop at the sections they don't read.
+	if ref, err := ReadRef(r, refs[9].RefName); err != nil || ref == nil {
+		t.Errorf("ReadRef: %v, %v", ref, err)
+	}
+	if n, err := countRecords(r); err != nil || n != 20 {
+		t.Errorf("got %d records, %v", n, err)
+	}
+}
+
+func TestWriterCustomErrors(t *testing.T) {
+	registerTestRecordTypes()
+	for _, typ := range []byte{0, blockTypeRef, blockTypeLog, blockTypeObj, blockTypeIndex, testMetaType} {
+		if err := RegisterRecordType(typ, "x"); err == nil {
+			t.Errorf("registered type 0x%02x", typ)
+		}
+	}
+
+	for _, format := range []TableFormat{FormatV1, FormatV2} {
+		w, err := NewWriter(&bytes.Buffer{}, &Config{Format: format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddCustom(&CustomRecord{Type: testUnknownType, Key: "a", Value: []byte{}}); err == nil {
+			t.Errorf("AddCustom accepted an unregistered type")
+		}
+		if err := w.AddCustom(&CustomRecord{Type: testMetaType}); err == nil {
+			t.Errorf("AddCustom accepted an empty key")
+		}
+		if err := w.AddCustom(&CustomRecord{Type: testPushType, Key: "b", Value: []byte("v")}); err != nil {
+			t.Fatalf("AddCustom: %v", err)
+		}
+		for _, rec := range []CustomRecord{
+			{Type: testPushType, Key: "a"},
+			{Type: testMetaType, Key: "c"},
+		} {
+			if err := w.AddCustom(&rec); !errors.Is(err, ErrKeyOrder) {
+				t.Errorf("format %d: AddCustom(%v): got %v, want ErrKeyOrder", format, &rec, err)
+			}
+		}
+		if err := w.AddRef(&RefRecord{RefName: "refs/heads/a"}); !errors.Is(err, ErrKeyOrder) {
+			t.Errorf("format %d: AddRef: got %v, want ErrKeyOrder", format, err)
+		}
+		if err := w.AddLog(&LogRecord{RefName: "refs/heads/a"}); !errors.Is(err, ErrKeyOrder) {
+			t.Errorf("format %d: AddLog: got %v, want ErrKeyOrder", format, err)
+		}
+	}
+}
+
+func TestStackCustom(t *testing.T) {
+	registerTestRecordTypes()
+	for _, cfg := range []Config{
+		{BlockSize: 256},
+		{BlockSize: 256, Format: FormatV2},
+	} {
+		st, err := NewStack(t.TempDir(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer st.Close()
+		st.disableAutoCompact = true
+
+		// want has the live records, as a Stack hides deletions.
+		want := map[string]string{}
+		const N = 10
+		for i := 0; i < N; i++ {
+			if err := st.Add(func(w *Writer) error {
+				idx := st.NextUpdateIndex()
+				w.SetLimits(idx, idx)
+				if err := w.AddRef(&RefRecord{RefName: "refs/heads/main", UpdateIndex: idx, Value: testHash(i)}); err != nil {
+					return err
+				}
+
+				key := fmt.Sprintf("refs/heads/branch%d", i%3)
+				rec := CustomRecord{Type: testMetaType, Key: key}
+				if i != N-1 {
+					rec.Value = []byte(fmt.Sprint(i))
+					want[key] = string(rec.Value)
+				} else {
+					delete(want, key)
+				}
+				if err := w.AddCustom(&rec); err != nil {
+					return err
+				}
+				return w.addCustom(&CustomRecord{Type: testUnknownType, Key: fmt.Sprintf("k%02d", i), Value: []byte{}})
+			}); err != nil {
+				t.Fatalf("Add %d: %v", i, err)
+			}
+		}
+
+		check := func(compacted bool) {
+			t.Helper()
+			got := map[string]string{}
+			for rec, err := range st.Custom(testMetaType, "refs/heads/") {
+				if err != nil {
+					t.Fatalf("Custom: %v", err)
+				}
+				got[rec.Key] = string(rec.Value)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("compacted %v: got %v, want %v", compacted, got, want)
+			}
+
+			unknown, err := readCustom(st.Merged(), testUnknownType)
+			if err != nil || len(unknown) != N {
+				t.Errorf("compacted %v: got %d unregistered records, %v", compacted, len(unknown), err)
+			}
+		}
+
+		check(false)
+		if err := st.CompactAll(nil); err != nil {
+			t.Fatalf("CompactAll: %v", err)
+		}
+		if len(st.stack) != 1 {
+			t.Fatalf("got %d tables after compaction", len(st.stack))
+		}
+		check(true)
+
+		recs, err := readCustom(st.stack[0], testMetaType)
+		if err != nil || len(recs) != len(want) {
+			t.Errorf("got compacted records %v, %v, want %d", recs, err, len(want))
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"encoding/binary"
+
+	"github.com/google/reftable/sst"
+)
+
+// Extensions are the optional additions of this package to FormatV1
+// tables: the ref filter, the custom directory and the block
+// checksums. Each is a single block,
+//
+//	typ | uint24(size) | payload | uint32(size) | uint8(id) | extensionMagic
+//
+// that ends at a position the reader knows, such as the start of the
+// next section or of the footer. Readers look for the trailer there,
+// and take an extension whose trailer does not check out as absent.
+//
+// Other implementations reject block types they don't know, so typ
+// is 'r' or 'o', whichever differs from the type of the block before.
+// Readers that don't know extensions stop at the block when scanning
+// the section before, and never get to it otherwise. As they only
+// read the type, the uint24 size is capped for large extensions.
+//
+// The custom sections start with an empty block, typ | uint24(4),
+// with typ chosen the same way.
+var extensionMagic = [3]byte{'E', 'X', 'T'}
+
+// IDs of the extensions.
+const (
+	extensionRefFilter = 'f'
+	extensionCustom    = 'c'
+	extensionChecksums = 's'
+)
+
+const (
+	extensionHeaderSize  = 4
+	extensionTrailerSize = 8
+)
+
+// extensionBlockType returns the type for an extension block that
+// follows a block of type prev.
+func extensionBlockType(prev byte) byte {
+	if prev == blockTypeRef {
+		return blockTypeObj
+	}
+	return blockTypeRef
+}
+
+// writeExtension writes an extension block after the last block.
+func (w *Writer) writeExtension(id byte, payload []byte) error {
+	size := extensionHeaderSize + len(payload) + extensionTrailerSize
+	block := make([]byte, extensionHeaderSize, size)
+	block[0] = extensionBlockType(w.lastBlockType)
+	sst.PutU24(block[1:], uint32(min(size, 1<<24-1)))
+	block = append(block, payload...)
+	block = binary.BigEndian.AppendUint32(block, uint32(size))
+	block = append(block, id)
+	block = append(block, extensionMagic[:]...)
+
+	// The checksums cover all blocks but their own.
+	if id != extensionChecksums {
+		w.addChecksum(w.next, block)
+	}
+	w.lastBlockType = block[0]
+	n, err := w.paddedWriter.Write(block, 0)
+	if err != nil {
+		return err
+	}
+	w.next += uint64(n)
+	return nil
+}
+
+// readExtension reads the extension with the given ID that ends at
+// end. It returns its payload and the offset of its block, or a nil
+// payload if there is none.
+func (r *Reader) readExtension(id byte, end uint64) ([]byte, uint64, error) {
+	minSize := uint64(extensionHeaderSize + extensionTrailerSize)
+	if end < uint64(headerSize(r.version))+minSize {
+		return nil, 0, nil
+	}
+	trailer, err := r.getBlock(end-extensionTrailerSize, extensionTrailerSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(trailer) != extensionTrailerSize || trailer[4] != id || [3]byte(trailer[5:]) != extensionMagic {
+		return nil, 0, nil
+	}
+
+	size := uint64(binary.BigEndian.Uint32(trailer))
+	if size < minSize || size > end-uint64(headerSize(r.version)) {
+		return nil, 0, nil
+	}
+	start := end - size
+	block, err := r.getBlock(start, uint32(size))
+	if err != nil {
+		return nil, 0, err
+	}
+	if uint64(len(block)) != size || (block[0] != blockTypeRef && block[0] != blockTypeObj) {
+		return nil, 0, nil
+	}
+	if r.verifyChecksums && id != extensionChecksums {
+		if _, err := r.checkBlock(start, block); err != nil {
+			return nil, 0, err
+		}
+	}
+	return block[extensionHeaderSize : size-extensionTrailerSize], start, nil
+}
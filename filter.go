@@ -0,0 +1,106 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// The ref filter is a Bloom filter over the names of the refs in a
+// table, including deletions. It is the extension (see extension.go)
+// that directly follows the ref section and its index, with the
+// payload
+//
+//	uint8(k) | bits
+
+// maxFilterBits keeps the block size within 24 bits.
+const maxFilterBits = ((1 << 24) - 1 - extensionHeaderSize - 1 - extensionTrailerSize) * 8
+
+// refFilter is a Bloom filter over ref names.
+type refFilter struct {
+	k    int
+	bits []byte
+}
+
+// filterHash returns the hash of a ref name from which the k bit
+// positions are derived.
+func filterHash(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64()
+}
+
+// newRefFilter creates a filter for the given hashes.
+func newRefFilter(hashes []uint64, bitsPerKey int) *refFilter {
+	k := int(math.Round(float64(bitsPerKey) * math.Ln2))
+	if k < 1 {
+		k = 1
+	} else if k > 30 {
+		k = 30
+	}
+
+	m := len(hashes) * bitsPerKey
+	if m < 64 {
+		m = 64
+	} else if m > maxFilterBits {
+		m = maxFilterBits
+	}
+
+	f := &refFilter{
+		k:    k,
+		bits: make([]byte, (m+7)/8),
+	}
+	for _, h := range hashes {
+		f.forBits(h, func(i uint64) bool {
+			f.bits[i/8] |= 1 << (i % 8)
+			return true
+		})
+	}
+	return f
+}
+
+// forBits calls fn for the bit positions of h, until it returns
+// false.
+func (f *refFilter) forBits(h uint64, fn func(uint64) bool) {
+	m := uint64(len(f.bits)) * 8
+	h1, h2 := h&0xffffffff, h>>32
+	for i := 0; i < f.k; i++ {
+		if !fn((h1 + uint64(i)*h2) % m) {
+			return
+		}
+	}
+}
+
+// mayContain returns false if the ref is certainly not in the table.
+func (f *refFilter) mayContain(name string) bool {
+	found := true
+	f.forBits(filterHash(name), func(i uint64) bool {
+		found = f.bits[i/8]&(1<<(i%8)) != 0
+		return found
+	})
+	return found
+}
+
+// encode returns the payload of the filter extension.
+func (f *refFilter) encode() []byte {
+	return append([]byte{byte(f.k)}, f.bits...)
+}
+
+// readRefFilter reads the filter that ends at end, if there is one.
+func (r *Reader) readRefFilter(end uint64) (*refFilter, error) {
+	payload, _, err := r.readExtension(extensionRefFilter, end)
+	if err != nil || len(payload) < 1+8 || payload[0] == 0 {
+		return nil, err
+	}
+	return &refFilter{
+		k:    int(payload[0]),
+		bits: payload[1:],
+	}, nil
+}
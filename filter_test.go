@@ -0,0 +1,149 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestTableRefFilter(t *testing.T) {
+	N := 500
+	var refs []RefRecord
+	var logs []LogRecord
+	for i := 0; i < N; i++ {
+		name := fmt.Sprintf("refs/heads/branch%04d", i)
+		refs = append(refs, RefRecord{
+			RefName:     name,
+			UpdateIndex: 1,
+			Value:       testHash(i),
+		})
+		logs = append(logs, LogRecord{
+			RefName:     name,
+			UpdateIndex: 1,
+			New:         testHash(i),
+			Message:     "message\n",
+		})
+	}
+
+	for _, cfg := range []Config{
+		{BlockSize: 256, RefFilterBitsPerKey: 10},
+		{BlockSize: 256, RefFilterBitsPerKey: 10, Unaligned: true},
+		{BlockSize: 256, RefFilterBitsPerKey: 10, SkipIndexObjects: true},
+		{BlockSize: 4096, RefFilterBitsPerKey: 1},
+	} {
+		for _, withLogs := range []bool{false, true} {
+			var ls []LogRecord
+			if withLogs {
+				ls = logs
+			}
+			_, reader := constructTestTable(t, refs, ls, cfg)
+			if reader.refFilter == nil {
+				t.Fatalf("%+v: table has no ref filter", cfg)
+			}
+			if errs := reader.Verify(); len(errs) > 0 {
+				t.Fatalf("%+v: Verify: %v", cfg, errs)
+			}
+
+			// Readers that don't know the filter must skip it.
+			filter := reader.refFilter
+			reader.refFilter = nil
+			got, err := readIter(blockTypeRef, mustSeek(t, reader, ""))
+			if err != nil || len(got) != N {
+				t.Fatalf("%+v: got %d refs, %v, want %d", cfg, len(got), err, N)
+			}
+			if withLogs {
+				it, err := reader.SeekLog("", 0)
+				if err != nil {
+					t.Fatalf("SeekLog: %v", err)
+				}
+				got, err := readIter(blockTypeLog, it.impl)
+				if err != nil || len(got) != N {
+					t.Fatalf("%+v: got %d logs, %v, want %d", cfg, len(got), err, N)
+				}
+			}
+			reader.refFilter = filter
+
+			for i, r := range refs {
+				got, err := ReadRef(reader, r.RefName)
+				if err != nil || got == nil || !reflect.DeepEqual(*got, refs[i]) {
+					t.Fatalf("ReadRef(%q): %v, %v", r.RefName, got, err)
+				}
+			}
+
+			falsePositives := 0
+			for i := 0; i < N; i++ {
+				name := fmt.Sprintf("refs/tags/v%d", i)
+				if filter.mayContain(name) {
+					falsePositives++
+				} else if it, err := reader.seekRange(&RefRecord{RefName: name}, name+"\x00"); err != nil {
+					t.Fatalf("seekRange: %v", err)
+				} else if _, ok := it.(*emptyIterator); !ok {
+					t.Fatalf("seekRange(%q) got %T, want table to be skipped", name, it)
+				}
+				if got, err := ReadRef(reader, name); err != nil || got != nil {
+					t.Fatalf("ReadRef(%q): %v, %v", name, got, err)
+				}
+			}
+			if cfg.RefFilterBitsPerKey == 10 && falsePositives > N/20 {
+				t.Errorf("got %d false positives out of %d", falsePositives, N)
+			}
+		}
+	}
+
+	_, reader := constructTestTable(t, refs, logs, Config{BlockSize: 256})
+	if reader.refFilter != nil {
+		t.Errorf("table without filter has a filter")
+	}
+}
+
+func mustSeek(t *testing.T, r *Reader, name string) iterator {
+	it, err := r.SeekRef(name)
+	if err != nil {
+		t.Fatalf("SeekRef: %v", err)
+	}
+	return it.impl
+}
+
+func TestMergedRefFilter(t *testing.T) {
+	cfg := Config{RefFilterBitsPerKey: 10}
+	_, r1 := constructTestTable(t, []RefRecord{{
+		RefName:     "a",
+		UpdateIndex: 1,
+		Value:       testHash(1),
+	}, {
+		RefName:     "b",
+		UpdateIndex: 1,
+		Value:       testHash(1),
+	}}, nil, cfg)
+	_, r2 := constructTestTable(t, []RefRecord{{
+		RefName:     "a",
+		UpdateIndex: 2,
+		Value:       testHash(2),
+	}, {
+		RefName:     "b",
+		UpdateIndex: 2,
+	}}, nil, cfg)
+
+	m, err := NewMerged([]Table{r1, r2}, SHA1ID)
+	if err != nil {
+		t.Fatalf("NewMerged: %v", err)
+	}
+
+	if got, err := ReadRef(m, "a"); err != nil || got == nil || got.UpdateIndex != 2 {
+		t.Errorf("ReadRef(a): %v, %v", got, err)
+	}
+	if got, err := ReadRef(m, "b"); err != nil || got == nil || !got.IsDeletion() {
+		t.Errorf("ReadRef(b): %v, %v, want deleted", got, err)
+	}
+	if got, err := ReadRef(m, "c"); err != nil || got != nil {
+		t.Errorf("ReadRef(c): %v, %v", got, err)
+	}
+}
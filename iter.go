@@ -8,7 +8,11 @@ https://developers.google.com/open-source/licenses/bsd
 
 package reftable
 
-import "bytes"
+import (
+	"bytes"
+	"context"
+	"math"
+)
 
 type emptyIterator struct {
 }
@@ -17,10 +21,21 @@ func (e *emptyIterator) Next(record) (bool, error) {
 	return false, nil
 }
 
+// pointsTo returns whether ref points to oid, or, if abbrev is set,
+// to an object ID starting with oid.
+func pointsTo(ref *RefRecord, oid []byte, abbrev bool) bool {
+	if abbrev {
+		return bytes.HasPrefix(ref.Value, oid) || bytes.HasPrefix(ref.TargetValue, oid)
+	}
+	return bytes.Equal(ref.Value, oid) || bytes.Equal(ref.TargetValue, oid)
+}
+
 // filteringRefIterator applies filtering for `oid` to the block
 type filteringRefIterator struct {
-	// The object ID to filter for
-	oid []byte
+	// The object ID to filter for, or a prefix of it if abbrev is
+	// set.
+	oid    []byte
+	abbrev bool
 
 	// doubleCheck if set, will cause the refs to be checked
 	// against the table in `tab`.
@@ -41,20 +56,18 @@ func (fri *filteringRefIterator) Next(rec record) (bool, error) {
 		}
 
 		if fri.doubleCheck {
-			it, err := fri.tab.SeekRef(ref.RefName)
+			got, err := ReadRef(fri.tab, ref.RefName)
 			if err != nil {
 				return false, err
 			}
-
-			ok, err := it.NextRef(ref)
-
-			// XXX !ok
-			if !ok || err != nil {
-				return false, err
+			if got == nil {
+				// A newer table deletes the ref.
+				continue
 			}
+			*ref = *got
 		}
 
-		if bytes.Compare(ref.Value, fri.oid) == 0 || bytes.Compare(ref.TargetValue, fri.oid) == 0 {
+		if pointsTo(ref, fri.oid, fri.abbrev) {
 			return true, err
 		}
 	}
@@ -73,3 +86,162 @@ func (it *Iterator) NextRef(ref *RefRecord) (bool, error) {
 func (it *Iterator) NextLog(log *LogRecord) (bool, error) {
 	return it.impl.Next(log)
 }
+
+// NextRefContext is like NextRef, but returns ctx.Err() once ctx is
+// done.
+func (it *Iterator) NextRefContext(ctx context.Context, ref *RefRecord) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return it.impl.Next(ref)
+}
+
+// NextLogContext is like NextLog, but returns ctx.Err() once ctx is
+// done.
+func (it *Iterator) NextLogContext(ctx context.Context, log *LogRecord) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return it.impl.Next(log)
+}
+
+// contextIterator stops the wrapped iterator once ctx is done. It is
+// placed below filtering iterators, so scans that skip many records
+// stop promptly too.
+type contextIterator struct {
+	ctx context.Context
+	it  iterator
+}
+
+// Next implements the Iterator interface.
+func (ci *contextIterator) Next(rec record) (bool, error) {
+	if err := ci.ctx.Err(); err != nil {
+		return false, err
+	}
+	return ci.it.Next(rec)
+}
+
+// withContext wraps it, unless ctx can never be done.
+func withContext(ctx context.Context, it iterator) iterator {
+	if ctx.Done() == nil {
+		return it
+	}
+	return &contextIterator{ctx: ctx, it: it}
+}
+
+// boundedIterator stops the wrapped iterator at the first record
+// with a key >= end.
+type boundedIterator struct {
+	it  iterator
+	end string
+
+	done bool
+}
+
+// Next implements the Iterator interface.
+func (bi *boundedIterator) Next(rec record) (bool, error) {
+	if bi.done {
+		return false, nil
+	}
+	ok, err := bi.it.Next(rec)
+	if !ok || err != nil {
+		return ok, err
+	}
+	if rec.key() >= bi.end {
+		// Don't touch the wrapped iterator anymore, so it
+		// does not load blocks beyond the bound.
+		bi.done = true
+		return false, nil
+	}
+	return true, nil
+}
+
+// prefixEnd returns the smallest key beyond all keys starting with
+// prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for len(b) > 0 {
+		if b[len(b)-1] < 0xff {
+			b[len(b)-1]++
+			return string(b)
+		}
+		b = b[:len(b)-1]
+	}
+	return ""
+}
+
+// seekRefRange implements SeekRefRange for any table.
+func seekRefRange(tab Table, start, end string) (*Iterator, error) {
+	impl, err := tab.seekRange(&RefRecord{RefName: start}, end)
+	if err != nil {
+		return nil, err
+	}
+	return &Iterator{impl}, nil
+}
+
+// seekRefLog implements SeekRefLog for any table.
+func seekRefLog(tab Table, refName string) (*Iterator, error) {
+	start := &LogRecord{
+		RefName:     refName,
+		UpdateIndex: math.MaxUint64,
+	}
+
+	// Log keys are the ref name, a NUL byte and the reversed
+	// update index.
+	impl, err := tab.seekRange(start, refName+"\x01")
+	if err != nil {
+		return nil, err
+	}
+	return &Iterator{impl}, nil
+}
+
+// seekLogByTime implements SeekLogByTime for any table. Log times
+// are taken to grow with the update index, so the entry is found by
+// a binary search over update indices, at a seek per probe.
+func seekLogByTime(tab Table, refName string, t uint64) (*Iterator, error) {
+	newest, err := ReadLogAt(tab, refName, math.MaxUint64)
+	if err != nil || newest == nil {
+		return &Iterator{&emptyIterator{}}, err
+	}
+
+	if newest.Time <= t {
+		return seekLogAt(tab, newest)
+	}
+
+	// The entry sought has an update index in [lo, hi), unless it
+	// is found, the newest entry below lo.
+	var found *LogRecord
+	lo, hi := uint64(0), newest.UpdateIndex
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		log, err := ReadLogAt(tab, refName, mid)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case log == nil || log.UpdateIndex < lo:
+			lo = mid + 1
+		case log.Time <= t:
+			found, lo = log, mid+1
+		default:
+			hi = log.UpdateIndex
+		}
+	}
+	if found == nil {
+		return &Iterator{&emptyIterator{}}, nil
+	}
+	return seekLogAt(tab, found)
+}
+
+// seekLogAt returns an iterator over the log records of log's ref,
+// starting at log.
+func seekLogAt(tab Table, log *LogRecord) (*Iterator, error) {
+	impl, err := tab.seekRange(&LogRecord{
+		RefName:     log.RefName,
+		UpdateIndex: log.UpdateIndex,
+	}, log.RefName+"\x01")
+	if err != nil {
+		return nil, err
+	}
+	return &Iterator{impl}, nil
+}
@@ -0,0 +1,377 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/google/reftable/sst"
+)
+
+// The log obj index maps the object IDs of log records to the log
+// blocks that have them, like the obj section does for refs. See
+// Config.IndexLogObjects. It is stored as custom records of type
+// blockTypeLogObj, so it gets a custom section in FormatV1 tables,
+// and readers that predate it skip it. The key of a record is a full
+// object ID, and the value is
+//
+//	varint(count) | varint(first offset) | varint(delta)*
+//
+// listing the log block offsets in ascending order. An object ID in
+// too many blocks to list has an empty value, and readers scan the
+// log section for it. The index comes
+// before the custom sections of applications, and compaction rebuilds
+// it rather than copying it.
+const blockTypeLogObj = 0x01
+
+// encodeLogOffsets encodes ascending block offsets.
+func encodeLogOffsets(offsets []uint64) []byte {
+	var buf [10]byte
+	n, _ := putVarInt(buf[:], uint64(len(offsets)))
+	out := append([]byte{}, buf[:n]...)
+
+	last := uint64(0)
+	for _, off := range offsets {
+		n, _ := putVarInt(buf[:], off-last)
+		out = append(out, buf[:n]...)
+		last = off
+	}
+	return out
+}
+
+// decodeLogOffsets decodes the value of a log obj record.
+func decodeLogOffsets(b []byte) ([]uint64, error) {
+	count, n := sst.Varint(b)
+	if n < 0 || count > uint64(len(b)) {
+		return nil, errors.New("bad log obj offset count")
+	}
+	b = b[n:]
+
+	offsets := make([]uint64, 0, count)
+	last := uint64(0)
+	for i := uint64(0); i < count; i++ {
+		delta, n := sst.Varint(b)
+		if n < 0 || (i > 0 && delta == 0) {
+			return nil, errors.New("bad log obj offset")
+		}
+		b = b[n:]
+		last += delta
+		offsets = append(offsets, last)
+	}
+	if len(b) > 0 {
+		return nil, fmt.Errorf("log obj record has %d trailing bytes", len(b))
+	}
+	return offsets, nil
+}
+
+// indexLogHash records that the current log block has a record with
+// the given object ID. FormatV1 tables record the block number, as
+// log blocks may be queued for compression, and their offsets are
+// known only once they are written.
+func (w *Writer) indexLogHash(hash []byte) {
+	if w.logObjIndex == nil || hash == nil {
+		return
+	}
+	pos := uint64(w.Stats.LogStats.Blocks)
+	if w.sst != nil {
+		pos = w.sst.Offset()
+	}
+
+	str := string(hash)
+	l := w.logObjIndex[str]
+	if len(l) > 0 && l[len(l)-1] == pos {
+		return
+	}
+	w.logObjIndex[str] = append(l, pos)
+}
+
+// writeLogObjIndex ends the log section, and adds the log obj index,
+// if there is one.
+func (w *Writer) writeLogObjIndex() error {
+	if len(w.logObjIndex) == 0 {
+		return nil
+	}
+	if w.sst == nil {
+		if err := w.finishPublicSection(); err != nil {
+			return err
+		}
+	}
+
+	oids := make([]string, 0, len(w.logObjIndex))
+	for k := range w.logObjIndex {
+		oids = append(oids, k)
+	}
+	sort.Strings(oids)
+
+	// Like the obj section, leave out offsets that would take up
+	// much of a block.
+	limit := int(w.cfg.sectionBlockSize(blockTypeLogObj)) / 2
+	for _, oid := range oids {
+		offsets := w.logObjIndex[oid]
+		if w.sst == nil {
+			for i, n := range offsets {
+				offsets[i] = w.logBlockOffsets[n]
+			}
+		}
+		rec := &CustomRecord{
+			Type:  blockTypeLogObj,
+			Key:   oid,
+			Value: encodeLogOffsets(offsets),
+		}
+		if len(rec.Value) > limit {
+			rec.Value = nil
+		}
+		if err := w.addCustom(rec); err != nil {
+			return err
+		}
+	}
+	w.logObjIndex = nil
+	return nil
+}
+
+func logPointsTo(log *LogRecord, oid []byte) bool {
+	return bytes.Equal(log.New, oid) || bytes.Equal(log.Old, oid)
+}
+
+// filteringLogIterator returns the log records of it that have oid.
+type filteringLogIterator struct {
+	oid []byte
+
+	// doubleCheck if set, will cause the records to be checked
+	// against the table in tab.
+	doubleCheck bool
+	tab         Table
+
+	it iterator
+}
+
+// Next implements the Iterator interface.
+func (fli *filteringLogIterator) Next(rec record) (bool, error) {
+	log := rec.(*LogRecord)
+	for {
+		ok, err := fli.it.Next(log)
+		if !ok || err != nil {
+			return false, err
+		}
+
+		if fli.doubleCheck {
+			it, err := fli.tab.SeekLog(log.RefName, log.UpdateIndex)
+			if err != nil {
+				return false, err
+			}
+			name, idx := log.RefName, log.UpdateIndex
+			ok, err := it.NextLog(log)
+			if err != nil {
+				return false, err
+			}
+			if !ok || log.RefName != name || log.UpdateIndex != idx {
+				continue
+			}
+		}
+
+		if logPointsTo(log, fli.oid) {
+			return true, nil
+		}
+	}
+}
+
+// LogsFor returns the log records whose New or Old is oid. If the
+// table has a log obj index, only the listed log blocks are read.
+func (r *Reader) LogsFor(oid []byte) (*Iterator, error) {
+	offsets, ok, err := r.logObjOffsets(oid)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if len(offsets) == 0 {
+			return &Iterator{&emptyIterator{}}, nil
+		}
+		if r.sst != nil {
+			return &Iterator{&sstIndexedLogIter{r: r, oid: oid, offsets: offsets}}, nil
+		}
+		it := &indexedTableLogIter{r: r, oid: oid, offsets: offsets}
+		if err := it.nextBlock(); err != nil {
+			return nil, err
+		}
+		return &Iterator{it}, nil
+	}
+
+	logs, err := r.seekRecord(&LogRecord{})
+	if err != nil {
+		return nil, err
+	}
+	return &Iterator{&filteringLogIterator{
+		oid: oid,
+		it:  logs,
+	}}, nil
+}
+
+// logObjOffsets looks up the log blocks that have records with oid
+// in the log obj index. It returns false if the table has no index,
+// or the index does not list the blocks for oid.
+func (r *Reader) logObjOffsets(oid []byte) ([]uint64, bool, error) {
+	it, err := r.seekRecord(&CustomRecord{Type: blockTypeLogObj})
+	if err != nil {
+		return nil, false, err
+	}
+	rec := CustomRecord{Type: blockTypeLogObj}
+	ok, err := it.Next(&rec)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	if rec.Key < string(oid) {
+		if it, err = r.seekRecord(&CustomRecord{Type: blockTypeLogObj, Key: string(oid)}); err != nil {
+			return nil, false, err
+		}
+		if ok, err = it.Next(&rec); err != nil {
+			return nil, false, err
+		}
+	}
+	if !ok || rec.Key != string(oid) {
+		return nil, true, nil
+	}
+	if len(rec.Value) == 0 {
+		return nil, false, nil
+	}
+
+	offsets, err := decodeLogOffsets(rec.Value)
+	if err != nil {
+		return nil, false, r.corrupt(r.offsets[blockTypeLogObj].Offset, blockTypeLogObj,
+			fmt.Errorf("object %x: %w", oid, err))
+	}
+	return offsets, true, nil
+}
+
+// indexedTableLogIter returns the log records with a given object ID
+// from the given log blocks.
+type indexedTableLogIter struct {
+	r   *Reader
+	oid []byte
+
+	// block offsets of remaining log blocks to look into
+	offsets  []uint64
+	cur      blockIter
+	finished bool
+}
+
+func (i *indexedTableLogIter) nextBlock() error {
+	if len(i.offsets) == 0 {
+		i.finished = true
+		return nil
+	}
+	nextOff := i.offsets[0]
+	i.offsets = i.offsets[1:]
+
+	br, err := i.r.newBlockReader(nextOff, blockTypeLog)
+	if err != nil {
+		return err
+	}
+	if br == nil {
+		return i.r.corrupt(nextOff, blockTypeLogObj, errors.New("indexed log block does not exist"))
+	}
+
+	br.start(&i.cur)
+	return nil
+}
+
+// Next implements the Iterator interface.
+func (i *indexedTableLogIter) Next(rec record) (bool, error) {
+	log := rec.(*LogRecord)
+	for {
+		if i.finished {
+			return false, nil
+		}
+		ok, err := i.cur.Next(log)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			if err := i.nextBlock(); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		if logPointsTo(log, i.oid) {
+			return true, nil
+		}
+	}
+}
+
+// sstIndexedLogIter returns the log records with a given object ID
+// from the given log blocks of a v2 table.
+type sstIndexedLogIter struct {
+	r   *Reader
+	oid []byte
+
+	// offsets of the remaining blocks.
+	offsets []uint64
+
+	off     uint64
+	entries []sst.Entry
+}
+
+// Next implements the Iterator interface.
+func (i *sstIndexedLogIter) Next(rec record) (bool, error) {
+	log := rec.(*LogRecord)
+	for {
+		for len(i.entries) > 0 {
+			e := i.entries[0]
+			i.entries = i.entries[1:]
+			if err := i.r.decodeSST(e, log); err != nil {
+				return false, i.r.corrupt(i.off, blockTypeLog, err)
+			}
+			if logPointsTo(log, i.oid) {
+				return true, nil
+			}
+		}
+		if len(i.offsets) == 0 {
+			return false, nil
+		}
+
+		i.off = i.offsets[0]
+		i.offsets = i.offsets[1:]
+		entries, err := i.r.sst.Block(i.off)
+		if err != nil {
+			return false, sstError(err)
+		}
+		i.entries = entries
+	}
+}
+
+// LogsFor returns the log records whose New or Old is oid, leaving
+// out those that newer tables replace by records without oid.
+func (m *Merged) LogsFor(oid []byte) (*Iterator, error) {
+	mit := &mergedIter{
+		typ:    blockTypeLog,
+		merged: m,
+	}
+	for _, t := range m.stack {
+		it, err := t.LogsFor(oid)
+		if err != nil {
+			return nil, err
+		}
+		mit.stack = append(mit.stack, it.impl)
+		mit.names = append(mit.names, t.Name())
+	}
+
+	if err := mit.init(); err != nil {
+		return nil, err
+	}
+	return &Iterator{&filteringLogIterator{
+		tab:         m,
+		oid:         oid,
+		it:          mit,
+		doubleCheck: true,
+	}}, nil
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// logObjTestRecords returns logs of n refs, with three entries each,
+// which share object IDs across refs.
+func logObjTestRecords(n int) []LogRecord {
+	var logs []LogRecord
+	for i := 0; i < n; i++ {
+		for j := 2; j >= 0; j-- {
+			log := LogRecord{
+				RefName:     fmt.Sprintf("refs/heads/%04d", i),
+				UpdateIndex: uint64(j + 1),
+				New:         testHash(i/5 + j),
+				Message:     fmt.Sprintf("update %d", j),
+			}
+			if j > 0 {
+				log.Old = testHash(i/5 + j - 1)
+			}
+			logs = append(logs, log)
+		}
+	}
+	return logs
+}
+
+// logKeys returns the ref names and update indices of the logs.
+func logKeys(logs []record) []string {
+	var keys []string
+	for _, rec := range logs {
+		l := rec.(*LogRecord)
+		keys = append(keys, fmt.Sprintf("%s@%d", l.RefName, l.UpdateIndex))
+	}
+	return keys
+}
+
+func readLogsFor(t *testing.T, tab Table, oid []byte) []string {
+	t.Helper()
+	it, err := tab.LogsFor(oid)
+	if err != nil {
+		t.Fatalf("LogsFor: %v", err)
+	}
+	got, err := readIter(blockTypeLog, it.impl)
+	if err != nil {
+		t.Fatalf("readIter: %v", err)
+	}
+	return logKeys(got)
+}
+
+func TestTableLogsFor(t *testing.T) {
+	logs := logObjTestRecords(200)
+
+	for _, cfg := range []Config{
+		{BlockSize: 256},
+		{BlockSize: 256, IndexLogObjects: true},
+		{BlockSize: 256, IndexLogObjects: true, Unaligned: true},
+		{BlockSize: 256, IndexLogObjects: true, LogCompressionWorkers: 4, BlockChecksums: true},
+		{BlockSize: 256, Format: FormatV2},
+		{BlockSize: 256, IndexLogObjects: true, Format: FormatV2},
+	} {
+		w, r := constructTestTable(t, nil, logs, cfg)
+		if errs := r.Verify(); len(errs) > 0 {
+			t.Fatalf("%+v: Verify: %v", cfg, errs)
+		}
+		if w.Stats.LogStats.Blocks < 10 {
+			t.Fatalf("%+v: got %d log blocks", cfg, w.Stats.LogStats.Blocks)
+		}
+		if _, ok := w.Stats.CustomStats[blockTypeLogObj]; ok != cfg.IndexLogObjects {
+			t.Errorf("%+v: got log obj index %v", cfg, ok)
+		}
+
+		for _, oid := range [][]byte{testHash(0), testHash(7), testHash(41), testHash(1000)} {
+			var want []string
+			for i := range logs {
+				if logPointsTo(&logs[i], oid) {
+					want = append(want, fmt.Sprintf("%s@%d", logs[i].RefName, logs[i].UpdateIndex))
+				}
+			}
+			if got := readLogsFor(t, r, oid); !reflect.DeepEqual(got, want) {
+				t.Errorf("%+v: LogsFor(%x): got %v, want %v", cfg, oid[:8], got, want)
+			}
+		}
+	}
+}
+
+func TestTableLogsForCommonObject(t *testing.T) {
+	// Every entry has the same old value, so its blocks do not fit
+	// in the index.
+	var logs []LogRecord
+	for i := 0; i < 1000; i++ {
+		logs = append(logs, LogRecord{
+			RefName:     fmt.Sprintf("refs/heads/%04d", i),
+			UpdateIndex: 1,
+			New:         testHash(i),
+			Old:         testHash(1),
+			Message:     "update",
+		})
+	}
+	for _, format := range []TableFormat{FormatV1, FormatV2} {
+		_, r := constructTestTable(t, nil, logs, Config{BlockSize: 256, IndexLogObjects: true, Format: format})
+		if offsets, ok, err := r.logObjOffsets(testHash(1)); err != nil || ok {
+			t.Errorf("format %d: got offsets %v, %v, %v", format, offsets, ok, err)
+		}
+		if got := readLogsFor(t, r, testHash(1)); len(got) != len(logs) {
+			t.Errorf("format %d: got %d logs, want %d", format, len(got), len(logs))
+		}
+		if got := readLogsFor(t, r, testHash(7)); len(got) != 1 {
+			t.Errorf("format %d: got logs %v for a single entry", format, got)
+		}
+	}
+}
+
+func TestWriterLogObjReserved(t *testing.T) {
+	if err := RegisterRecordType(blockTypeLogObj, "x"); err == nil {
+		t.Errorf("registered the log obj type")
+	}
+}
+
+func TestStackLogsFor(t *testing.T) {
+	for _, format := range []TableFormat{FormatV1, FormatV2} {
+		cfg := Config{
+			BlockSize:       256,
+			IndexLogObjects: true,
+			Format:          format,
+		}
+		st, err := NewStack(t.TempDir(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer st.Close()
+		st.disableAutoCompact = true
+
+		// Each table adds a log entry to every ref. The last one
+		// also rewrites the previous entry of ref 3.
+		const N = 4
+		oid := testHash(100)
+		for i := 0; i < N; i++ {
+			if err := st.Add(func(w *Writer) error {
+				idx := st.NextUpdateIndex()
+				w.SetLimits(idx, idx)
+				for j := 0; j < 10; j++ {
+					name := fmt.Sprintf("refs/heads/%d", j)
+					log := LogRecord{
+						RefName:     name,
+						UpdateIndex: idx,
+						New:         testHash(j + int(idx)),
+						Old:         oid,
+						Message:     "update",
+					}
+					if err := w.AddLog(&log); err != nil {
+						return err
+					}
+					if i == N-1 && j == 3 {
+						log.UpdateIndex = idx - 1
+						log.Old = testHash(1)
+						if err := w.AddLog(&log); err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Fatalf("Add %d: %v", i, err)
+			}
+		}
+
+		var want []string
+		for j := 0; j < 10; j++ {
+			for idx := N; idx > 0; idx-- {
+				if j != 3 || idx != N-1 {
+					want = append(want, fmt.Sprintf("refs/heads/%d@%d", j, idx))
+				}
+			}
+		}
+
+		if got := readLogsFor(t, st.Merged(), oid); !reflect.DeepEqual(got, want) {
+			t.Errorf("format %d: got %v, want %v", format, got, want)
+		}
+		if err := st.CompactAll(nil); err != nil {
+			t.Fatalf("CompactAll: %v", err)
+		}
+		if len(st.stack) != 1 {
+			t.Fatalf("got %d tables after compaction", len(st.stack))
+		}
+		if got := readLogsFor(t, st.Merged(), oid); !reflect.DeepEqual(got, want) {
+			t.Errorf("format %d: after compaction, got %v, want %v", format, got, want)
+		}
+
+		if offsets, ok, err := st.stack[0].logObjOffsets(oid); err != nil || !ok || len(offsets) == 0 {
+			t.Errorf("format %d: compacted table has offsets %v, %v, %v", format, offsets, ok, err)
+		}
+	}
+}
@@ -9,102 +9,104 @@ https://developers.google.com/open-source/licenses/bsd
 package reftable
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 )
 
-// pqEntry is an entry of the priority queue
-type pqEntry struct {
-	rec   record
-	index int
+// loserTree is a tournament tree, which picks the first of the heads
+// of the subiterators of a merge. Node n has the children 2n and
+// 2n+1, and the leaves k..2k-1 stand for the heads 0..k-1. Each inner
+// node keeps the loser of the match between its children, and node 0
+// the overall winner, so a new head only replays the matches on the
+// path from its leaf to the root, one comparison per level.
+type loserTree struct {
+	// heads are the next records of the subiterators, or nil for
+	// those that are done. keys caches their keys.
+	heads []record
+	keys  []string
+	nodes []int
+
+	reverse bool
 }
 
-func (e pqEntry) String() string {
-	return fmt.Sprintf("%s,%d", e.rec.key(), e.index)
-}
-
-func pqLess(a, b pqEntry) bool {
-	if a.rec.key() == b.rec.key() {
-		return a.index > b.index
+// beats returns whether head a comes before head b. Done heads come
+// last, and among equal keys, the head of the newest table comes
+// first.
+func (t *loserTree) beats(a, b int) bool {
+	if t.heads[a] == nil {
+		return false
 	}
-
-	return a.rec.key() < b.rec.key()
+	if t.heads[b] == nil {
+		return true
+	}
+	if ka, kb := t.keys[a], t.keys[b]; ka != kb {
+		return (ka < kb) != t.reverse
+	}
+	return a > b
 }
 
-// a min heap
-type mergedIterPQueue struct {
-	heap []pqEntry
+// init plays all matches.
+func (t *loserTree) init() {
+	t.nodes = make([]int, len(t.heads))
+	if len(t.heads) > 0 {
+		t.nodes[0] = t.play(1)
+	}
 }
 
-func (pq *mergedIterPQueue) isEmpty() bool {
-	return len(pq.heap) == 0
+// play plays the matches below node, and returns the winner.
+func (t *loserTree) play(node int) int {
+	k := len(t.heads)
+	if node >= k {
+		return node - k
+	}
+	a, b := t.play(2*node), t.play(2*node+1)
+	if t.beats(b, a) {
+		a, b = b, a
+	}
+	t.nodes[node] = b
+	return a
 }
 
-func (pq *mergedIterPQueue) top() pqEntry {
-	return pq.heap[0]
+// winner returns the index of the first head.
+func (t *loserTree) winner() int {
+	return t.nodes[0]
 }
 
-func (pq *mergedIterPQueue) check() {
-	for i := 1; i < len(pq.heap); i++ {
-		par := (i - 1) / 2
-
-		if !pqLess(pq.heap[par], pq.heap[i]) {
-			log.Panicf("%v %v %d", pq.heap[par], pq.heap[i], i)
-		}
+// set replaces head i, which must be the winner, and replays its
+// matches.
+func (t *loserTree) set(i int, head record) {
+	t.heads[i] = head
+	if head != nil {
+		t.keys[i] = head.key()
 	}
-}
-
-func (pq *mergedIterPQueue) remove() pqEntry {
-	e := pq.heap[0]
-
-	pq.heap[0] = pq.heap[len(pq.heap)-1]
-	pq.heap = pq.heap[:len(pq.heap)-1]
-
-	i := 0
-	for i < len(pq.heap) {
-		min := i
-		j, k := 2*i+1, 2*i+2
 
-		if j < len(pq.heap) && pqLess(pq.heap[j], pq.heap[i]) {
-			min = j
+	w := i
+	for node := (i + len(t.heads)) / 2; node > 0; node /= 2 {
+		if t.beats(t.nodes[node], w) {
+			t.nodes[node], w = w, t.nodes[node]
 		}
-		if k < len(pq.heap) && pqLess(pq.heap[k], pq.heap[min]) {
-			min = k
-		}
-
-		if min == i {
-			break
-		}
-
-		pq.heap[i], pq.heap[min] = pq.heap[min], pq.heap[i]
-		i = min
 	}
-
-	return e
+	t.nodes[0] = w
 }
 
-func (pq *mergedIterPQueue) add(e pqEntry) {
-	pq.heap = append(pq.heap, e)
-	i := len(pq.heap) - 1
-	for i > 0 {
-		j := (i - 1) / 2
-
-		if pqLess(pq.heap[j], pq.heap[i]) {
-
-			break
-		}
-
-		pq.heap[j], pq.heap[i] = pq.heap[i], pq.heap[j]
-		i = j
-	}
-}
-
-// Merged is a stack of reftables.
+// Merged is a stack of reftables. A Merged is immutable, so it may be
+// used from several goroutines at once, as long as its tables can.
+// Iterators must not be shared between goroutines.
 type Merged struct {
 	stack  []Table
 	hashID HashID
 
 	suppressDeletions bool
+
+	// view is set for the point-in-time views of AsOf, which hide
+	// the records newer than asOf.
+	view bool
+	asOf uint64
+
+	// release drops the table references of a view that
+	// Stack.AsOf returned.
+	release func()
 }
 
 func (m *Merged) HashID() HashID {
@@ -133,25 +135,80 @@ func NewMerged(tabs []Table, hashID [4]byte) (*Merged, error) {
 
 // MaxUpdateIndex implements the Table interface.
 func (m *Merged) MaxUpdateIndex() uint64 {
-	return m.stack[len(m.stack)].MaxUpdateIndex()
+	if len(m.stack) == 0 {
+		return 0
+	}
+	max := m.stack[len(m.stack)-1].MaxUpdateIndex()
+	if m.view && m.asOf < max {
+		max = m.asOf
+	}
+	return max
 }
 
 // MinUpdateIndex implements the Table interface.
 func (m *Merged) MinUpdateIndex() uint64 {
+	if len(m.stack) == 0 {
+		return 0
+	}
 	return m.stack[0].MinUpdateIndex()
 }
 
 // RefsFor returns the refs that point to the given oid
 func (m *Merged) RefsFor(oid []byte) (*Iterator, error) {
+	return m.RefsForContext(context.Background(), oid)
+}
+
+// RefsForContext is like RefsFor, but stops with ctx.Err() once ctx
+// is done.
+func (m *Merged) RefsForContext(ctx context.Context, oid []byte) (*Iterator, error) {
+	return m.refsFor(ctx, oid, false, func(t Table) (*Iterator, error) {
+		return t.RefsForContext(ctx, oid)
+	})
+}
+
+// RefsForPrefix returns the refs that point to an object ID starting
+// with abbrev.
+func (m *Merged) RefsForPrefix(abbrev []byte) (*Iterator, error) {
+	if len(abbrev) == 0 {
+		return nil, errors.New("reftable: empty object ID prefix")
+	}
+	return m.refsFor(context.Background(), abbrev, true, func(t Table) (*Iterator, error) {
+		return t.RefsForPrefix(abbrev)
+	})
+}
+
+// refsFor merges the refs returned by tableRefs for each table, and
+// drops those that newer tables change to point elsewhere.
+func (m *Merged) refsFor(ctx context.Context, oid []byte, abbrev bool, tableRefs func(t Table) (*Iterator, error)) (*Iterator, error) {
+	if m.view {
+		// The obj indices of the tables don't know the refs
+		// that the view takes from logs.
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		it, err := m.seekRecord(&RefRecord{})
+		if err != nil {
+			return nil, err
+		}
+		return &Iterator{&filteringRefIterator{
+			tab:    m,
+			oid:    oid,
+			abbrev: abbrev,
+			it:     withContext(ctx, it),
+		}}, nil
+	}
+
 	mit := &mergedIter{
-		typ: blockTypeRef,
+		typ:    blockTypeRef,
+		merged: m,
 	}
 	for _, t := range m.stack {
-		it, err := t.RefsFor(oid)
+		it, err := tableRefs(t)
 		if err != nil {
 			return nil, err
 		}
 		mit.stack = append(mit.stack, it.impl)
+		mit.names = append(mit.names, t.Name())
 	}
 
 	if err := mit.init(); err != nil {
@@ -160,7 +217,8 @@ func (m *Merged) RefsFor(oid []byte) (*Iterator, error) {
 	return &Iterator{&filteringRefIterator{
 		tab:         m,
 		oid:         oid,
-		it:          mit,
+		abbrev:      abbrev,
+		it:          withContext(ctx, mit),
 		doubleCheck: true,
 	}}, nil
 }
@@ -176,6 +234,13 @@ func (m *Merged) Name() string {
 
 // Seek returns an iterator positioned before the wanted record.
 func (m *Merged) SeekLog(refname string, updateIndex uint64) (*Iterator, error) {
+	return m.SeekLogContext(context.Background(), refname, updateIndex)
+}
+
+func (m *Merged) SeekLogContext(ctx context.Context, refname string, updateIndex uint64) (*Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	log := LogRecord{
 		RefName:     refname,
 		UpdateIndex: updateIndex,
@@ -184,10 +249,17 @@ func (m *Merged) SeekLog(refname string, updateIndex uint64) (*Iterator, error)
 	if err != nil {
 		return nil, err
 	}
-	return &Iterator{impl}, nil
+	return &Iterator{withContext(ctx, impl)}, nil
 }
 
 func (m *Merged) SeekRef(name string) (*Iterator, error) {
+	return m.SeekRefContext(context.Background(), name)
+}
+
+func (m *Merged) SeekRefContext(ctx context.Context, name string) (*Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	ref := RefRecord{
 		RefName: name,
 	}
@@ -195,16 +267,81 @@ func (m *Merged) SeekRef(name string) (*Iterator, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Iterator{impl}, nil
+	return &Iterator{withContext(ctx, impl)}, nil
 }
 
 func (m *Merged) seekRecord(rec record) (iterator, error) {
+	return m.seekMerged(rec, false, "")
+}
+
+func (m *Merged) seekRecordReverse(rec record) (iterator, error) {
+	return m.seekMerged(rec, true, "")
+}
+
+// seekRange implements the Table interface. Each table is bounded
+// separately, so tables without keys in the range drop out of the
+// merge right away.
+func (m *Merged) seekRange(rec record, end string) (iterator, error) {
+	return m.seekMerged(rec, false, end)
+}
+
+func (m *Merged) SeekRefPrefix(prefix string) (*Iterator, error) {
+	return seekRefRange(m, prefix, prefixEnd(prefix))
+}
+
+func (m *Merged) SeekRefRange(start, end string) (*Iterator, error) {
+	return seekRefRange(m, start, end)
+}
+
+func (m *Merged) SeekRefLog(refName string) (*Iterator, error) {
+	return seekRefLog(m, refName)
+}
+
+func (m *Merged) SeekLogByTime(refName string, t uint64) (*Iterator, error) {
+	return seekLogByTime(m, refName, t)
+}
+
+// SeekRefReverse returns an iterator that returns refs in descending
+// order, starting at the last ref whose name is <= name.
+func (m *Merged) SeekRefReverse(name string) (*Iterator, error) {
+	impl, err := m.seekRecordReverse(&RefRecord{RefName: name})
+	if err != nil {
+		return nil, err
+	}
+	return &Iterator{impl}, nil
+}
+
+// SeekLogReverse returns an iterator that returns log records in
+// descending order, starting at the given record.
+func (m *Merged) SeekLogReverse(name string, updateIndex uint64) (*Iterator, error) {
+	impl, err := m.seekRecordReverse(&LogRecord{RefName: name, UpdateIndex: updateIndex})
+	if err != nil {
+		return nil, err
+	}
+	return &Iterator{impl}, nil
+}
+
+func (m *Merged) seekMerged(rec record, reverse bool, end string) (iterator, error) {
 	var its []iterator
 	var names []string
+	if span := m.spanningTable(); m.view && span != nil && rec.typ() == blockTypeRef {
+		it, err := m.seekLoggedRefs(span, rec.key(), reverse, end)
+		if err != nil {
+			return nil, fmt.Errorf("reftable: seek logs of %s: %w", span.Name(), err)
+		}
+		its = append(its, it)
+		names = append(names, span.Name()+" logs")
+	}
 	for _, t := range m.stack {
-		iter, err := t.seekRecord(rec)
+		var iter iterator
+		var err error
+		if reverse {
+			iter, err = t.seekRecordReverse(rec)
+		} else {
+			iter, err = t.seekRange(rec, end)
+		}
 		if err != nil {
-			return nil, fmt.Errorf("reftable: seek %s: %v", t.Name(), err)
+			return nil, fmt.Errorf("reftable: seek %s: %w", t.Name(), err)
 		}
 		its = append(its, iter)
 		names = append(names, t.Name())
@@ -212,9 +349,11 @@ func (m *Merged) seekRecord(rec record) (iterator, error) {
 
 	merged := &mergedIter{
 		typ:               rec.typ(),
+		reverse:           reverse,
 		suppressDeletions: m.suppressDeletions,
 		stack:             its,
 		names:             names,
+		merged:            m,
 	}
 
 	if err := merged.init(); err != nil {
@@ -226,62 +365,80 @@ func (m *Merged) seekRecord(rec record) (iterator, error) {
 
 // in the stack obscure lower entries.
 type mergedIter struct {
-	// TODO: We could short-circuit the entries coming from the
-	// base stack
-	typ byte
-	pq  mergedIterPQueue
+	typ     byte
+	reverse bool
 
 	suppressDeletions bool
 
 	// Fixed side arrays, matched with merged.stack
 	stack []iterator
 	names []string
+
+	// tree picks the next entry among the heads of the stack.
+	tree loserTree
+
+	// live counts the subiterators that are not done. Once only
+	// one is left, Next reads from it directly.
+	live int
+
+	// merged is the Merged that the iterator reads.
+	merged *Merged
 }
 
 func (it *mergedIter) init() error {
+	it.tree = loserTree{
+		heads:   make([]record, len(it.stack)),
+		keys:    make([]string, len(it.stack)),
+		reverse: it.reverse,
+	}
 	for i, sub := range it.stack {
 		rec := newRecord(it.typ, "")
 		ok, err := sub.Next(rec)
 		if err != nil {
-			return fmt.Errorf("init %s: %v", it.names[i], err)
+			return fmt.Errorf("init %s: %w", it.names[i], err)
 		}
 		if ok {
-			it.pq.add(pqEntry{
-				rec:   rec,
-				index: i,
-			})
+			it.tree.heads[i] = rec
+			it.tree.keys[i] = rec.key()
+			it.live++
 		} else {
 			it.stack[i] = nil
 		}
 	}
+	it.tree.init()
 
 	return nil
 }
 
-// advance one iterator, putting its result into the priority queue.
+// advance one iterator, which must be the winner of the tree, and
+// put its result into the tree. The head record is reused.
 func (m *mergedIter) advanceSubIter(index int) error {
-	if m.stack[index] == nil {
-		return nil
-	}
-
-	r := newRecord(m.typ, "")
+	r := m.tree.heads[index]
 	ok, err := m.stack[index].Next(r)
 	if err != nil {
-		return fmt.Errorf("next %s: %v", m.names[index], err)
+		return fmt.Errorf("next %s: %w", m.names[index], err)
 	}
 
 	if !ok {
 		m.stack[index] = nil
-		return nil
+		m.live--
+		r = nil
 	}
 
-	m.pq.add(pqEntry{r, index})
+	m.tree.set(index, r)
 	return nil
 }
 
 func (m *mergedIter) Next(rec record) (bool, error) {
 	for {
 		ok, err := m.nextEntry(rec)
+		if ok && m.merged != nil && m.merged.view {
+			// Before suppressing deletions, as the view may
+			// have a ref that a newer record deletes.
+			if ok, err = m.merged.asOfRecord(rec); err == nil && !ok {
+				continue
+			}
+		}
 		if ok && rec.IsDeletion() && m.suppressDeletions {
 			continue
 		}
@@ -291,12 +448,21 @@ func (m *mergedIter) Next(rec record) (bool, error) {
 }
 
 func (m *mergedIter) nextEntry(rec record) (bool, error) {
-	if m.pq.isEmpty() {
+	if m.live == 0 {
 		return false, nil
 	}
 
-	entry := m.pq.remove()
-	if err := m.advanceSubIter(entry.index); err != nil {
+	w := m.tree.winner()
+	if m.live == 1 {
+		// No other table has entries left, typically once the
+		// small tables on top of a large base run out, so there
+		// is nothing to merge.
+		return m.nextSingle(w, rec)
+	}
+
+	rec.copyFrom(m.tree.heads[w])
+	key := m.tree.keys[w]
+	if err := m.advanceSubIter(w); err != nil {
 		return false, err
 	}
 
@@ -307,18 +473,36 @@ func (m *mergedIter) nextEntry(rec record) (bool, error) {
 	// contain older entries. In such a deployment, the loop below
 	// must be changed to collect all entries for the same key,
 	// and return new the newest one.
-	for !m.pq.isEmpty() {
-		top := m.pq.top()
-		if top.rec.key() > entry.rec.key() {
+	for m.live > 0 {
+		top := m.tree.winner()
+		if m.tree.keys[top] != key {
 			break
 		}
 
-		m.pq.remove()
-		if err := m.advanceSubIter(top.index); err != nil {
+		if err := m.advanceSubIter(top); err != nil {
 			return false, err
 		}
 	}
 
-	rec.copyFrom(entry.rec)
 	return true, nil
 }
+
+// nextSingle returns the next entry of subiterator index, the only
+// one that is not done. Its head goes out first.
+func (m *mergedIter) nextSingle(index int, rec record) (bool, error) {
+	if head := m.tree.heads[index]; head != nil {
+		rec.copyFrom(head)
+		m.tree.heads[index] = nil
+		return true, nil
+	}
+
+	ok, err := m.stack[index].Next(rec)
+	if err != nil {
+		return false, fmt.Errorf("next %s: %w", m.names[index], err)
+	}
+	if !ok {
+		m.stack[index] = nil
+		m.live = 0
+	}
+	return ok, nil
+}
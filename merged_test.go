@@ -12,40 +12,66 @@ import (
 	"fmt"
 	"math/rand"
 	"reflect"
+	"sort"
 	"testing"
 )
 
-func TestPQ(t *testing.T) {
-	pq := mergedIterPQueue{}
-
-	rec := func(k string) pqEntry {
-		return pqEntry{
-			rec: &RefRecord{
-				RefName: k,
-			},
-			index: 0,
+// drainLoserTree takes the winners of the tree until all heads are
+// done, and returns their keys and indices.
+func drainLoserTree(tree *loserTree) (keys []string, indices []int) {
+	for {
+		w := tree.winner()
+		if tree.heads[w] == nil {
+			return keys, indices
 		}
+		keys = append(keys, tree.keys[w])
+		indices = append(indices, w)
+		tree.set(w, nil)
 	}
+}
 
+func TestLoserTree(t *testing.T) {
 	var names []string
 	for i := 0; i < 30; i++ {
 		names = append(names, fmt.Sprintf("%02d", i))
 	}
 
-	for _, j := range rand.Perm(len(names)) {
-		pq.add(rec(names[j]))
-		pq.check()
-	}
+	for _, reverse := range []bool{false, true} {
+		tree := loserTree{
+			heads:   make([]record, len(names)),
+			keys:    make([]string, len(names)),
+			reverse: reverse,
+		}
+		for i, j := range rand.Perm(len(names)) {
+			tree.heads[i] = &RefRecord{RefName: names[j]}
+			tree.keys[i] = names[j]
+		}
+		tree.init()
 
-	var res []string
-	for !pq.isEmpty() {
-		r := pq.remove()
-		pq.check()
-		res = append(res, r.rec.key())
+		res, _ := drainLoserTree(&tree)
+		want := append([]string(nil), names...)
+		if reverse {
+			sort.Sort(sort.Reverse(sort.StringSlice(want)))
+		}
+		if !reflect.DeepEqual(want, res) {
+			t.Errorf("reverse %v: got \n%v want \n%v", reverse, res, want)
+		}
 	}
 
-	if !reflect.DeepEqual(names, res) {
-		t.Errorf("got \n%v want \n%v", res, names)
+	// Equal keys come out newest table first.
+	tree := loserTree{
+		heads: make([]record, 5),
+		keys:  make([]string, 5),
+	}
+	for i, k := range []string{"b", "a", "b", "", "a"} {
+		if k != "" {
+			tree.heads[i] = &RefRecord{RefName: k}
+			tree.keys[i] = k
+		}
+	}
+	tree.init()
+	if _, indices := drainLoserTree(&tree); !reflect.DeepEqual(indices, []int{4, 1, 2, 0}) {
+		t.Errorf("got order %v, want [4 1 2 0]", indices)
 	}
 }
 
@@ -142,4 +168,340 @@ func TestMerged(t *testing.T) {
 		}
 	}
 
+	{
+		iter, err := merged.RefsForPrefix(testHash(1)[:8])
+		if err != nil {
+			t.Fatalf("RefsForPrefix: %v", err)
+		}
+
+		got, err := readIter(blockTypeRef, iter.impl)
+		if err != nil {
+			t.Fatalf("readIter: %v", err)
+		}
+
+		want := []record{
+			&r1[1],
+			&r3[1],
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v, want %#v", got, want)
+		}
+	}
+
+}
+
+func TestMergedRefsForDeleted(t *testing.T) {
+	r1 := []RefRecord{{
+		RefName:     "a",
+		UpdateIndex: 1,
+		Value:       testHash(1),
+	}, {
+		RefName:     "b",
+		UpdateIndex: 1,
+		Value:       testHash(1),
+	}, {
+		RefName:     "c",
+		UpdateIndex: 1,
+		Value:       testHash(1),
+	}}
+	r2 := []RefRecord{{
+		RefName:     "a",
+		UpdateIndex: 2,
+	}, {
+		RefName:     "d",
+		UpdateIndex: 2,
+		Value:       testHash(1),
+	}}
+	r3 := []RefRecord{{
+		RefName:     "c",
+		UpdateIndex: 3,
+	}}
+
+	merged := constructMergedRefTestTable(t, r1, r2, r3)
+	merged.suppressDeletions = true
+	want := []record{
+		&r1[1],
+		&r2[1],
+	}
+
+	for _, refsFor := range []func() (*Iterator, error){
+		func() (*Iterator, error) { return merged.RefsFor(testHash(1)) },
+		func() (*Iterator, error) { return merged.RefsForPrefix(testHash(1)[:8]) },
+	} {
+		iter, err := refsFor()
+		if err != nil {
+			t.Fatalf("RefsFor: %v", err)
+		}
+		got, err := readIter(blockTypeRef, iter.impl)
+		if err != nil {
+			t.Fatalf("readIter: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestMergedSeekReverse(t *testing.T) {
+	r1 := []RefRecord{{
+		RefName:     "a",
+		UpdateIndex: 1,
+		Value:       testHash(1),
+	}, {
+		RefName:     "b",
+		UpdateIndex: 1,
+		Value:       testHash(1),
+	}, {
+		RefName:     "c",
+		UpdateIndex: 1,
+		Value:       testHash(1),
+	}}
+	r2 := []RefRecord{{
+		RefName:     "a",
+		UpdateIndex: 2,
+	}}
+	r3 := []RefRecord{{
+		RefName:     "c",
+		UpdateIndex: 3,
+		Value:       testHash(2),
+	}, {
+		RefName:     "d",
+		UpdateIndex: 3,
+		Value:       testHash(1),
+	}}
+
+	merged := constructMergedRefTestTable(t, r1, r2, r3)
+
+	iter, err := merged.SeekRefReverse("c")
+	if err != nil {
+		t.Fatalf("SeekRefReverse: %v", err)
+	}
+	got, err := readIter(blockTypeRef, iter.impl)
+	if err != nil {
+		t.Fatalf("readIter: %v", err)
+	}
+	want := []record{
+		&r3[0],
+		&r1[1],
+		&r2[0],
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	merged.suppressDeletions = true
+	iter, err = merged.SeekRefReverse("\xff")
+	if err != nil {
+		t.Fatalf("SeekRefReverse: %v", err)
+	}
+	got, err = readIter(blockTypeRef, iter.impl)
+	if err != nil {
+		t.Fatalf("readIter: %v", err)
+	}
+	want = []record{
+		&r3[1],
+		&r3[0],
+		&r1[1],
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestMergedSeekRefPrefix(t *testing.T) {
+	r1 := []RefRecord{{
+		RefName:     "refs/heads/a",
+		UpdateIndex: 1,
+		Value:       testHash(1),
+	}, {
+		RefName:     "refs/heads/b",
+		UpdateIndex: 1,
+		Value:       testHash(1),
+	}, {
+		RefName:     "refs/tags/a",
+		UpdateIndex: 1,
+		Value:       testHash(1),
+	}}
+	r2 := []RefRecord{{
+		RefName:     "refs/heads/a",
+		UpdateIndex: 2,
+	}}
+	r3 := []RefRecord{{
+		RefName:     "refs/heads/c",
+		UpdateIndex: 3,
+		Value:       testHash(2),
+	}, {
+		RefName:     "refs/tags/b",
+		UpdateIndex: 3,
+		Value:       testHash(1),
+	}}
+
+	merged := constructMergedRefTestTable(t, r1, r2, r3)
+	merged.suppressDeletions = true
+
+	iter, err := merged.SeekRefPrefix("refs/heads/")
+	if err != nil {
+		t.Fatalf("SeekRefPrefix: %v", err)
+	}
+	got, err := readIter(blockTypeRef, iter.impl)
+	if err != nil {
+		t.Fatalf("readIter: %v", err)
+	}
+	want := []record{
+		&r1[1],
+		&r3[0],
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	iter, err = merged.SeekRefRange("refs/heads/b", "refs/tags/b")
+	if err != nil {
+		t.Fatalf("SeekRefRange: %v", err)
+	}
+	got, err = readIter(blockTypeRef, iter.impl)
+	if err != nil {
+		t.Fatalf("readIter: %v", err)
+	}
+	want = []record{
+		&r1[1],
+		&r3[0],
+		&r1[2],
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestMergedSeekLogByTime(t *testing.T) {
+	const name = "refs/heads/main"
+	var tables [3][]LogRecord
+	var all []LogRecord
+	for i := 299; i >= 0; i-- {
+		log := LogRecord{
+			RefName:     name,
+			UpdateIndex: uint64(3*i + 1),
+			New:         testHash(i),
+			Old:         testHash(i + 1),
+			Time:        uint64(1000 + 10*i),
+			Message:     fmt.Sprintf("update %d\n", i),
+		}
+		tables[i/100] = append(tables[i/100], log)
+		all = append(all, log)
+	}
+	for i := range tables {
+		tables[i] = append([]LogRecord{{RefName: "refs/heads/a", UpdateIndex: 1, Time: 1}}, tables[i]...)
+		tables[i] = append(tables[i], LogRecord{RefName: "refs/heads/z", UpdateIndex: 1, Time: 1})
+	}
+
+	var tabs []Table
+	for i := range tables {
+		_, reader := constructTestTable(t, nil, tables[i], Config{BlockSize: 256})
+		tabs = append(tabs, reader)
+	}
+	merged, err := NewMerged(tabs, SHA1ID)
+	if err != nil {
+		t.Fatalf("NewMerged: %v", err)
+	}
+	_, single := constructTestTable(t, nil, all, Config{BlockSize: 256})
+
+	for _, tab := range []Table{single, merged} {
+		for _, when := range []uint64{0, 999, 1000, 1005, 1500, 1510, 1511, 2000, 3990, 3995, 5000} {
+			var want *LogRecord
+			for i := range all {
+				if all[i].Time <= when {
+					want = &all[i]
+					break
+				}
+			}
+
+			it, err := tab.SeekLogByTime(name, when)
+			if err != nil {
+				t.Fatalf("SeekLogByTime: %v", err)
+			}
+			var got LogRecord
+			ok, err := it.NextLog(&got)
+			if err != nil {
+				t.Fatalf("NextLog: %v", err)
+			}
+			if want == nil {
+				if ok {
+					t.Errorf("%s: SeekLogByTime(%d): got %v, want none", tab.Name(), when, &got)
+				}
+				continue
+			}
+			if !ok || !reflect.DeepEqual(&got, want) {
+				t.Errorf("%s: SeekLogByTime(%d): got %v, want %v", tab.Name(), when, &got, want)
+			}
+			for ok {
+				if ok, err = it.NextLog(&got); err != nil || (ok && got.RefName != name) {
+					t.Fatalf("NextLog: got %v, %v", &got, err)
+				}
+			}
+		}
+	}
+}
+
+// benchmarkMergedScan reads all refs of a base table of n refs with
+// the given number of small tables on top.
+func benchmarkMergedScan(b *testing.B, n, small int) {
+	var tabs []Table
+	var refs []RefRecord
+	for i := 0; i < n; i++ {
+		refs = append(refs, RefRecord{
+			RefName:     fmt.Sprintf("refs/heads/%07d", i),
+			UpdateIndex: 1,
+			Value:       testHash(i),
+		})
+	}
+	_, base := constructTestTable(b, refs, nil, Config{})
+	tabs = append(tabs, base)
+
+	for j := 0; j < small; j++ {
+		refs = refs[:0]
+		for i := j; i < n; i += n / 4 {
+			refs = append(refs, RefRecord{
+				RefName:     fmt.Sprintf("refs/heads/%07d", i),
+				UpdateIndex: uint64(j + 2),
+				Value:       testHash(i + j),
+			})
+		}
+		_, r := constructTestTable(b, refs, nil, Config{})
+		tabs = append(tabs, r)
+	}
+	m, err := NewMerged(tabs, SHA1ID)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it, err := m.SeekRef("")
+		if err != nil {
+			b.Fatal(err)
+		}
+		count := 0
+		for {
+			var ref RefRecord
+			ok, err := it.NextRef(&ref)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+			count++
+		}
+		if count != n {
+			b.Fatalf("got %d refs, want %d", count, n)
+		}
+	}
+}
+
+func BenchmarkMergedScan(b *testing.B) {
+	for _, small := range []int{0, 4, 32} {
+		b.Run(fmt.Sprintf("tables=%d", small+1), func(b *testing.B) {
+			benchmarkMergedScan(b, 100000, small)
+		})
+	}
 }
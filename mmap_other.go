@@ -0,0 +1,19 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+// NewMmapBlockSource opens a file on local disk as a BlockSource. On
+// this platform, mmap is not supported, and it is equivalent to
+// NewFileBlockSource.
+func NewMmapBlockSource(name string) (BlockSource, error) {
+	return NewFileBlockSource(name)
+}
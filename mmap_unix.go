@@ -0,0 +1,89 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+type mmapBlockSource struct {
+	// mu guards data against Close. Reads share it, so they run
+	// in parallel.
+	mu   sync.RWMutex
+	data []byte
+	sz   uint64
+}
+
+// NewMmapBlockSource opens a file on local disk as a BlockSource,
+// mapping it read-only into memory. ReadBlock returns slices into the
+// mapping, which are only valid until Close is called.
+func NewMmapBlockSource(name string) (BlockSource, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	bs := &mmapBlockSource{sz: uint64(fi.Size())}
+	if bs.sz == 0 {
+		return bs, nil
+	}
+
+	bs.data, err = syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
+
+func (bs *mmapBlockSource) Size() uint64 {
+	return bs.sz
+}
+
+var errMmapClosed = errors.New("reftable: read from closed mmap block source")
+
+func (bs *mmapBlockSource) ReadBlock(off uint64, size int) ([]byte, error) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	if bs.data == nil && bs.sz > 0 {
+		return nil, errMmapClosed
+	}
+	if off >= bs.sz {
+		return nil, io.EOF
+	}
+	end := off + uint64(size)
+	if end > bs.sz {
+		end = bs.sz
+	}
+	return bs.data[off:end:end], nil
+}
+
+// Close unmaps the file. It is safe to call Close more than once.
+func (bs *mmapBlockSource) Close() error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.data == nil {
+		return nil
+	}
+	data := bs.data
+	bs.data = nil
+	return syscall.Munmap(data)
+}
@@ -10,11 +10,16 @@ package reftable
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
-	"log"
+	"sort"
+	"sync/atomic"
+
+	"github.com/google/reftable/sst"
 )
 
 // ByteBlockSource is an in-memory block source.
@@ -26,7 +31,14 @@ func (s *ByteBlockSource) Size() uint64 {
 	return uint64(len(s.Source))
 }
 func (s *ByteBlockSource) ReadBlock(off uint64, sz int) ([]byte, error) {
-	return s.Source[off : off+uint64(sz)], nil
+	if off >= uint64(len(s.Source)) {
+		return nil, io.EOF
+	}
+	end := off + uint64(sz)
+	if end > uint64(len(s.Source)) {
+		end = uint64(len(s.Source))
+	}
+	return s.Source[off:end], nil
 }
 
 func (s *ByteBlockSource) Close() error {
@@ -45,7 +57,11 @@ type readerOffsets struct {
 	IndexOffset uint64
 }
 
-// Reader allows reading from a reftable.
+// Reader allows reading from a reftable. A Reader is immutable after
+// NewReader returns, so it may be used from several goroutines at
+// once, provided its BlockSource supports concurrent ReadBlock
+// calls. The block sources of this package do. Iterators returned
+// by a Reader must not be shared between goroutines.
 type Reader struct {
 	header header
 	footer footer
@@ -61,10 +77,30 @@ type Reader struct {
 	size uint64
 
 	offsets map[byte]readerOffsets
+
+	// checksums are the block checksums, sorted by offset, and
+	// verifyChecksums is set to check them as blocks are read.
+	checksums       []blockChecksum
+	verifyChecksums bool
+
+	// refFilter is the Bloom filter over ref names, or nil.
+	refFilter *refFilter
+
+	// customTypes are the types of the custom sections, in
+	// ascending order.
+	customTypes []byte
+
+	// sst reads FormatV2 tables, which have no sections.
+	sst *sst.Reader
+
+	// refs counts the owners of the reader. The block source is
+	// closed when it drops to zero.
+	refs int32
 }
 
+// HashID returns the hash ID recorded in the table header.
 func (r *Reader) HashID() HashID {
-	return SHA1ID
+	return r.header.HashID
 }
 
 func (r *Reader) DebugData() string {
@@ -75,14 +111,34 @@ func (r *Reader) DebugData() string {
 	)
 }
 
+// acquire takes an extra reference, which keeps the table open until
+// the matching Close.
+func (r *Reader) acquire() {
+	atomic.AddInt32(&r.refs, 1)
+}
+
+// Close releases the reader. The underlying BlockSource is closed
+// once all references taken by a Stack are released as well.
 func (r *Reader) Close() {
-	r.src.Close()
+	if atomic.AddInt32(&r.refs, -1) == 0 {
+		r.src.Close()
+	}
 }
 
 func (r *Reader) Name() string {
 	return r.name
 }
 
+// corrupt returns a CorruptTableError for the block at off.
+func (r *Reader) corrupt(off uint64, typ byte, err error) error {
+	return &CorruptTableError{
+		Table:     r.name,
+		Offset:    off,
+		BlockType: typ,
+		Err:       err,
+	}
+}
+
 func (r *Reader) getBlock(off uint64, sz uint32) ([]byte, error) {
 	if off >= r.size {
 		return nil, nil
@@ -111,13 +167,29 @@ func readHeader(r io.Reader, h *header, version int) error {
 
 // NewReader creates a reader for a reftable file.
 func NewReader(src BlockSource, name string) (*Reader, error) {
-	headBlock, err := src.ReadBlock(0, headerSize(2)+1)
+	return NewReaderConfig(src, name, &Config{})
+}
 
-	if err != nil {
+// NewReaderConfig creates a reader for a reftable file, which checks
+// block checksums as set in cfg.ChecksumVerification. Other fields of
+// cfg are ignored.
+func NewReaderConfig(src BlockSource, name string, cfg *Config) (*Reader, error) {
+	headBlock, err := src.ReadBlock(0, headerSize(2)+1)
+	if err != nil && err != io.EOF {
 		return nil, err
 	}
-	if bytes.Compare(headBlock[:4], magic[:]) != 0 {
-		return nil, fmt.Errorf("reftable: got magic %q, want %q", headBlock[:4], magic)
+	if len(headBlock) <= len(magic) && bytes.HasPrefix(magic[:], headBlock) {
+		return nil, &CorruptTableError{Table: name, Err: errors.New("header is truncated")}
+	}
+	if !bytes.HasPrefix(headBlock, magic[:]) {
+		s, err := sst.NewReader(src, name)
+		if err == nil {
+			return newSSTReader(s, src, name)
+		}
+		if !errors.Is(err, sst.ErrNotSST) {
+			return nil, sstError(err)
+		}
+		return nil, fmt.Errorf("reftable: got magic %q, want %q", headBlock[:min(len(headBlock), 4)], magic)
 	}
 
 	version := int(headBlock[4])
@@ -127,10 +199,14 @@ func NewReader(src BlockSource, name string) (*Reader, error) {
 
 	r := &Reader{
 		version: version,
-		size:    src.Size() - uint64(footerSize(version)),
 		src:     src,
 		name:    name,
+		refs:    1,
 	}
+	if src.Size() < uint64(headerSize(version)+footerSize(version)) {
+		return nil, r.corrupt(0, 0, fmt.Errorf("table of %d bytes is truncated", src.Size()))
+	}
+	r.size = src.Size() - uint64(footerSize(version))
 
 	footBlock, err := src.ReadBlock(r.size, footerSize(version))
 	if err != nil {
@@ -138,8 +214,8 @@ func NewReader(src BlockSource, name string) (*Reader, error) {
 	}
 
 	if 0 != bytes.Compare(headBlock[:headerSize(version)], footBlock[:headerSize(version)]) {
-		return nil, fmt.Errorf("reftable: start header %q != tail header %q",
-			headBlock[:headerSize(version)], footBlock[:headerSize(version)])
+		return nil, r.corrupt(r.size, 0, fmt.Errorf("start header %q != tail header %q",
+			headBlock[:headerSize(version)], footBlock[:headerSize(version)]))
 	}
 
 	footBuf := bytes.NewBuffer(footBlock)
@@ -158,8 +234,11 @@ func NewReader(src BlockSource, name string) (*Reader, error) {
 	r.hashSize = r.header.HashID.Size()
 	r.header.BlockSize &= (1 << 24) - 1
 
+	if r.hashSize == 0 {
+		return nil, r.corrupt(0, 0, fmt.Errorf("%w: unknown hash ID %q", ErrHashSize, r.header.HashID))
+	}
 	if footBuf.Len() > 0 {
-		log.Panicf("footer size %d", footBuf.Len())
+		return nil, r.corrupt(r.size, 0, fmt.Errorf("footer has %d trailing bytes", footBuf.Len()))
 	}
 
 	r.objectIDLen = int(r.footer.ObjOffset & ((1 << 5) - 1))
@@ -167,7 +246,7 @@ func NewReader(src BlockSource, name string) (*Reader, error) {
 
 	wantCRC32 := crc32.ChecksumIEEE(footBlock[:footerSize(version)-4])
 	if gotCRC32 != wantCRC32 {
-		return nil, fmt.Errorf("reftable: got CRC %x, want CRC %x", gotCRC32, wantCRC32)
+		return nil, r.corrupt(r.size, 0, fmt.Errorf("got CRC %x, want CRC %x", gotCRC32, wantCRC32))
 	}
 
 	firstBlockTyp := headBlock[headerSize(version)]
@@ -192,6 +271,35 @@ func NewReader(src BlockSource, name string) (*Reader, error) {
 	// In case of blocksize==0, should read the entire thing
 	// into a ByteBlockSource?
 
+	checksumStart, err := r.readChecksums()
+	if err != nil {
+		return nil, err
+	}
+	r.verifyChecksums = cfg.ChecksumVerification == ChecksumLazy && r.checksums != nil
+	customStart, err := r.readCustomSections(checksumStart)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.offsets[blockTypeRef].Present {
+		// The filter ends where the next section starts.
+		end := customStart
+		if r.offsets[blockTypeObj].Present {
+			end = r.footer.ObjOffset
+		} else if r.offsets[blockTypeLog].Present {
+			end = r.footer.LogOffset
+		}
+		if r.refFilter, err = r.readRefFilter(end); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.ChecksumVerification == ChecksumOnOpen {
+		if err := r.checkAllBlocks(); err != nil {
+			return nil, err
+		}
+	}
+
 	return r, nil
 }
 
@@ -216,7 +324,7 @@ func (i *tableIter) nextInBlock(rec record) (bool, error) {
 		}
 	}
 	if err != nil {
-		err = fmt.Errorf("block %c, off %d: %v", i.typ, i.blockOff, err)
+		err = i.r.corrupt(i.blockOff, i.typ, err)
 	}
 	return ok, err
 }
@@ -224,7 +332,7 @@ func (i *tableIter) nextInBlock(rec record) (bool, error) {
 // Next implements the Iterator interface
 func (i *tableIter) Next(rec record) (bool, error) {
 	if rec.typ() != i.typ {
-		log.Panicf("got %T want %c", rec, i.typ)
+		return false, fmt.Errorf("reftable: got %T, want record of type %c", rec, i.typ)
 	}
 
 	for {
@@ -246,17 +354,19 @@ func (i *tableIter) Next(rec record) (bool, error) {
 	}
 }
 
-// extractBlockSize returns the block size from the block header
-func extractBlockSize(block []byte, off uint64, version int) (typ byte, size uint32, err error) {
+// extractBlockSize returns the block type and size from the block
+// header.
+func extractBlockSize(block []byte, off uint64, version int) (typ byte, size uint32) {
 	if off == 0 {
 		block = block[headerSize(version):]
 	}
+	return block[0], sst.U24(block[1:])
+}
 
-	if !isBlockType(block[0]) {
-		return 0, 0, fmtError
-	}
-
-	return block[0], getU24(block[1:]), nil
+// knownBlockType returns whether the table may have blocks of type
+// typ.
+func (r *Reader) knownBlockType(typ byte) bool {
+	return isBlockType(typ) || (typ != blockTypeAny && r.offsets[typ].Present)
 }
 
 // newBlockReader opens a block of the given type, starting at
@@ -277,15 +387,30 @@ func (r *Reader) newBlockReader(nextOff uint64, wantTyp byte) (br *blockReader,
 		return nil, err
 	}
 
-	blockTyp, blockSize, err := extractBlockSize(block, nextOff, r.version)
-	if err != nil {
-		return nil, err
+	var headerOff uint32
+	if nextOff == 0 {
+		headerOff = uint32(headerSize(r.version))
+	}
+	if len(block) < int(headerOff)+4 {
+		return nil, r.corrupt(nextOff, 0, fmt.Errorf("%w: block header beyond the table", fmtError))
+	}
+
+	blockTyp, blockSize := extractBlockSize(block, nextOff, r.version)
+	if !r.knownBlockType(blockTyp) {
+		return nil, r.corrupt(nextOff, 0, fmtError)
 	}
 
 	if wantTyp != blockTypeAny && blockTyp != wantTyp {
 		return nil, nil
 	}
 
+	cache, _ := r.src.(*cachedBlockSource)
+	if cache != nil && blockTyp == blockTypeLog {
+		if br := cache.getInflated(nextOff); br != nil {
+			return br, nil
+		}
+	}
+
 	if blockSize > guessBlockSize {
 		block, err = r.getBlock(nextOff, blockSize)
 		if err != nil {
@@ -293,12 +418,30 @@ func (r *Reader) newBlockReader(nextOff uint64, wantTyp byte) (br *blockReader,
 		}
 	}
 
-	var headerOff uint32
-	if nextOff == 0 {
-		headerOff = uint32(headerSize(r.version))
+	// Without compression, log blocks exceed their size.
+	if blockTyp == blockTypeLog {
+		if n := logBlockSize(block, headerOff); n > len(block) {
+			block, err = r.getBlock(nextOff, uint32(n))
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	return newBlockReader(block, headerOff, r.header.BlockSize, r.hashSize)
+	if r.verifyChecksums {
+		if block, err = r.checkBlock(nextOff, block); err != nil {
+			return nil, err
+		}
+	}
+
+	br, err = newBlockReader(block, headerOff, r.header.BlockSize, r.hashSize)
+	if err != nil {
+		return nil, r.corrupt(nextOff, blockTyp, err)
+	}
+	if cache != nil && blockTyp == blockTypeLog {
+		cache.putInflated(nextOff, br)
+	}
+	return br, nil
 }
 
 // nextBlock moves to the next block, or returns false fi there is none.
@@ -308,7 +451,7 @@ func (i *tableIter) nextBlock() (bool, error) {
 	nextBlockOff := i.blockOff + uint64(i.bi.br.fullBlockSize)
 	br, err := i.r.newBlockReader(nextBlockOff, i.typ)
 	if err != nil {
-		return false, fmt.Errorf("reftable: reading %c block at 0x%x: %v", i.typ, nextBlockOff, err)
+		return false, fmt.Errorf("reftable: reading %c block at 0x%x: %w", i.typ, nextBlockOff, err)
 	}
 	if br == nil {
 		i.finished = true
@@ -353,6 +496,9 @@ func (r *Reader) tabIterAt(off uint64, wantTyp byte) (*tableIter, error) {
 // seekRecord returns an iterator pointed to just before the key specified
 // by the record
 func (r *Reader) seekRecord(rec record) (iterator, error) {
+	if r.sst != nil {
+		return r.seekSST(rec, false)
+	}
 	if !r.offsets[rec.typ()].Present {
 		return &emptyIterator{}, nil
 	}
@@ -364,6 +510,13 @@ func (r *Reader) seekRecord(rec record) (iterator, error) {
 }
 
 func (r *Reader) SeekRef(name string) (*Iterator, error) {
+	return r.SeekRefContext(context.Background(), name)
+}
+
+func (r *Reader) SeekRefContext(ctx context.Context, name string) (*Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	ref := RefRecord{
 		RefName: name,
 	}
@@ -371,10 +524,17 @@ func (r *Reader) SeekRef(name string) (*Iterator, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Iterator{impl}, nil
+	return &Iterator{withContext(ctx, impl)}, nil
 }
 
 func (r *Reader) SeekLog(name string, updateIndex uint64) (*Iterator, error) {
+	return r.SeekLogContext(context.Background(), name, updateIndex)
+}
+
+func (r *Reader) SeekLogContext(ctx context.Context, name string, updateIndex uint64) (*Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	log := LogRecord{
 		RefName:     name,
 		UpdateIndex: updateIndex,
@@ -384,7 +544,61 @@ func (r *Reader) SeekLog(name string, updateIndex uint64) (*Iterator, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Iterator{impl}, nil
+	return &Iterator{withContext(ctx, impl)}, nil
+}
+
+// seekRange implements the Table interface. If the range holds only
+// a ref name that the filter rules out, or the block that the index
+// leads to has no key in the range, the table is skipped.
+func (r *Reader) seekRange(rec record, end string) (iterator, error) {
+	if r.refFilter != nil && rec.typ() == blockTypeRef && end == rec.key()+"\x00" &&
+		!r.refFilter.mayContain(rec.key()) {
+		return &emptyIterator{}, nil
+	}
+	if r.sst != nil || end == "" || !r.offsets[rec.typ()].Present {
+		it, err := r.seekRecord(rec)
+		if err != nil || end == "" {
+			return it, err
+		}
+		return &boundedIterator{it: it, end: end}, nil
+	}
+
+	tabIter, err := r.seek(rec)
+	if err != nil {
+		return nil, err
+	}
+	if tabIter == nil {
+		return &emptyIterator{}, nil
+	}
+
+	// The seek loaded the block that would hold the start of the
+	// range. Peek at it, without loading the blocks after it.
+	peek := tabIter.bi
+	next := newRecord(rec.typ(), "")
+	ok, err := peek.Next(next)
+	if err != nil {
+		return nil, r.corrupt(tabIter.blockOff, tabIter.typ, err)
+	}
+	if ok && next.key() >= end {
+		return &emptyIterator{}, nil
+	}
+	return &boundedIterator{it: tabIter, end: end}, nil
+}
+
+func (r *Reader) SeekRefPrefix(prefix string) (*Iterator, error) {
+	return seekRefRange(r, prefix, prefixEnd(prefix))
+}
+
+func (r *Reader) SeekRefRange(start, end string) (*Iterator, error) {
+	return seekRefRange(r, start, end)
+}
+
+func (r *Reader) SeekRefLog(refName string) (*Iterator, error) {
+	return seekRefLog(r, refName)
+}
+
+func (r *Reader) SeekLogByTime(refName string, t uint64) (*Iterator, error) {
+	return seekLogByTime(r, refName, t)
 }
 
 // seek seeks to the key specified by the record
@@ -411,6 +625,10 @@ func (r *Reader) seek(rec record) (*tableIter, error) {
 	return nil, err
 }
 
+// maxIndexDepth bounds the index levels that are followed, so an
+// index entry that points back up the index does not loop forever.
+const maxIndexDepth = 16
+
 // seekIndexed seeks to the `want` record, using its index.
 func (r *Reader) seekIndexed(want record) (*tableIter, error) {
 	idxIter, err := r.start(want.typ(), true)
@@ -427,20 +645,26 @@ func (r *Reader) seekIndexed(want record) (*tableIter, error) {
 		return nil, err
 	}
 
-	for {
+	for depth := 0; ; depth++ {
 		var rec indexRecord
 		ok, err := idxIter.Next(&rec)
+		if err != nil {
+			return nil, err
+		}
 		if !ok {
 			return nil, nil
 		}
-		if err != nil {
-			return nil, err
+		if depth >= maxIndexDepth {
+			return nil, r.corrupt(idxIter.blockOff, blockTypeIndex, fmt.Errorf("index exceeds %d levels", maxIndexDepth))
 		}
 
 		tabIter, err := r.tabIterAt(rec.Offset, blockTypeAny)
 		if err != nil {
 			return nil, err
 		}
+		if tabIter == nil {
+			return nil, r.corrupt(idxIter.blockOff, blockTypeIndex, fmt.Errorf("index points to 0x%x, beyond the table", rec.Offset))
+		}
 
 		err = tabIter.bi.seek(want.key())
 		if err != nil {
@@ -452,7 +676,7 @@ func (r *Reader) seekIndexed(want record) (*tableIter, error) {
 		}
 
 		if tabIter.typ != blockTypeIndex {
-			log.Panicf("got type %c following indexes", tabIter.typ)
+			return nil, r.corrupt(rec.Offset, tabIter.typ, fmt.Errorf("index points to %c block, want %c", tabIter.typ, want.typ()))
 		}
 
 		idxIter = tabIter
@@ -483,7 +707,7 @@ func (r *Reader) seekLinear(tabIter *tableIter, want record) (bool, error) {
 			return false, err
 		}
 		if !ok {
-			panic("read from fresh block failed")
+			return false, r.corrupt(tabIter.blockOff, tabIter.typ, errors.New("empty block"))
 		}
 		if rec.key() > wantKey {
 			break
@@ -510,11 +734,12 @@ func (r *Reader) MinUpdateIndex() uint64 {
 }
 
 // indexedTableRefIter iterates over a refs, returning refs pointing
-// to a given object ID. The ref blocks to consider must be specified
-// upfront.
+// to a given object ID, or to object IDs starting with it if abbrev is
+// set. The ref blocks to consider must be specified upfront.
 type indexedTableRefIter struct {
-	r   *Reader
-	oid []byte
+	r      *Reader
+	oid    []byte
+	abbrev bool
 
 	// mutable
 
@@ -563,7 +788,7 @@ func (i *indexedTableRefIter) Next(rec record) (bool, error) {
 			continue
 		}
 
-		if bytes.Compare(ref.Value, i.oid) == 0 || bytes.Compare(ref.TargetValue, i.oid) == 0 {
+		if pointsTo(ref, i.oid, i.abbrev) {
 			return true, nil
 		}
 	}
@@ -571,46 +796,390 @@ func (i *indexedTableRefIter) Next(rec record) (bool, error) {
 
 // RefsFor iterates over refs that point to `oid`.
 func (r *Reader) RefsFor(oid []byte) (*Iterator, error) {
+	return r.RefsForContext(context.Background(), oid)
+}
+
+func (r *Reader) RefsForContext(ctx context.Context, oid []byte) (*Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	it, err := r.refsFor(ctx, oid, false)
+	if err != nil {
+		return nil, err
+	}
+	return &Iterator{it}, nil
+}
+
+// RefsForPrefix iterates over the refs that point to an object ID
+// starting with abbrev, such as a short hash typed by a user.
+func (r *Reader) RefsForPrefix(abbrev []byte) (*Iterator, error) {
+	if len(abbrev) == 0 {
+		return nil, errors.New("reftable: empty object ID prefix")
+	}
+	it, err := r.refsFor(context.Background(), abbrev, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Iterator{it}, nil
+}
+
+// refsFor returns the refs that point to oid, or, if abbrev is set,
+// to an object ID starting with oid.
+func (r *Reader) refsFor(ctx context.Context, oid []byte, abbrev bool) (iterator, error) {
+	if r.sst != nil {
+		return r.refsForSST(ctx, oid, abbrev)
+	}
 	if r.offsets[blockTypeObj].Present {
-		return r.refsForIndexed(oid)
+		offsets, ok, err := r.objOffsets(oid)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			if len(offsets) == 0 {
+				return withContext(ctx, &emptyIterator{}), nil
+			}
+			tr := &indexedTableRefIter{
+				r:       r,
+				oid:     oid,
+				abbrev:  abbrev,
+				offsets: offsets,
+			}
+			if err := tr.nextBlock(); err != nil {
+				return nil, err
+			}
+			return withContext(ctx, tr), nil
+		}
 	}
 
 	it, err := r.start(blockTypeRef, false)
 	if err != nil {
 		return nil, err
 	}
-	return &Iterator{&filteringRefIterator{
+	return &filteringRefIterator{
 		tab:         r,
 		oid:         oid,
+		abbrev:      abbrev,
 		doubleCheck: false,
-		it:          it,
-	}}, nil
+		it:          withContext(ctx, it),
+	}, nil
 }
 
-func (r *Reader) refsForIndexed(oid []byte) (*Iterator, error) {
-	want := &objRecord{HashPrefix: oid[:r.objectIDLen]}
+// objOffsets looks up the ref blocks that may have refs pointing to
+// an object ID starting with oid in the obj index. Full object IDs
+// match a single entry, shorter prefixes may match several. It
+// returns false if the blocks are not listed, because the offsets of
+// an entry did not fit in a block.
+func (r *Reader) objOffsets(oid []byte) ([]uint64, bool, error) {
+	prefix := oid
+	if len(prefix) > r.objectIDLen {
+		prefix = prefix[:r.objectIDLen]
+	}
+
+	it, err := r.seek(&objRecord{HashPrefix: prefix})
+	if err != nil || it == nil {
+		return nil, true, err
+	}
+
+	var offsets []uint64
+	matches := 0
+	for {
+		var got objRecord
+		ok, err := it.Next(&got)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok || !bytes.HasPrefix(got.HashPrefix, prefix) {
+			break
+		}
+		if got.Offsets == nil {
+			return nil, false, nil
+		}
+		offsets = append(offsets, got.Offsets...)
+		matches++
+	}
+
+	if matches > 1 {
+		sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+		offsets = uniqOffsets(offsets)
+	}
+	return offsets, true, nil
+}
+
+// uniqOffsets removes duplicates from sorted offsets.
+func uniqOffsets(offsets []uint64) []uint64 {
+	u := offsets[:0]
+	for _, off := range offsets {
+		if len(u) == 0 || off != u[len(u)-1] {
+			u = append(u, off)
+		}
+	}
+	return u
+}
+
+// reverseTableIter iterates over a section, or a level of its index,
+// backwards. The blocks to visit come from the index level above,
+// or, if there is none, from a list of offsets.
+type reverseTableIter struct {
+	r   *Reader
+	typ byte
+
+	// parent yields the index records for the blocks of this
+	// level, in descending order.
+	parent iterator
+
+	// offsets are the remaining blocks, if there is no parent.
+	offsets []uint64
+
+	blockOff uint64
+	bi       reverseBlockIter
+	finished bool
+}
+
+// prevBlock moves to the end of the previous block, or returns false
+// if there is none.
+func (i *reverseTableIter) prevBlock() (bool, error) {
+	var off uint64
+	if i.parent != nil {
+		var idx indexRecord
+		ok, err := i.parent.Next(&idx)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			i.finished = true
+			return false, nil
+		}
+		off = idx.Offset
+	} else {
+		if len(i.offsets) == 0 {
+			i.finished = true
+			return false, nil
+		}
+		off = i.offsets[len(i.offsets)-1]
+		i.offsets = i.offsets[:len(i.offsets)-1]
+	}
 
-	it, err := r.seek(want)
+	br, err := i.r.newBlockReader(off, blockTypeAny)
 	if err != nil {
-		return nil, err
+		return false, fmt.Errorf("reftable: reading %c block at 0x%x: %v", i.typ, off, err)
+	}
+	if br == nil {
+		return false, fmt.Errorf("reftable: no %c block at 0x%x", i.typ, off)
 	}
+	if i.typ == blockTypeAny {
+		i.typ = br.getType()
+	} else if br.getType() != i.typ {
+		return false, fmt.Errorf("reftable: got %c block at 0x%x, want %c", br.getType(), off, i.typ)
+	}
+
+	i.blockOff = off
+	i.bi = reverseBlockIter{br: br}
+	if err := i.bi.seekEnd(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-	got := objRecord{}
-	ok, err := it.Next(&got)
+// Next implements the Iterator interface, returning the previous
+// record.
+func (i *reverseTableIter) Next(rec record) (bool, error) {
+	if rec.typ() != i.typ {
+		return false, fmt.Errorf("reftable: got %T, want record of type %c", rec, i.typ)
+	}
+
+	for !i.finished {
+		ok, err := i.bi.Next(rec)
+		if err != nil {
+			return false, i.r.corrupt(i.blockOff, i.typ, err)
+		}
+		if ok {
+			if ref, isRef := rec.(*RefRecord); isRef {
+				ref.UpdateIndex += i.r.header.MinUpdateIndex
+			}
+			return true, nil
+		}
+		if _, err := i.prevBlock(); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// seekIndex positions the iterator on a level of index blocks at the
+// first index record with a key >= key, as reverseBlockIter.seek
+// with orNext set.
+func (i *reverseTableIter) seekIndex(key string) error {
+	if i.parent == nil && len(i.offsets) > 1 {
+		// Without an index above, there are only a few
+		// blocks. Look at each to pick the right one.
+		pick := 0
+		for j, off := range i.offsets {
+			br, err := i.r.newBlockReader(off, blockTypeAny)
+			if err != nil {
+				return err
+			}
+			if br == nil || br.restartCount == 0 {
+				return fmt.Errorf("reftable: no %c block at 0x%x", i.typ, off)
+			}
+
+			last := reverseBlockIter{br: br}
+			if err := last.seekEnd(); err != nil {
+				return err
+			}
+			pick = j
+			if len(last.recs) > 0 && last.recs[len(last.recs)-1].key() >= key {
+				break
+			}
+		}
+		i.offsets = i.offsets[:pick+1]
+	}
+
+	ok, err := i.prevBlock()
+	if err != nil || !ok {
+		return err
+	}
+	return i.bi.seek(key, true)
+}
+
+// sectionBlocks returns the offsets of the consecutive blocks of the
+// given type starting at off.
+func (r *Reader) sectionBlocks(off uint64, typ byte) ([]uint64, error) {
+	var offs []uint64
+	for {
+		br, err := r.newBlockReader(off, typ)
+		if err != nil {
+			return nil, err
+		}
+		if br == nil {
+			return offs, nil
+		}
+		offs = append(offs, off)
+		off += uint64(br.fullBlockSize)
+	}
+}
+
+// blocksUpTo returns the offsets of the consecutive blocks of the
+// given type starting at off, up to the last one whose first key is
+// <= key. Blocks past that one are not read.
+func (r *Reader) blocksUpTo(off uint64, typ byte, key string) ([]uint64, error) {
+	var offs []uint64
+	for {
+		br, err := r.newBlockReader(off, typ)
+		if err != nil {
+			return nil, err
+		}
+		if br == nil {
+			return offs, nil
+		}
+		if br.restartCount == 0 {
+			return nil, r.corrupt(off, typ, fmt.Errorf("%w: block without restarts", fmtError))
+		}
+		if len(offs) > 0 {
+			first, err := decodeRestartKey(br.block, br.restartOffset(0))
+			if err != nil {
+				return nil, r.corrupt(off, typ, err)
+			}
+			if first > key {
+				return offs, nil
+			}
+		}
+		offs = append(offs, off)
+		off += uint64(br.fullBlockSize)
+	}
+}
+
+// seekReverse returns an iterator that returns the record with the
+// largest key <= the wanted key first, and then walks backwards.
+func (r *Reader) seekReverse(want record) (iterator, error) {
+	typ := want.typ()
+	key := want.key()
+
+	idxOff := r.offsets[typ].IndexOffset
+	if idxOff == 0 {
+		offs, err := r.blocksUpTo(r.offsets[typ].Offset, typ, key)
+		if err != nil {
+			return nil, err
+		}
+		it := &reverseTableIter{r: r, typ: typ, offsets: offs}
+		ok, err := it.prevBlock()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			if err := it.bi.seek(key, false); err != nil {
+				return nil, err
+			}
+		}
+		return it, nil
+	}
+
+	offs, err := r.sectionBlocks(idxOff, blockTypeIndex)
 	if err != nil {
 		return nil, err
 	}
-	if !ok || got.key() != want.key() {
-		return &Iterator{&emptyIterator{}}, nil
+	it := &reverseTableIter{r: r, typ: blockTypeIndex, offsets: offs}
+	if err := it.seekIndex(key); err != nil {
+		return nil, err
+	}
+
+	// Descend the index levels. The parent yields the block that
+	// may hold the key first, and the blocks before it next.
+	for {
+		child := &reverseTableIter{r: r, typ: blockTypeAny, parent: it}
+		ok, err := child.prevBlock()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return &emptyIterator{}, nil
+		}
+		switch child.typ {
+		case typ:
+			if err := child.bi.seek(key, false); err != nil {
+				return nil, err
+			}
+			return child, nil
+		case blockTypeIndex:
+			if err := child.bi.seek(key, true); err != nil {
+				return nil, err
+			}
+			it = child
+		default:
+			return nil, fmt.Errorf("reftable: got %c block at 0x%x following indexes", child.typ, child.blockOff)
+		}
+	}
+}
+
+// seekRecordReverse returns an iterator that returns records in
+// descending key order, starting at the largest key <= the key of the
+// given record.
+func (r *Reader) seekRecordReverse(rec record) (iterator, error) {
+	if r.sst != nil {
+		return r.seekSST(rec, true)
+	}
+	if !r.offsets[rec.typ()].Present {
+		return &emptyIterator{}, nil
 	}
+	return r.seekReverse(rec)
+}
 
-	tr := &indexedTableRefIter{
-		r:       r,
-		oid:     oid,
-		offsets: got.Offsets,
+// SeekRefReverse returns an iterator that returns refs in descending
+// order, starting at the last ref whose name is <= name.
+func (r *Reader) SeekRefReverse(name string) (*Iterator, error) {
+	impl, err := r.seekRecordReverse(&RefRecord{RefName: name})
+	if err != nil {
+		return nil, err
 	}
-	if err := tr.nextBlock(); err != nil {
+	return &Iterator{impl}, nil
+}
+
+// SeekLogReverse returns an iterator that returns log records in
+// descending order, starting at the given record. For a single ref,
+// this walks from older to newer entries.
+func (r *Reader) SeekLogReverse(name string, updateIndex uint64) (*Iterator, error) {
+	impl, err := r.seekRecordReverse(&LogRecord{RefName: name, UpdateIndex: updateIndex})
+	if err != nil {
 		return nil, err
 	}
-	return &Iterator{tr}, nil
+	return &Iterator{impl}, nil
 }
@@ -12,8 +12,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
 	"math"
+
+	"github.com/google/reftable/sst"
 )
 
 func newRecord(typ byte, key string) record {
@@ -36,8 +37,10 @@ func newRecord(typ byte, key string) record {
 		}
 	case blockTypeIndex:
 		return &indexRecord{LastKey: key}
+	case blockTypeAny:
+		return nil
 	}
-	return nil
+	return &CustomRecord{Type: typ, Key: key}
 }
 
 type objRecord struct {
@@ -45,73 +48,24 @@ type objRecord struct {
 	Offsets    []uint64
 }
 
-func getVarInt(buf []byte) (uint64, int) {
-	if len(buf) == 0 {
-		return 0, -1
-	}
-	ptr := 0
-	val := uint64(buf[ptr] & 0x7f)
-	for buf[ptr]&0x80 != 0 {
-		ptr++
-		if ptr > len(buf) {
-			return 0, -1
-		}
-		val = ((val + 1) << 7) | uint64(buf[ptr]&0x7f)
-	}
-
-	return val, ptr + 1
-}
-
+// putVarInt writes the varint encoding of val to buf, returning false
+// if it does not fit.
 func putVarInt(buf []byte, val uint64) (n int, ok bool) {
-	var dest [10]byte
-
-	i := 9
-	dest[i] = byte(val & 0x7f)
-	i--
-	for {
-		val >>= 7
-		if val == 0 {
-			break
-		}
-
-		val--
-		dest[i] = 0x80 | byte(val&0x7f)
-		i--
-	}
-
-	n = len(dest[i+1:])
-	if n > len(buf) {
+	out := sst.AppendVarint(buf[:0:len(buf)], val)
+	if len(out) > len(buf) {
 		return 0, false
 	}
-	copy(buf, dest[i+1:])
-	return n, true
+	return len(out), true
 }
 
+// encodeKey writes the key of a record to buf, returning false if it
+// does not fit.
 func encodeKey(buf []byte, prevKey, key string, extra uint8) (n int, restart bool, fits bool) {
-	start := buf
-	prefixLen := commonPrefixSize(prevKey, key)
-	restart = prefixLen == 0
-
-	s, ok := putVarInt(buf, uint64(prefixLen))
-	if !ok {
-		return
-	}
-	buf = buf[s:]
-
-	suffixLen := len(key) - prefixLen
-	if s, ok := putVarInt(buf, uint64(suffixLen<<3)|uint64(extra)); !ok {
-		return
-	} else {
-		buf = buf[s:]
+	out, restart := sst.AppendKey(buf[:0:len(buf)], prevKey, key, extra)
+	if len(out) > len(buf) {
+		return 0, false, false
 	}
-	if len(buf) < suffixLen {
-		return
-	}
-	copy(buf, key[prefixLen:])
-	buf = buf[suffixLen:]
-
-	n = len(start) - len(buf)
-	return n, restart, true
+	return len(out), restart, true
 }
 
 func (r *RefRecord) typ() byte {
@@ -149,7 +103,7 @@ func (r *RefRecord) decode(buf []byte, key string, valType uint8, hashSize int)
 	*r = RefRecord{}
 	start := buf
 	r.RefName = key
-	delta, s := getVarInt(buf)
+	delta, s := sst.Varint(buf)
 	if s <= 0 {
 		return
 	}
@@ -174,12 +128,12 @@ func (r *RefRecord) decode(buf []byte, key string, valType uint8, hashSize int)
 		copy(r.TargetValue, buf[:hashSize])
 		buf = buf[hashSize:]
 	case 3:
-		tsize, s := getVarInt(buf)
+		tsize, s := sst.Varint(buf)
 		if s <= 0 {
 			return
 		}
 		buf = buf[s:]
-		if len(buf) < int(tsize) {
+		if uint64(len(buf)) < tsize {
 			return
 		}
 
@@ -311,7 +265,7 @@ func (r *objRecord) decode(buf []byte, prefix string, cnt3 uint8, hashSize int)
 	r.HashPrefix = []byte(prefix)
 	var count uint64
 	if cnt3 == 0 {
-		count, n = getVarInt(buf)
+		count, n = sst.Varint(buf)
 		if n <= 0 {
 			return
 		}
@@ -323,9 +277,13 @@ func (r *objRecord) decode(buf []byte, prefix string, cnt3 uint8, hashSize int)
 	if count == 0 {
 		return len(start) - len(buf), true
 	}
+	// Each offset takes at least a byte.
+	if count > uint64(len(buf)) {
+		return
+	}
 
 	r.Offsets = make([]uint64, 1, count)
-	r.Offsets[0], n = getVarInt(buf)
+	r.Offsets[0], n = sst.Varint(buf)
 	if n <= 0 {
 		return
 	}
@@ -334,7 +292,7 @@ func (r *objRecord) decode(buf []byte, prefix string, cnt3 uint8, hashSize int)
 
 	last := r.Offsets[0]
 	for count > 0 {
-		o, n := getVarInt(buf)
+		o, n := sst.Varint(buf)
 		if n <= 0 {
 			return 0, false
 		}
@@ -383,7 +341,7 @@ func (r *indexRecord) decode(buf []byte, key string, valType uint8, hashSize int
 	r.LastKey = key
 
 	var s int
-	r.Offset, s = getVarInt(buf)
+	r.Offset, s = sst.Varint(buf)
 	if s <= 0 {
 		return
 	}
@@ -405,58 +363,22 @@ func (r *indexRecord) encode(buf []byte, hashSize int) (n int, ok bool) {
 var fmtError = errors.New("reftable: format error")
 
 func decodeRestartKey(buf []byte, off uint32) (key string, err error) {
-	err = fmtError
 	if len(buf) <= int(off) {
-		return
-	}
-
-	if buf[off] != 0 {
-		return
-	}
-	buf = buf[off+1:]
-
-	l, s := getVarInt(buf)
-	if s <= 0 {
-		return
+		return "", fmtError
 	}
-	buf = buf[s:]
-	l >>= 3
-	if uint64(len(buf)) < l {
-		return
+	prefix, suffix, _, n := sst.DecodeKey(buf[off:])
+	if n <= 0 || prefix != 0 {
+		return "", fmtError
 	}
-
-	return string(buf[:l]), nil
+	return string(suffix), nil
 }
 
 func decodeKey(buf []byte, prevKey string) (n int, key string, value uint8, ok bool) {
-	start := buf
-	prefixLen, s := getVarInt(buf)
-	if s <= 0 {
+	prefix, suffix, value, n := sst.DecodeKey(buf)
+	if n <= 0 || prefix > len(prevKey) {
 		return
 	}
-	buf = buf[s:]
-
-	suffixLen, s := getVarInt(buf)
-	if s <= 0 {
-		return
-	}
-	buf = buf[s:]
-	value = uint8(suffixLen & 0x7)
-	suffixLen = suffixLen >> 3
-
-	if int(suffixLen) > len(buf) {
-		return
-	}
-
-	if int(prefixLen) > len(prevKey) {
-		return
-	}
-
-	name := make([]byte, suffixLen+prefixLen)
-	copy(name, prevKey[:prefixLen])
-	copy(name[prefixLen:], buf[:suffixLen])
-	buf = buf[suffixLen:]
-	return len(start) - len(buf), string(name), value, true
+	return n, prevKey[:prefix] + string(suffix), value, true
 }
 
 func revInt64(t uint64) uint64 {
@@ -519,8 +441,8 @@ func (l *LogRecord) encode(buf []byte, hashSize int) (n int, fits bool) {
 	}
 
 	if len(l.Old) != hashSize || len(l.New) != hashSize {
-		log.Panicf("invalid log entry %d!=%d || %d!=%d",
-			len(l.Old), hashSize, len(l.New), hashSize)
+		// Writers reject these with ErrHashSize up front.
+		return 0, false
 	}
 
 	start := buf
@@ -567,12 +489,12 @@ func (l *LogRecord) encode(buf []byte, hashSize int) (n int, fits bool) {
 
 func decodeString(buf []byte) (n int, val string, ok bool) {
 	start := buf
-	nameLen, s := getVarInt(buf)
+	nameLen, s := sst.Varint(buf)
 	if s <= 0 {
 		return
 	}
 	buf = buf[s:]
-	if len(buf) < int(nameLen) {
+	if uint64(len(buf)) < nameLen {
 		return
 	}
 	val = string(buf[:nameLen])
@@ -630,14 +552,14 @@ func (l *LogRecord) decode(buf []byte, key string, valType uint8, hashSize int)
 	}
 	buf = buf[n:]
 
-	l.Time, n = getVarInt(buf)
+	l.Time, n = sst.Varint(buf)
 	if n <= 0 {
-		return
+		return 0, false
 	}
 	buf = buf[n:]
 
 	if len(buf) < 2 {
-		return
+		return 0, false
 	}
 	tz := binary.BigEndian.Uint16(buf)
 	buf = buf[2:]
@@ -16,6 +16,8 @@ import (
 	"reflect"
 	"testing"
 	"testing/quick"
+
+	"github.com/google/reftable/sst"
 )
 
 func testHash256(j int) []byte {
@@ -111,23 +113,6 @@ func testRecordRoundTrip(t *testing.T, inputs []record) {
 	}
 }
 
-func TestCommonPrefix(t *testing.T) {
-	for _, c := range []struct {
-		a, b string
-		want int
-	}{
-		{"abc", "ab", 2},
-		{"", "abc", 0},
-		{"abc", "abd", 2},
-		{"abc", "pqr", 0},
-	} {
-		got := commonPrefixSize(c.a, c.b)
-		if got != c.want {
-			t.Fatalf("commonPrefixSize(%q,%q): %d, want %d", c.a, c.b, got, c.want)
-		}
-	}
-}
-
 func TestRecordRoundTripLogRecord(t *testing.T) {
 	inputs := []record{&LogRecord{
 		RefName:     "prefix/master",
@@ -178,9 +163,9 @@ func TestVarIntRoundtrip(t *testing.T) {
 		if !ok {
 			t.Fatalf("putVarInt(%v): !ok", v)
 		}
-		w, _ := getVarInt(d[:n])
+		w, _ := sst.Varint(d[:n])
 		if !ok {
-			t.Fatalf("getVarInt(%v): !ok", v)
+			t.Fatalf("Varint(%v): !ok", v)
 		}
 
 		if v != w {
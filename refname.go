@@ -44,7 +44,7 @@ func hasRefWithPrefix(tab Table, additions []string, deletions map[string]bool,
 		return true, nil
 	}
 
-	it, err := tab.SeekRef(prefix)
+	it, err := tab.SeekRefPrefix(prefix)
 	if err != nil {
 		return false, err
 	}
@@ -61,7 +61,7 @@ func hasRefWithPrefix(tab Table, additions []string, deletions map[string]bool,
 		if deletions[rec.RefName] {
 			continue
 		}
-		return strings.HasPrefix(rec.RefName, prefix), nil
+		return true, nil
 	}
 }
 
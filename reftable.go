@@ -56,9 +56,11 @@ func (bs *fileBlockSource) Close() error {
 	return bs.f.Close()
 }
 
-// ReadRef reads a ref record by name.
+// ReadRef reads a ref record by name. Tables whose ref filter rules
+// out the name are not searched.
 func ReadRef(tab Table, name string) (*RefRecord, error) {
-	it, err := tab.SeekRef(name)
+	// The smallest name after name.
+	it, err := tab.SeekRefRange(name, name+"\x00")
 	if err != nil {
 		return nil, err
 	}
@@ -10,10 +10,17 @@ package reftable
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -29,7 +36,7 @@ func TestTableObjectIDLen(t *testing.T) {
 		h := bytes.Repeat([]byte{'~'}, sha1.Size)
 		h[4] = byte(i)
 
-		refName := string('a'+i) + suffix
+		refName := string(rune('a'+i)) + suffix
 		refs = append(refs, RefRecord{
 			RefName: refName,
 			Value:   h,
@@ -74,7 +81,7 @@ func TestTableObjectIDLen(t *testing.T) {
 	}
 }
 
-func constructTestTable(t *testing.T, refs []RefRecord, logs []LogRecord, cfg Config) (*Writer, *Reader) {
+func constructTestTable(t testing.TB, refs []RefRecord, logs []LogRecord, cfg Config) (*Writer, *Reader) {
 	buf := &bytes.Buffer{}
 	var min, max uint64
 	min = math.MaxUint64
@@ -386,6 +393,113 @@ func TestTableSeekRefLevel2(t *testing.T) {
 	testTableSeek(t, blockTypeRef, 120, 50, 256, 2, false)
 }
 
+func TestTableSeekEveryRefLevel2(t *testing.T) {
+	var refs []RefRecord
+	suffix := strings.Repeat("x", 50)
+	for i := 0; i < 120; i++ {
+		refs = append(refs, RefRecord{
+			RefName: fmt.Sprintf("%04d/%s", i, suffix)[:50],
+			Value:   testHash(i),
+		})
+	}
+	w, reader := constructTestTable(t, refs, nil, Config{
+		BlockSize: 256,
+	})
+	if got := w.Stats.RefStats.MaxIndexLevel; got != 2 {
+		t.Fatalf("got index level %d, want 2", got)
+	}
+
+	for _, want := range refs {
+		got, err := ReadRef(reader, want.RefName)
+		if err != nil {
+			t.Fatalf("ReadRef(%s): %v", want.RefName, err)
+		}
+		if got == nil {
+			t.Fatalf("ReadRef(%s): not found", want.RefName)
+		}
+	}
+}
+
+// indexedBlocks returns the offsets of the blocks that the index
+// block at off points to, following the lower index levels.
+func indexedBlocks(t *testing.T, r *Reader, off uint64) []uint64 {
+	br, err := r.newBlockReader(off, blockTypeIndex)
+	if err != nil || br == nil {
+		t.Fatalf("index block at 0x%x: %v, %v", off, br, err)
+	}
+	var bi blockIter
+	br.start(&bi)
+
+	var offs []uint64
+	for {
+		var rec indexRecord
+		ok, err := bi.Next(&rec)
+		if err != nil {
+			t.Fatalf("index block at 0x%x: %v", off, err)
+		}
+		if !ok {
+			return offs
+		}
+		if child, err := r.newBlockReader(rec.Offset, blockTypeIndex); err != nil {
+			t.Fatalf("block at 0x%x: %v", rec.Offset, err)
+		} else if child != nil {
+			offs = append(offs, indexedBlocks(t, r, rec.Offset)...)
+		} else {
+			offs = append(offs, rec.Offset)
+		}
+	}
+}
+
+// sectionOffsets returns the offsets of the blocks of a section, or
+// of its top-level index, which may take a few blocks.
+func sectionOffsets(t *testing.T, r *Reader, typ byte, index bool) []uint64 {
+	it, err := r.start(typ, index)
+	if err != nil || it == nil {
+		t.Fatalf("start(%c, %v): %v, %v", typ, index, it, err)
+	}
+	var offs []uint64
+	for {
+		offs = append(offs, it.blockOff)
+		ok, err := it.nextBlock()
+		if err != nil {
+			t.Fatalf("nextBlock: %v", err)
+		}
+		if !ok {
+			return offs
+		}
+	}
+}
+
+func TestWriterIndexEveryBlock(t *testing.T) {
+	var refs []RefRecord
+	var logs []LogRecord
+	suffix := strings.Repeat("x", 50)
+	for i := 0; i < 120; i++ {
+		name := fmt.Sprintf("%04d/%s", i, suffix)[:50]
+		refs = append(refs, RefRecord{RefName: name, Value: testHash(i)})
+		logs = append(logs, LogRecord{RefName: name, New: testHash(i), Message: suffix})
+	}
+	w, r := constructTestTable(t, refs, logs, Config{
+		BlockSize: 256,
+	})
+	if got := w.Stats.RefStats.MaxIndexLevel; got != 2 {
+		t.Fatalf("got ref index level %d, want 2", got)
+	}
+
+	// Each level of the index must point to the last block of the
+	// level below, and the index of a section must not point into
+	// the one before.
+	for _, typ := range []byte{blockTypeRef, blockTypeLog} {
+		var got []uint64
+		for _, off := range sectionOffsets(t, r, typ, true) {
+			got = append(got, indexedBlocks(t, r, off)...)
+		}
+		if want := sectionOffsets(t, r, typ, false); !reflect.DeepEqual(got, want) {
+			t.Errorf("%c: index points to blocks %x, want %x", typ, got, want)
+		}
+	}
+}
+
 func TestTableSeekLogLevel0(t *testing.T) {
 	// 8 * 50 / 256 ~= 2, this should not have an index
 	testTableSeek(t, blockTypeLog, 4, 50, 256, 0, false)
@@ -401,10 +515,10 @@ func TestTableIterRefLevel0(t *testing.T) {
 	testTableSeek(t, blockTypeRef, 4, 50, 256, 0, true)
 }
 
-func TestTableSeekLogLevel1(t *testing.T) {
+func TestTableSeekLogLevel2(t *testing.T) {
 	// 25 * (50b + 60b) -> 13 blocks
-	// 13 blocks -> 3 index blocks; not enough for another index level
-	testTableSeek(t, blockTypeLog, 25, 50, 256, 1, false)
+	// 13 blocks -> 5 index blocks -> 1 index block
+	testTableSeek(t, blockTypeLog, 25, 50, 256, 2, false)
 }
 
 func TestTableLogBlocksUnaligned(t *testing.T) {
@@ -431,6 +545,121 @@ func TestTableLogBlocksUnaligned(t *testing.T) {
 	}
 }
 
+func TestTableParallelLogCompression(t *testing.T) {
+	var refs []RefRecord
+	var logs []LogRecord
+	for i := 0; i < 500; i++ {
+		name := fmt.Sprintf("refs/heads/branch%04d", i)
+		refs = append(refs, RefRecord{
+			RefName:     name,
+			UpdateIndex: 1,
+			Value:       testHash(i),
+		})
+		logs = append(logs, LogRecord{
+			RefName:     name,
+			UpdateIndex: 1,
+			New:         testHash(i),
+			Old:         testHash(i + 1),
+			Message:     fmt.Sprintf("update %d %s\n", i, strings.Repeat("x", i%97)),
+		})
+	}
+
+	for _, withRefs := range []bool{false, true} {
+		for _, codec := range []Codec{nil, SnappyCompression} {
+			var tables [][]byte
+			var stats []Stats
+			for _, workers := range []int{0, 4} {
+				cfg := Config{
+					BlockSize:             512,
+					LogCodec:              codec,
+					LogCompressionWorkers: workers,
+				}
+				var rs []RefRecord
+				if withRefs {
+					rs = refs
+				}
+				w, r := constructTestTable(t, rs, logs, cfg)
+				if errs := r.Verify(); len(errs) > 0 {
+					t.Fatalf("refs %v codec %T workers %d: Verify: %v", withRefs, codec, workers, errs[0])
+				}
+				if w.Stats.LogStats.Blocks < 10 || w.Stats.LogStats.IndexBlocks == 0 {
+					t.Fatalf("got log stats %+v, want several blocks", w.Stats.LogStats)
+				}
+				tables = append(tables, w.paddedWriter.out.(*bytes.Buffer).Bytes())
+				stats = append(stats, w.Stats)
+			}
+
+			if !bytes.Equal(tables[0], tables[1]) {
+				t.Errorf("refs %v codec %T: tables differ", withRefs, codec)
+			}
+			if !reflect.DeepEqual(stats[0], stats[1]) {
+				t.Errorf("refs %v codec %T: got stats %+v, want %+v", withRefs, codec, stats[1], stats[0])
+			}
+		}
+	}
+}
+
+func TestTableSectionBlockSizes(t *testing.T) {
+	refs, logs := checksumTestRecords(500)
+
+	for _, cfg := range []Config{
+		{RefBlockSize: 256, LogBlockSize: 1 << 16, ObjBlockSize: 512, IndexBlockSize: 1024},
+		{RefBlockSize: 2048, ObjBlockSize: 256, IndexBlockSize: 512, Unaligned: true},
+		{BlockSize: 512, LogBlockSize: 128, RefRestartInterval: 2, IndexRestartInterval: 64, LogRestartInterval: 1},
+	} {
+		w, r := constructTestTable(t, refs, logs, cfg)
+		if errs := r.Verify(); len(errs) > 0 {
+			t.Fatalf("%+v: Verify: %v", cfg, errs)
+		}
+
+		want := w.cfg.RefBlockSize
+		for _, sz := range []uint32{w.cfg.ObjBlockSize, w.cfg.IndexBlockSize} {
+			if sz > want {
+				want = sz
+			}
+		}
+		if r.header.BlockSize != want {
+			t.Errorf("%+v: got header block size %d, want %d", cfg, r.header.BlockSize, want)
+		}
+
+		stats := w.Stats
+		if got, max := stats.RefStats.Entries/stats.RefStats.Blocks, int(w.cfg.RefBlockSize)/20; got > max {
+			t.Errorf("%+v: got %d refs per block, want at most %d", cfg, got, max)
+		}
+		if got, want := stats.RefStats.Restarts, stats.RefStats.Entries/w.cfg.RefRestartInterval; got < want {
+			t.Errorf("%+v: got %d ref restarts, want at least %d", cfg, got, want)
+		}
+		if got, want := stats.LogStats.Restarts, stats.LogStats.Entries/w.cfg.LogRestartInterval; got < want {
+			t.Errorf("%+v: got %d log restarts, want at least %d", cfg, got, want)
+		}
+		if cfg.LogBlockSize == 1<<16 && stats.LogStats.Blocks != 1 {
+			t.Errorf("%+v: got %d log blocks, want 1", cfg, stats.LogStats.Blocks)
+		}
+
+		for i := range refs {
+			if got, err := ReadRef(r, refs[i].RefName); err != nil || got == nil || !reflect.DeepEqual(*got, refs[i]) {
+				t.Fatalf("%+v: ReadRef(%q): %v, %v", cfg, refs[i].RefName, got, err)
+			}
+		}
+		if n, err := countRecords(r); err != nil || n != len(refs)+len(logs) {
+			t.Fatalf("%+v: got %d records, %v", cfg, n, err)
+		}
+
+		it, err := r.RefsFor(testHash(42))
+		if err != nil {
+			t.Fatalf("RefsFor: %v", err)
+		}
+		var ref RefRecord
+		if ok, err := it.NextRef(&ref); !ok || err != nil || ref.RefName != refs[42].RefName {
+			t.Errorf("%+v: RefsFor: got %v, %v, %v", cfg, ref, ok, err)
+		}
+	}
+
+	if _, err := NewWriter(&bytes.Buffer{}, &Config{LogBlockSize: 1 << 24}); err == nil {
+		t.Errorf("NewWriter accepted log block size of 16M")
+	}
+}
+
 func TestTableRefsForIndexed(t *testing.T) {
 	testTableRefsFor(t, true)
 }
@@ -481,6 +710,73 @@ func testTableRefsFor(t *testing.T, indexed bool) {
 	}
 }
 
+func TestTableRefsForPrefix(t *testing.T) {
+	var refs []RefRecord
+	for i := 0; i < 200; i++ {
+		val := sha1.Sum([]byte(fmt.Sprint(i / 2)))
+		ref := RefRecord{
+			RefName: fmt.Sprintf("refs/heads/%04d", i),
+			Value:   val[:],
+		}
+		if i%10 == 0 {
+			peeled := sha1.Sum([]byte(fmt.Sprint("peeled", i)))
+			ref.TargetValue = peeled[:]
+		}
+		refs = append(refs, ref)
+	}
+
+	for _, cfg := range []Config{
+		{BlockSize: 256},
+		{BlockSize: 256, SkipIndexObjects: true},
+		{BlockSize: 256, Format: FormatV2},
+	} {
+		_, reader := constructTestTable(t, refs, nil, cfg)
+		if cfg.Format == FormatV1 && reader.offsets[blockTypeObj].Present == cfg.SkipIndexObjects {
+			t.Fatalf("%+v: obj section present: %v", cfg, reader.offsets[blockTypeObj].Present)
+		}
+
+		for _, abbrev := range [][]byte{
+			refs[0].Value[:1],
+			refs[17].Value[:2],
+			refs[31].Value[:3],
+			refs[40].TargetValue[:2],
+			refs[99].Value,
+			{0xff, 0xff, 0xff},
+		} {
+			var want []string
+			for _, r := range refs {
+				if bytes.HasPrefix(r.Value, abbrev) || bytes.HasPrefix(r.TargetValue, abbrev) {
+					want = append(want, r.RefName)
+				}
+			}
+
+			it, err := reader.RefsForPrefix(abbrev)
+			if err != nil {
+				t.Fatalf("RefsForPrefix: %v", err)
+			}
+			var got []string
+			for {
+				var ref RefRecord
+				ok, err := it.NextRef(&ref)
+				if err != nil {
+					t.Fatalf("NextRef: %v", err)
+				}
+				if !ok {
+					break
+				}
+				got = append(got, ref.RefName)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%+v: RefsForPrefix(%x): got %v, want %v", cfg, abbrev, got, want)
+			}
+		}
+
+		if _, err := reader.RefsForPrefix(nil); err == nil {
+			t.Errorf("%+v: RefsForPrefix accepted an empty prefix", cfg)
+		}
+	}
+}
+
 func TestTableMinUpdate(t *testing.T) {
 	buf := &bytes.Buffer{}
 	w, err := NewWriter(buf, &Config{})
@@ -502,6 +798,135 @@ func TestTableMinUpdate(t *testing.T) {
 	}
 }
 
+// seekOnlyFile hides the WriteAt method of *os.File.
+type seekOnlyFile struct {
+	f *os.File
+}
+
+func (s *seekOnlyFile) Write(b []byte) (int, error) {
+	return s.f.Write(b)
+}
+
+func (s *seekOnlyFile) Seek(off int64, whence int) (int64, error) {
+	return s.f.Seek(off, whence)
+}
+
+// writeAtOnlyFile hides the Seek method of *os.File.
+type writeAtOnlyFile struct {
+	f *os.File
+}
+
+func (s *writeAtOnlyFile) Write(b []byte) (int, error) {
+	return s.f.Write(b)
+}
+
+func (s *writeAtOnlyFile) WriteAt(b []byte, off int64) (int, error) {
+	return s.f.WriteAt(b, off)
+}
+
+func TestTableAutoMaxUpdateIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, kind := range []string{"buffer", "file", "seeker", "writerAt"} {
+		var out io.Writer
+		var data func() []byte
+		switch kind {
+		case "buffer":
+			buf := &bytes.Buffer{}
+			out, data = buf, buf.Bytes
+		case "file", "seeker", "writerAt":
+			f, err := os.Create(filepath.Join(dir, kind))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			// The table need not start at offset 0.
+			if _, err := f.Write([]byte("junk")); err != nil {
+				t.Fatal(err)
+			}
+			out = f
+			switch kind {
+			case "seeker":
+				out = &seekOnlyFile{f}
+			case "writerAt":
+				out = &writeAtOnlyFile{f}
+			}
+			data = func() []byte {
+				c, err := ioutil.ReadFile(f.Name())
+				if err != nil {
+					t.Fatal(err)
+				}
+				return c[4:]
+			}
+		}
+
+		w, err := NewWriter(out, &Config{BlockSize: 256})
+		if err != nil {
+			t.Fatalf("NewWriter: %v", err)
+		}
+		w.SetMinUpdateIndex(3)
+		if err := w.AddRef(&RefRecord{RefName: "a", UpdateIndex: 2}); err == nil {
+			t.Fatalf("%s: succeeded adding ref below the lower limit", kind)
+		}
+
+		var refs []RefRecord
+		for i := 0; i < 50; i++ {
+			refs = append(refs, RefRecord{
+				RefName:     fmt.Sprintf("refs/heads/%02d", i),
+				UpdateIndex: uint64(3 + i%7),
+				Value:       testHash(i),
+			})
+			if err := w.AddRef(&refs[i]); err != nil {
+				t.Fatalf("%s: AddRef: %v", kind, err)
+			}
+		}
+		if err := w.AddLog(&LogRecord{
+			RefName:     "refs/heads/00",
+			UpdateIndex: 12,
+			New:         testHash(1),
+			Old:         testHash(2),
+		}); err != nil {
+			t.Fatalf("%s: AddLog: %v", kind, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: Close: %v", kind, err)
+		}
+
+		r, err := NewReader(&ByteBlockSource{data()}, kind)
+		if err != nil {
+			t.Fatalf("%s: NewReader: %v", kind, err)
+		}
+		if min, max := r.MinUpdateIndex(), r.MaxUpdateIndex(); min != 3 || max != 12 {
+			t.Errorf("%s: got limits [%d, %d], want [3, 12]", kind, min, max)
+		}
+		if errs := r.Verify(); len(errs) > 0 {
+			t.Errorf("%s: Verify: %v", kind, errs)
+		}
+
+		it, err := r.SeekRef("")
+		if err != nil {
+			t.Fatalf("SeekRef: %v", err)
+		}
+		got, err := readIter(blockTypeRef, it.impl)
+		if err != nil {
+			t.Fatalf("readIter: %v", err)
+		}
+		if len(got) != len(refs) {
+			t.Fatalf("%s: got %d refs, want %d", kind, len(got), len(refs))
+		}
+		for i := range got {
+			if !reflect.DeepEqual(got[i], &refs[i]) {
+				t.Fatalf("%s: got %v, want %v", kind, got[i], &refs[i])
+			}
+		}
+	}
+}
+
 func TestTableUpdateIndexAcrossBlockBoundary(t *testing.T) {
 	records := []RefRecord{{
 		RefName:     fmt.Sprintf("A%0*d", 200, 0),
@@ -610,4 +1035,623 @@ func TestEmptyTable(t *testing.T) {
 		t.Errorf("Next: %v, %v want false, nil", ok, err)
 	}
 
+	// Without an upper limit, there is no header to write.
+	buf.Reset()
+	w, err = NewWriter(buf, &cfg)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	w.SetMinUpdateIndex(1)
+	if err := w.Close(); err != ErrEmptyTable {
+		t.Fatalf("Close: got %v, want %v", err, ErrEmptyTable)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("got len %d for an empty table with auto limits, want 0", buf.Len())
+	}
+}
+
+func TestMmapBlockSource(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, &Config{})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	w.SetLimits(1, 1)
+	ref := RefRecord{
+		RefName:     "refs/heads/master",
+		UpdateIndex: 1,
+		Value:       testHash(1),
+	}
+	if err := w.AddRef(&ref); err != nil {
+		t.Fatalf("AddRef: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "table.ref")
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := NewMmapBlockSource(fn)
+	if err != nil {
+		t.Fatalf("NewMmapBlockSource: %v", err)
+	}
+	if got, want := bs.Size(), uint64(buf.Len()); got != want {
+		t.Fatalf("got size %d, want %d", got, want)
+	}
+
+	r, err := NewReader(bs, fn)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+
+	got, err := ReadRef(r, ref.RefName)
+	if err != nil {
+		t.Fatalf("ReadRef: %v", err)
+	}
+	if got == nil || !reflect.DeepEqual(*got, ref) {
+		t.Fatalf("got %v, want %v", got, ref)
+	}
+
+	r.Close()
+	if err := bs.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	if _, err := bs.ReadBlock(0, 10); err == nil {
+		t.Fatalf("ReadBlock after Close succeeded")
+	}
+}
+
+func TestTableSeekReverse(t *testing.T) {
+	for _, n := range []int{3, 30, 500} {
+		for _, cfg := range []Config{
+			{BlockSize: 256},
+			{BlockSize: 256, Unaligned: true},
+			{BlockSize: 4096},
+		} {
+			var refs []RefRecord
+			var logs []LogRecord
+			for i := 0; i < n; i++ {
+				name := fmt.Sprintf("refs/heads/%04d", i)
+				refs = append(refs, RefRecord{
+					RefName:     name,
+					UpdateIndex: 1,
+					Value:       testHash(i),
+				})
+				for j := 3; j > 0; j-- {
+					logs = append(logs, LogRecord{
+						RefName:     name,
+						UpdateIndex: uint64(j),
+						New:         testHash(i),
+						Old:         testHash(i + 1),
+						Message:     "message",
+					})
+				}
+			}
+
+			_, reader := constructTestTable(t, refs, logs, cfg)
+			if errs := reader.Verify(); len(errs) > 0 {
+				t.Fatalf("Verify: %v", errs)
+			}
+
+			for i := 0; i < n; i += 1 + n/10 {
+				for _, name := range []string{refs[i].RefName, refs[i].RefName + "/x", refs[i].RefName[:len(refs[i].RefName)-1]} {
+					it, err := reader.SeekRefReverse(name)
+					if err != nil {
+						t.Fatalf("SeekRefReverse(%q): %v", name, err)
+					}
+					got, err := readIter(blockTypeRef, it.impl)
+					if err != nil {
+						t.Fatalf("readIter: %v", err)
+					}
+
+					var want []record
+					for j := len(refs) - 1; j >= 0; j-- {
+						if refs[j].RefName <= name {
+							r := refs[j]
+							want = append(want, &r)
+						}
+					}
+					if !reflect.DeepEqual(got, want) {
+						t.Fatalf("n=%d cfg %+v: SeekRefReverse(%q): got %d refs, want %d", n, cfg, name, len(got), len(want))
+					}
+				}
+
+				// Page backwards from the oldest entry of a reflog.
+				it, err := reader.SeekLogReverse(refs[i].RefName, 1)
+				if err != nil {
+					t.Fatalf("SeekLogReverse: %v", err)
+				}
+				for j := uint64(1); j <= 3; j++ {
+					var l LogRecord
+					ok, err := it.NextLog(&l)
+					if !ok || err != nil {
+						t.Fatalf("NextLog: %v, %v", ok, err)
+					}
+					if l.RefName != refs[i].RefName || l.UpdateIndex != j {
+						t.Fatalf("got log %s, want %s@%d", &l, refs[i].RefName, j)
+					}
+				}
+			}
+		}
+	}
+}
+
+// offsetRecorder records the offsets of the blocks read.
+type offsetRecorder struct {
+	BlockSource
+	offs []uint64
+}
+
+func (s *offsetRecorder) ReadBlock(off uint64, size int) ([]byte, error) {
+	s.offs = append(s.offs, off)
+	return s.BlockSource.ReadBlock(off, size)
+}
+
+func TestTableSeekReverseUnindexed(t *testing.T) {
+	var refs []RefRecord
+	for i := 0; i < 20; i++ {
+		refs = append(refs, RefRecord{
+			RefName:     fmt.Sprintf("refs/heads/%04d", i),
+			UpdateIndex: 1,
+			Value:       testHash(i),
+		})
+	}
+	w, reader := constructTestTable(t, refs, nil, Config{BlockSize: 256})
+	if w.Stats.RefStats.IndexOffset != 0 || w.Stats.RefStats.Blocks < 3 {
+		t.Fatalf("got %d ref blocks with index at 0x%x, want 3 or more without index", w.Stats.RefStats.Blocks, w.Stats.RefStats.IndexOffset)
+	}
+	blocks, err := reader.sectionBlocks(0, blockTypeRef)
+	if err != nil {
+		t.Fatalf("sectionBlocks: %v", err)
+	}
+
+	// The second block is read to find the first block ends before
+	// its key, but the blocks after it are not.
+	src := &offsetRecorder{BlockSource: reader.src}
+	reader.src = src
+	it, err := reader.SeekRefReverse(refs[1].RefName)
+	if err != nil {
+		t.Fatalf("SeekRefReverse: %v", err)
+	}
+	got, err := readIter(blockTypeRef, it.impl)
+	if err != nil {
+		t.Fatalf("readIter: %v", err)
+	}
+	if want := []record{&refs[1], &refs[0]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, off := range src.offs {
+		if off >= blocks[2] {
+			t.Errorf("read block at 0x%x, after the second block at 0x%x", off, blocks[1])
+		}
+	}
+}
+
+func TestTableSeekRefPrefix(t *testing.T) {
+	var refs []RefRecord
+	var logs []LogRecord
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("refs/heads/%c/%03d", 'a'+i%4, i)
+		refs = append(refs, RefRecord{
+			RefName:     name,
+			UpdateIndex: 1,
+			Value:       testHash(i),
+		})
+		logs = append(logs, LogRecord{
+			RefName:     name,
+			UpdateIndex: 1,
+			New:         testHash(i),
+			Old:         testHash(i + 1),
+			Message:     "message\n",
+		})
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].RefName < refs[j].RefName })
+	sort.Slice(logs, func(i, j int) bool { return logs[i].RefName < logs[j].RefName })
+
+	_, reader := constructTestTable(t, refs, logs, Config{BlockSize: 256})
+
+	for _, prefix := range []string{"", "refs/heads/b/", "refs/heads/b", "refs/heads/d/199", "refs/heads/e", "refs/\xff"} {
+		it, err := reader.SeekRefPrefix(prefix)
+		if err != nil {
+			t.Fatalf("SeekRefPrefix(%q): %v", prefix, err)
+		}
+		got, err := readIter(blockTypeRef, it.impl)
+		if err != nil {
+			t.Fatalf("readIter: %v", err)
+		}
+
+		var want []record
+		for i := range refs {
+			if strings.HasPrefix(refs[i].RefName, prefix) {
+				want = append(want, &refs[i])
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("SeekRefPrefix(%q): got %d refs, want %d", prefix, len(got), len(want))
+		}
+	}
+
+	start, end := "refs/heads/b/", "refs/heads/c/100"
+	it, err := reader.SeekRefRange(start, end)
+	if err != nil {
+		t.Fatalf("SeekRefRange: %v", err)
+	}
+	got, err := readIter(blockTypeRef, it.impl)
+	if err != nil {
+		t.Fatalf("readIter: %v", err)
+	}
+	var want []record
+	for i := range refs {
+		if refs[i].RefName >= start && refs[i].RefName < end {
+			want = append(want, &refs[i])
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SeekRefRange: got %d refs, want %d", len(got), len(want))
+	}
+
+	// Ranges without refs skip the table, with or without a ref
+	// that follows them.
+	for _, prefix := range []string{"refs/heads/b/002", "refs/heads/e"} {
+		if it, err := reader.seekRange(&RefRecord{RefName: prefix}, prefixEnd(prefix)); err != nil {
+			t.Fatalf("seekRange(%q): %v", prefix, err)
+		} else if _, ok := it.(*emptyIterator); !ok {
+			t.Errorf("seekRange(%q) got %T, want table to be skipped", prefix, it)
+		}
+	}
+
+	for _, l := range []LogRecord{logs[0], logs[77], logs[len(logs)-1]} {
+		it, err := reader.SeekRefLog(l.RefName)
+		if err != nil {
+			t.Fatalf("SeekRefLog: %v", err)
+		}
+		got, err := readIter(blockTypeLog, it.impl)
+		if err != nil {
+			t.Fatalf("readIter: %v", err)
+		}
+		if want := []record{&l}; !reflect.DeepEqual(got, want) {
+			t.Errorf("SeekRefLog(%q): got %v, want %v", l.RefName, got, want)
+		}
+	}
+
+	it, err = reader.SeekRefLog("refs/heads/a")
+	if err != nil {
+		t.Fatalf("SeekRefLog: %v", err)
+	}
+	if got, err := readIter(blockTypeLog, it.impl); err != nil || len(got) > 0 {
+		t.Errorf("SeekRefLog(prefix): got %v, %v", got, err)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for in, want := range map[string]string{
+		"":           "",
+		"a":          "b",
+		"refs/":      "refs0",
+		"a\xff":      "b",
+		"\xff\xff":   "",
+		"ab\xff\xff": "ac",
+	} {
+		if got := prefixEnd(in); got != want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestTableContext(t *testing.T) {
+	var refs []RefRecord
+	var logs []LogRecord
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("refs/heads/%03d", i)
+		refs = append(refs, RefRecord{
+			RefName:     name,
+			UpdateIndex: 1,
+			Value:       testHash(i),
+		})
+		logs = append(logs, LogRecord{
+			RefName:     name,
+			UpdateIndex: 1,
+			New:         testHash(i),
+			Old:         testHash(i + 1),
+		})
+	}
+
+	for _, indexObjects := range []bool{false, true} {
+		_, reader := constructTestTable(t, refs, logs, Config{
+			BlockSize:        256,
+			SkipIndexObjects: !indexObjects,
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		it, err := reader.SeekRefContext(ctx, "")
+		if err != nil {
+			t.Fatalf("SeekRefContext: %v", err)
+		}
+		var ref RefRecord
+		if ok, err := it.NextRef(&ref); !ok || err != nil {
+			t.Fatalf("NextRef: %v, %v", ok, err)
+		}
+
+		logIt, err := reader.SeekLogContext(ctx, "", math.MaxUint64)
+		if err != nil {
+			t.Fatalf("SeekLogContext: %v", err)
+		}
+		forIt, err := reader.RefsForContext(ctx, testHash(200))
+		if err != nil {
+			t.Fatalf("RefsForContext: %v", err)
+		}
+
+		cancel()
+		if _, err := it.NextRef(&ref); err != context.Canceled {
+			t.Errorf("NextRef after cancel: %v", err)
+		}
+		var log LogRecord
+		if _, err := logIt.NextLog(&log); err != context.Canceled {
+			t.Errorf("NextLog after cancel: %v", err)
+		}
+		if _, err := forIt.NextRef(&ref); err != context.Canceled {
+			t.Errorf("RefsForContext(indexed=%v) after cancel: %v", indexObjects, err)
+		}
+		if _, err := reader.SeekRefContext(ctx, ""); err != context.Canceled {
+			t.Errorf("SeekRefContext after cancel: %v", err)
+		}
+
+		// Iterators without a context check it per call.
+		it, err = reader.SeekRef("")
+		if err != nil {
+			t.Fatalf("SeekRef: %v", err)
+		}
+		if _, err := it.NextRefContext(ctx, &ref); err != context.Canceled {
+			t.Errorf("NextRefContext: %v", err)
+		}
+		if ok, err := it.NextRef(&ref); !ok || err != nil {
+			t.Errorf("NextRef: %v, %v", ok, err)
+		}
+	}
+}
+
+// cancelAfter is a context that is canceled after Err has been
+// called n times.
+type cancelAfter struct {
+	context.Context
+	n int
+}
+
+func (c *cancelAfter) Err() error {
+	if c.n--; c.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestRefsForContextScan(t *testing.T) {
+	var refs []RefRecord
+	var logs []LogRecord
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("refs/heads/branch%02d", i)
+		refs = append(refs, RefRecord{RefName: name, UpdateIndex: 1, Value: testHash(i)})
+		logs = append(logs, LogRecord{RefName: name, UpdateIndex: 1, New: testHash(i)})
+	}
+	_, reader := constructTestTable(t, refs, logs, Config{
+		BlockSize:        256,
+		SkipIndexObjects: true,
+	})
+	m, err := NewMerged([]Table{reader}, SHA1ID)
+	if err != nil {
+		t.Fatalf("NewMerged: %v", err)
+	}
+	view, err := m.AsOf(1)
+	if err != nil {
+		t.Fatalf("AsOf: %v", err)
+	}
+
+	// No ref points to the object, so the scan reads every ref,
+	// and must notice the context is canceled along the way. A
+	// merged table starts the scan to find its first ref.
+	for name, tab := range map[string]Table{"reader": reader, "merged": m, "view": view} {
+		ctx, cancel := context.WithCancel(context.Background())
+		it, err := tab.RefsForContext(&cancelAfter{Context: ctx, n: 10}, testHash(200))
+		ok := false
+		if err == nil {
+			var ref RefRecord
+			ok, err = it.NextRef(&ref)
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: got %v, %v, want context.Canceled", name, ok, err)
+		}
+		cancel()
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	w, err := NewWriter(&bytes.Buffer{}, &Config{BlockSize: 256})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	w.SetLimits(1, 1)
+
+	if err := w.AddRef(&RefRecord{RefName: "b", UpdateIndex: 1}); err != nil {
+		t.Fatalf("AddRef: %v", err)
+	}
+	if err := w.AddRef(&RefRecord{RefName: "a", UpdateIndex: 1}); !errors.Is(err, ErrKeyOrder) {
+		t.Errorf("AddRef out of order: got %v, want ErrKeyOrder", err)
+	}
+	if err := w.AddRef(&RefRecord{RefName: "c", UpdateIndex: 1, Value: []byte("short")}); !errors.Is(err, ErrHashSize) {
+		t.Errorf("AddRef with short hash: got %v, want ErrHashSize", err)
+	}
+	if err := w.AddRef(&RefRecord{RefName: "c", UpdateIndex: 1, Target: strings.Repeat("x", 300)}); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("AddRef of huge ref: got %v, want ErrRecordTooLarge", err)
+	}
+	if err := w.AddRef(&RefRecord{RefName: "d", UpdateIndex: 1}); err != nil {
+		t.Fatalf("AddRef after errors: %v", err)
+	}
+
+	if err := w.AddLog(&LogRecord{RefName: "a", UpdateIndex: 1, New: testHash256(1)}); !errors.Is(err, ErrHashSize) {
+		t.Errorf("AddLog with SHA-256 hash: got %v, want ErrHashSize", err)
+	}
+	if err := w.AddLog(&LogRecord{RefName: "a", UpdateIndex: 1}); err != nil {
+		t.Fatalf("AddLog: %v", err)
+	}
+	if err := w.AddRef(&RefRecord{RefName: "e", UpdateIndex: 1}); !errors.Is(err, ErrKeyOrder) {
+		t.Errorf("AddRef after AddLog: got %v, want ErrKeyOrder", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The index records for long ref names do not fit in the index
+	// blocks, which the first log entry finds out.
+	w, err = NewWriter(&bytes.Buffer{}, &Config{RefBlockSize: 1024, IndexBlockSize: 256})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	w.SetLimits(1, 1)
+	for i := 0; i < 12; i++ {
+		name := fmt.Sprintf("refs/heads/%02d/%s", i, strings.Repeat("x", 300))
+		if err := w.AddRef(&RefRecord{RefName: name, UpdateIndex: 1}); err != nil {
+			t.Fatalf("AddRef: %v", err)
+		}
+	}
+	if err := w.AddLog(&LogRecord{RefName: "a", UpdateIndex: 1}); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("AddLog after refs with huge index records: got %v, want ErrRecordTooLarge", err)
+	}
+
+	if _, err := NewWriter(&bytes.Buffer{}, &Config{HashID: HashID{'x', 'x', 'x', 'x'}}); !errors.Is(err, ErrHashSize) {
+		t.Errorf("NewWriter with unknown hash: got %v, want ErrHashSize", err)
+	}
+}
+
+func TestCorruptTableError(t *testing.T) {
+	var refs []RefRecord
+	for i := 0; i < 20; i++ {
+		refs = append(refs, RefRecord{
+			RefName:     fmt.Sprintf("refs/heads/%02d", i),
+			UpdateIndex: 1,
+			Value:       testHash(i),
+		})
+	}
+	w, _ := constructTestTable(t, refs, nil, Config{BlockSize: 256})
+	data := w.paddedWriter.out.(*bytes.Buffer).Bytes()
+
+	// Break the type of the second ref block.
+	second := append([]byte{}, data...)
+	second[256] = 'x'
+	r, err := NewReader(&ByteBlockSource{second}, "second")
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	it, err := r.SeekRef("")
+	if err != nil {
+		t.Fatalf("SeekRef: %v", err)
+	}
+	_, err = readIter(blockTypeRef, it.impl)
+	var cte *CorruptTableError
+	if !errors.As(err, &cte) {
+		t.Fatalf("got %v, want CorruptTableError", err)
+	}
+	if cte.Table != "second" || cte.Offset != 256 {
+		t.Errorf("got %+v, want table second at 256", cte)
+	}
+
+	// Break the footer CRC.
+	footer := append([]byte{}, data...)
+	footer[len(footer)-1] ^= 1
+	if _, err := NewReader(&ByteBlockSource{footer}, "footer"); !errors.As(err, &cte) {
+		t.Errorf("NewReader: got %v, want CorruptTableError", err)
+	}
+
+	// Cut the table short.
+	for _, n := range []int{0, 3, 20, headerSize(1) + footerSize(1) - 1, len(data) - 1} {
+		if _, err := NewReader(&ByteBlockSource{data[:n]}, "truncated"); !errors.As(err, &cte) {
+			t.Errorf("NewReader of %d bytes: got %v, want CorruptTableError", n, err)
+		}
+	}
+
+	// Reading records of the wrong type is an error.
+	r, err = NewReader(&ByteBlockSource{data}, "data")
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	it, err = r.SeekRef("")
+	if err != nil {
+		t.Fatalf("SeekRef: %v", err)
+	}
+	var log LogRecord
+	if _, err := it.NextLog(&log); err == nil {
+		t.Errorf("NextLog on ref iterator succeeded")
+	}
+}
+
+// readCorruptTable seeks and iterates through a table, and returns
+// an error if that panics. Other errors are expected.
+func readCorruptTable(data []byte, refs []RefRecord) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+
+	r, err := NewReader(&ByteBlockSource{data}, "corrupt")
+	if err != nil {
+		return nil
+	}
+	mid := refs[len(refs)/2].RefName
+	for _, seek := range []struct {
+		typ  byte
+		seek func() (*Iterator, error)
+	}{
+		{blockTypeRef, func() (*Iterator, error) { return r.SeekRef("") }},
+		{blockTypeRef, func() (*Iterator, error) { return r.SeekRef(mid) }},
+		{blockTypeRef, func() (*Iterator, error) { return r.SeekRefPrefix(mid[:len(mid)-1]) }},
+		{blockTypeRef, func() (*Iterator, error) { return r.SeekRefReverse(mid) }},
+		{blockTypeRef, func() (*Iterator, error) { return r.RefsFor(refs[3].Value) }},
+		{blockTypeLog, func() (*Iterator, error) { return r.SeekLog("", math.MaxUint64) }},
+		{blockTypeLog, func() (*Iterator, error) { return r.SeekLog(mid, math.MaxUint64) }},
+		{blockTypeLog, func() (*Iterator, error) { return r.SeekLogReverse(mid, 0) }},
+	} {
+		if it, err := seek.seek(); err == nil {
+			readIter(seek.typ, it.impl)
+		}
+	}
+	return nil
+}
+
+func TestTableCorruptBytes(t *testing.T) {
+	refs, logs := verifyTestRecords(30)
+	for _, cfg := range []Config{
+		{BlockSize: 256},
+		{BlockSize: 256, Unaligned: true, LogCodec: NoCompression},
+		{BlockSize: 256, BlockChecksums: true, RefFilterBitsPerKey: 10, IndexLogObjects: true},
+	} {
+		w, _ := constructTestTable(t, refs, logs, cfg)
+		data := w.out.(*bytes.Buffer).Bytes()
+		if w.Stats.RefStats.IndexOffset == 0 || w.Stats.ObjStats.Offset == 0 {
+			t.Fatalf("%+v: table has no ref index or obj section", cfg)
+		}
+
+		// Vary the flipped bits, so a byte holding a count or a
+		// size gets both small and large errors across offsets.
+		flips := []byte{0x01, 0x10, 0x80, 0xff}
+		for off := range data {
+			corrupt := append([]byte{}, data...)
+			flip := flips[off%len(flips)]
+			corrupt[off] ^= flip
+			if err := readCorruptTable(corrupt, refs); err != nil {
+				t.Fatalf("%+v: flip 0x%02x at 0x%x: %v", cfg, flip, off, err)
+			}
+		}
+		for n := range data {
+			if err := readCorruptTable(data[:n], refs); err != nil {
+				t.Fatalf("%+v: truncated to %d bytes: %v", cfg, n, err)
+			}
+		}
+	}
 }
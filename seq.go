@@ -0,0 +1,106 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"iter"
+	"math"
+)
+
+// refSeq returns the refs whose name starts with prefix as a sequence.
+// An error ends the sequence.
+func refSeq(tab Table, prefix string) iter.Seq2[RefRecord, error] {
+	return func(yield func(RefRecord, error) bool) {
+		it, err := tab.SeekRefPrefix(prefix)
+		if err != nil {
+			yield(RefRecord{}, err)
+			return
+		}
+		for {
+			var rec RefRecord
+			ok, err := it.NextRef(&rec)
+			if err != nil {
+				yield(RefRecord{}, err)
+				return
+			}
+			if !ok || !yield(rec, nil) {
+				return
+			}
+		}
+	}
+}
+
+// logSeq returns the log records of the refs whose name starts with
+// prefix as a sequence. An error ends the sequence.
+func logSeq(tab Table, prefix string) iter.Seq2[LogRecord, error] {
+	return func(yield func(LogRecord, error) bool) {
+		start := &LogRecord{
+			RefName:     prefix,
+			UpdateIndex: math.MaxUint64,
+		}
+		impl, err := tab.seekRange(start, prefixEnd(prefix))
+		if err != nil {
+			yield(LogRecord{}, err)
+			return
+		}
+		for {
+			var rec LogRecord
+			ok, err := impl.Next(&rec)
+			if err != nil {
+				yield(LogRecord{}, err)
+				return
+			}
+			if !ok || !yield(rec, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Refs returns the refs whose name starts with prefix, in order.
+func (r *Reader) Refs(prefix string) iter.Seq2[RefRecord, error] {
+	return refSeq(r, prefix)
+}
+
+// Logs returns the log records of the refs whose name starts with
+// prefix, ordered by ref name, newest first.
+func (r *Reader) Logs(prefix string) iter.Seq2[LogRecord, error] {
+	return logSeq(r, prefix)
+}
+
+// Refs returns the refs whose name starts with prefix, in order.
+func (m *Merged) Refs(prefix string) iter.Seq2[RefRecord, error] {
+	return refSeq(m, prefix)
+}
+
+// Logs returns the log records of the refs whose name starts with
+// prefix, ordered by ref name, newest first.
+func (m *Merged) Logs(prefix string) iter.Seq2[LogRecord, error] {
+	return logSeq(m, prefix)
+}
+
+// Refs is like Merged.Refs. The tables of the stack stay open until
+// the loop ends, also when it breaks early.
+func (st *Stack) Refs(prefix string) iter.Seq2[RefRecord, error] {
+	return func(yield func(RefRecord, error) bool) {
+		m, release := st.Acquire()
+		defer release()
+		refSeq(m, prefix)(yield)
+	}
+}
+
+// Logs is like Merged.Logs. The tables of the stack stay open until
+// the loop ends, also when it breaks early.
+func (st *Stack) Logs(prefix string) iter.Seq2[LogRecord, error] {
+	return func(yield func(LogRecord, error) bool) {
+		m, release := st.Acquire()
+		defer release()
+		logSeq(m, prefix)(yield)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTableSeq(t *testing.T) {
+	var refs []RefRecord
+	var logs []LogRecord
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("refs/heads/%c/%02d", 'a'+i/25, i%25)
+		refs = append(refs, RefRecord{
+			RefName:     name,
+			UpdateIndex: 2,
+			Value:       testHash(i),
+		})
+		for j := 2; j > 0; j-- {
+			logs = append(logs, LogRecord{
+				RefName:     name,
+				UpdateIndex: uint64(j),
+				New:         testHash(i),
+				Old:         testHash(i + 1),
+				Message:     "message\n",
+			})
+		}
+	}
+
+	_, reader := constructTestTable(t, refs, logs, Config{BlockSize: 256})
+	merged, err := NewMerged([]Table{reader}, SHA1ID)
+	if err != nil {
+		t.Fatalf("NewMerged: %v", err)
+	}
+
+	for _, tab := range []Table{reader, merged} {
+		var gotRefs []RefRecord
+		for rec, err := range tab.Refs("refs/heads/b/") {
+			if err != nil {
+				t.Fatalf("Refs: %v", err)
+			}
+			gotRefs = append(gotRefs, rec)
+		}
+		if !reflect.DeepEqual(gotRefs, refs[25:]) {
+			t.Errorf("%s: Refs: got %d refs, want 25", tab.Name(), len(gotRefs))
+		}
+
+		var gotLogs []LogRecord
+		for rec, err := range tab.Logs("refs/heads/a/") {
+			if err != nil {
+				t.Fatalf("Logs: %v", err)
+			}
+			gotLogs = append(gotLogs, rec)
+		}
+		if !reflect.DeepEqual(gotLogs, logs[:50]) {
+			t.Errorf("%s: Logs: got %d logs, want 50", tab.Name(), len(gotLogs))
+		}
+
+		n := 0
+		for rec, err := range tab.Refs("") {
+			if err != nil {
+				t.Fatalf("Refs: %v", err)
+			}
+			if !strings.HasPrefix(rec.RefName, "refs/heads/a/") {
+				t.Fatalf("got %q", rec.RefName)
+			}
+			n++
+			if n == 3 {
+				break
+			}
+		}
+	}
+}
+
+func TestStackSeqReleases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := NewStack(dir, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	st.disableAutoCompact = true
+
+	for i := 0; i < 3; i++ {
+		if err := st.Add(func(w *Writer) error {
+			r := RefRecord{
+				RefName:     fmt.Sprintf("branch%d", i),
+				Value:       testHash(i),
+				UpdateIndex: st.NextUpdateIndex(),
+			}
+			w.SetLimits(r.UpdateIndex, r.UpdateIndex)
+			return w.AddRef(&r)
+		}); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+
+	refs := func() []int32 {
+		var res []int32
+		for _, r := range st.stack {
+			res = append(res, atomic.LoadInt32(&r.refs))
+		}
+		return res
+	}
+	before := refs()
+
+	for rec, err := range st.Refs("") {
+		if err != nil {
+			t.Fatalf("Refs: %v", err)
+		}
+		if got := refs(); reflect.DeepEqual(got, before) {
+			t.Errorf("tables not acquired while iterating: %v", got)
+		}
+		if rec.RefName != "branch0" {
+			t.Errorf("got %q, want branch0", rec.RefName)
+		}
+		break
+	}
+	if got := refs(); !reflect.DeepEqual(got, before) {
+		t.Errorf("after break: got refs %v, want %v", got, before)
+	}
+}
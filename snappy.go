@@ -0,0 +1,177 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// This file implements the snappy block format, see
+// https://github.com/google/snappy/blob/main/format_description.txt
+
+const (
+	snappyTagLiteral = 0x00
+	snappyTagCopy1   = 0x01
+	snappyTagCopy2   = 0x02
+	snappyTagCopy4   = 0x03
+
+	snappyTableBits = 14
+	snappyMaxOffset = 1 << 16
+)
+
+var errSnappyCorrupt = errors.New("reftable: corrupt snappy data")
+
+func snappyHash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - snappyTableBits)
+}
+
+// snappyEncode appends the snappy encoding of src to dst.
+func snappyEncode(dst, src []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+
+	var table [1 << snappyTableBits]int32
+	lit := 0
+	i := 0
+	for i+4 <= len(src) {
+		u := binary.LittleEndian.Uint32(src[i:])
+		h := snappyHash(u)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if cand < 0 || i-cand >= snappyMaxOffset || binary.LittleEndian.Uint32(src[cand:]) != u {
+			i++
+			continue
+		}
+
+		dst = snappyEmitLiteral(dst, src[lit:i])
+		n := 4
+		for i+n < len(src) && src[cand+n] == src[i+n] {
+			n++
+		}
+		dst = snappyEmitCopy(dst, i-cand, n)
+		i += n
+		lit = i
+	}
+	return snappyEmitLiteral(dst, src[lit:])
+}
+
+func snappyEmitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+func snappyEmitCopy(dst []byte, offset, n int) []byte {
+	for n > 0 {
+		l := n
+		if l > 64 {
+			l = 64
+			if n-l < 4 {
+				// Leave enough for a final copy.
+				l = 60
+			}
+		}
+		if l >= 4 && l <= 11 && offset < 2048 {
+			dst = append(dst, byte(offset>>8)<<5|byte(l-4)<<2|snappyTagCopy1, byte(offset))
+		} else {
+			dst = append(dst, byte(l-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		}
+		n -= l
+	}
+	return dst
+}
+
+// snappyDecode appends the decoding of src to dst.
+func snappyDecode(dst, src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 || size > 1<<32 {
+		return nil, errSnappyCorrupt
+	}
+	src = src[n:]
+	start := len(dst)
+	want := start + int(size)
+
+	for len(src) > 0 {
+		tag := src[0]
+		var l, offset int
+		switch tag & 0x03 {
+		case snappyTagLiteral:
+			x := int(tag >> 2)
+			src = src[1:]
+			if x >= 60 {
+				k := x - 59
+				if len(src) < k {
+					return nil, errSnappyCorrupt
+				}
+				x = 0
+				for j := k - 1; j >= 0; j-- {
+					x = x<<8 | int(src[j])
+				}
+				src = src[k:]
+			}
+			l = x + 1
+			if l > len(src) || len(dst)+l > want {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[:l]...)
+			src = src[l:]
+			continue
+		case snappyTagCopy1:
+			if len(src) < 2 {
+				return nil, errSnappyCorrupt
+			}
+			l = 4 + int(tag>>2)&0x07
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+		case snappyTagCopy2:
+			if len(src) < 3 {
+				return nil, errSnappyCorrupt
+			}
+			l = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case snappyTagCopy4:
+			if len(src) < 5 {
+				return nil, errSnappyCorrupt
+			}
+			l = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+
+		if offset <= 0 || offset > len(dst)-start || len(dst)+l > want {
+			return nil, errSnappyCorrupt
+		}
+		// Copies may overlap their output, so go byte by byte.
+		from := len(dst) - offset
+		for j := 0; j < l; j++ {
+			dst = append(dst, dst[from+j])
+		}
+	}
+
+	if len(dst) != want {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
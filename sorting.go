@@ -0,0 +1,424 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// DuplicatePolicy decides what a SortingWriter does with records that
+// have the same key.
+type DuplicatePolicy int
+
+const (
+	// DuplicateError makes Close fail on duplicate keys.
+	DuplicateError DuplicatePolicy = iota
+
+	// DuplicateKeepLast keeps the record that was added last.
+	DuplicateKeepLast
+
+	// DuplicateKeepFirst keeps the record that was added first.
+	DuplicateKeepFirst
+)
+
+// SortConfig configures a SortingWriter.
+type SortConfig struct {
+	// The number of bytes of records to hold in memory before
+	// spilling them to a temporary file. If not set, 64 MiB.
+	MemoryLimit int64
+
+	// The directory for temporary files. If not set, the system
+	// default is used.
+	TempDir string
+
+	// What to do with duplicate keys.
+	Duplicates DuplicatePolicy
+}
+
+// SortingWriter writes a reftable from refs and logs added in any
+// order. Records are collected in memory, and spilled to temporary
+// files in sorted runs once they exceed the memory limit. Close
+// merges the runs, and writes the table.
+type SortingWriter struct {
+	out      io.Writer
+	cfg      Config
+	sortCfg  SortConfig
+	hashSize int
+
+	minUpdateIndex uint64
+	maxUpdateIndex uint64
+	count          int
+
+	mem     []sortEntry
+	memSize int64
+
+	// scratch is reused to encode records, which are then copied
+	// to values of their exact size.
+	scratch []byte
+
+	// runs are the spilled runs, oldest first.
+	runs []*os.File
+}
+
+// sortEntry is a record in its encoded form.
+type sortEntry struct {
+	typ     byte
+	key     string
+	valType uint8
+	val     []byte
+}
+
+// sortEntryOverhead approximates the memory used by a sortEntry
+// beyond its key and value.
+const sortEntryOverhead = 64
+
+// rank orders refs before logs, as the table has them.
+func (e *sortEntry) rank() int {
+	if e.typ == blockTypeRef {
+		return 0
+	}
+	return 1
+}
+
+func sortEntryLess(a, b *sortEntry) bool {
+	if ra, rb := a.rank(), b.rank(); ra != rb {
+		return ra < rb
+	}
+	return a.key < b.key
+}
+
+func sortEntryEqual(a, b *sortEntry) bool {
+	return a.typ == b.typ && a.key == b.key
+}
+
+// NewSortingWriter creates a SortingWriter that writes a table to out.
+func NewSortingWriter(out io.Writer, cfg *Config, sortCfg SortConfig) (*SortingWriter, error) {
+	if sortCfg.MemoryLimit == 0 {
+		sortCfg.MemoryLimit = 64 << 20
+	}
+	switch sortCfg.Duplicates {
+	case DuplicateError, DuplicateKeepLast, DuplicateKeepFirst:
+	default:
+		return nil, fmt.Errorf("reftable: unknown duplicate policy %d", sortCfg.Duplicates)
+	}
+
+	o := *cfg
+	if o.HashID == NullHashID {
+		o.HashID = SHA1ID
+	}
+	if o.HashID.Size() == 0 {
+		return nil, fmt.Errorf("%w: unknown hash ID %q", ErrHashSize, o.HashID)
+	}
+	return &SortingWriter{
+		out:            out,
+		cfg:            o,
+		sortCfg:        sortCfg,
+		hashSize:       o.HashID.Size(),
+		minUpdateIndex: math.MaxUint64,
+	}, nil
+}
+
+// AddRef adds a RefRecord to the table.
+func (w *SortingWriter) AddRef(r *RefRecord) error {
+	if r.RefName == "" {
+		return fmt.Errorf("reftable: must specify RefName")
+	}
+	return w.add(r, r.UpdateIndex)
+}
+
+// AddLog adds a LogRecord to the table.
+func (w *SortingWriter) AddLog(l *LogRecord) error {
+	if l.RefName == "" {
+		return fmt.Errorf("reftable: must specify RefName")
+	}
+	return w.add(l, l.UpdateIndex)
+}
+
+func (w *SortingWriter) add(rec record, updateIndex uint64) error {
+	if err := checkHashSize(rec, w.hashSize); err != nil {
+		return err
+	}
+	if w.scratch == nil {
+		w.scratch = make([]byte, 256)
+	}
+	var val []byte
+	for {
+		n, ok := rec.encode(w.scratch, w.hashSize)
+		if ok {
+			val = make([]byte, n)
+			copy(val, w.scratch)
+			break
+		}
+		w.scratch = make([]byte, 2*len(w.scratch))
+	}
+
+	e := sortEntry{
+		typ:     rec.typ(),
+		key:     rec.key(),
+		valType: rec.valType(),
+		val:     val,
+	}
+	w.mem = append(w.mem, e)
+	w.memSize += int64(len(e.key)+len(e.val)) + sortEntryOverhead
+	w.count++
+	if updateIndex < w.minUpdateIndex {
+		w.minUpdateIndex = updateIndex
+	}
+	if updateIndex > w.maxUpdateIndex {
+		w.maxUpdateIndex = updateIndex
+	}
+
+	if w.memSize >= w.sortCfg.MemoryLimit {
+		return w.spill()
+	}
+	return nil
+}
+
+// sortMem sorts the records in memory, keeping the order in which
+// they were added among duplicates.
+func (w *SortingWriter) sortMem() {
+	sort.SliceStable(w.mem, func(i, j int) bool {
+		return sortEntryLess(&w.mem[i], &w.mem[j])
+	})
+}
+
+// spill writes the records in memory to a new run.
+func (w *SortingWriter) spill() error {
+	w.sortMem()
+
+	f, err := os.CreateTemp(w.sortCfg.TempDir, "reftable-sort-*")
+	if err != nil {
+		return err
+	}
+	w.runs = append(w.runs, f)
+
+	bw := bufio.NewWriter(f)
+	var hdr []byte
+	for i := range w.mem {
+		e := &w.mem[i]
+		hdr = append(hdr[:0], e.typ)
+		hdr = binary.AppendUvarint(hdr, uint64(len(e.key)))
+		hdr = append(hdr, e.key...)
+		hdr = append(hdr, e.valType)
+		hdr = binary.AppendUvarint(hdr, uint64(len(e.val)))
+		if _, err := bw.Write(hdr); err != nil {
+			return err
+		}
+		if _, err := bw.Write(e.val); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	w.mem = nil
+	w.memSize = 0
+	return nil
+}
+
+// Close merges the records, and writes the table. Like Writer.Close,
+// it returns ErrEmptyTable if no records were added.
+func (w *SortingWriter) Close() error {
+	defer w.removeRuns()
+
+	wr, err := NewWriter(w.out, &w.cfg)
+	if err != nil {
+		return err
+	}
+	if w.count > 0 {
+		wr.SetLimits(w.minUpdateIndex, w.maxUpdateIndex)
+	}
+
+	w.sortMem()
+	var srcs []sortSource
+	for _, f := range w.runs {
+		srcs = append(srcs, &fileSortSource{r: bufio.NewReader(f)})
+	}
+	srcs = append(srcs, &memSortSource{entries: w.mem})
+
+	if err := w.merge(srcs, func(e *sortEntry) error {
+		rec := newRecord(e.typ, "")
+		if n, ok := rec.decode(e.val, e.key, e.valType, w.hashSize); !ok || n != len(e.val) {
+			return fmtError
+		}
+		switch r := rec.(type) {
+		case *RefRecord:
+			return wr.AddRef(r)
+		case *LogRecord:
+			return wr.AddLog(r)
+		}
+		return fmt.Errorf("reftable: unexpected record type %c", e.typ)
+	}); err != nil {
+		return err
+	}
+
+	return wr.Close()
+}
+
+func (w *SortingWriter) removeRuns() {
+	for _, f := range w.runs {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	w.runs = nil
+	w.mem = nil
+}
+
+// merge calls emit for the records of srcs in order, applying the
+// duplicate policy. Sources are ordered oldest first.
+func (w *SortingWriter) merge(srcs []sortSource, emit func(*sortEntry) error) error {
+	h := &sortHeap{}
+	for i, src := range srcs {
+		e, ok, err := src.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h.entries = append(h.entries, sortHeapEntry{e, i})
+		}
+	}
+	heap.Init(h)
+
+	pop := func() (*sortEntry, error) {
+		top := heap.Pop(h).(sortHeapEntry)
+		e, ok, err := srcs[top.src].next()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			heap.Push(h, sortHeapEntry{e, top.src})
+		}
+		return top.entry, nil
+	}
+
+	for h.Len() > 0 {
+		e, err := pop()
+		if err != nil {
+			return err
+		}
+		for h.Len() > 0 && sortEntryEqual(h.entries[0].entry, e) {
+			dup, err := pop()
+			if err != nil {
+				return err
+			}
+			switch w.sortCfg.Duplicates {
+			case DuplicateError:
+				return fmt.Errorf("reftable: duplicate key %q", e.key)
+			case DuplicateKeepLast:
+				e = dup
+			}
+		}
+
+		if err := emit(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortSource yields sorted entries.
+type sortSource interface {
+	next() (*sortEntry, bool, error)
+}
+
+type memSortSource struct {
+	entries []sortEntry
+}
+
+func (s *memSortSource) next() (*sortEntry, bool, error) {
+	if len(s.entries) == 0 {
+		return nil, false, nil
+	}
+	e := &s.entries[0]
+	s.entries = s.entries[1:]
+	return e, true, nil
+}
+
+// fileSortSource reads a run written by spill.
+type fileSortSource struct {
+	r *bufio.Reader
+}
+
+func (s *fileSortSource) next() (*sortEntry, bool, error) {
+	typ, err := s.r.ReadByte()
+	if err == io.EOF {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	e := &sortEntry{typ: typ}
+	key, err := s.readBytes()
+	if err != nil {
+		return nil, false, err
+	}
+	e.key = string(key)
+	if e.valType, err = s.r.ReadByte(); err != nil {
+		return nil, false, err
+	}
+	if e.val, err = s.readBytes(); err != nil {
+		return nil, false, err
+	}
+	return e, true, nil
+}
+
+func (s *fileSortSource) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(s.r)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(s.r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+type sortHeapEntry struct {
+	entry *sortEntry
+	src   int
+}
+
+// sortHeap is a min heap of entries. Among equal keys, the entry from
+// the oldest source comes first.
+type sortHeap struct {
+	entries []sortHeapEntry
+}
+
+func (h *sortHeap) Len() int { return len(h.entries) }
+
+func (h *sortHeap) Less(i, j int) bool {
+	a, b := h.entries[i], h.entries[j]
+	if sortEntryEqual(a.entry, b.entry) {
+		return a.src < b.src
+	}
+	return sortEntryLess(a.entry, b.entry)
+}
+
+func (h *sortHeap) Swap(i, j int) { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+
+func (h *sortHeap) Push(x interface{}) { h.entries = append(h.entries, x.(sortHeapEntry)) }
+
+func (h *sortHeap) Pop() interface{} {
+	e := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return e
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func readSortedTable(t *testing.T, data []byte) ([]record, []record) {
+	r, err := NewReader(&ByteBlockSource{data}, "sorted")
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	if errs := r.Verify(); len(errs) > 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+
+	it, err := r.SeekRef("")
+	if err != nil {
+		t.Fatalf("SeekRef: %v", err)
+	}
+	refs, err := readIter(blockTypeRef, it.impl)
+	if err != nil {
+		t.Fatalf("readIter: %v", err)
+	}
+	it, err = r.SeekLog("", 1<<63)
+	if err != nil {
+		t.Fatalf("SeekLog: %v", err)
+	}
+	logs, err := readIter(blockTypeLog, it.impl)
+	if err != nil {
+		t.Fatalf("readIter: %v", err)
+	}
+	return refs, logs
+}
+
+func TestSortingWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const N = 500
+	var refs []RefRecord
+	var logs []LogRecord
+	for i := 0; i < N; i++ {
+		name := fmt.Sprintf("refs/heads/branch%04d", i)
+		refs = append(refs, RefRecord{
+			RefName:     name,
+			UpdateIndex: uint64(1 + i%10),
+			Value:       testHash(i),
+		})
+		logs = append(logs, LogRecord{
+			RefName:     name,
+			UpdateIndex: uint64(1 + i%10),
+			New:         testHash(i),
+			Old:         testHash(i + 1),
+			Message:     strings.Repeat("x", i%50) + "\n",
+		})
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := NewSortingWriter(buf, &Config{BlockSize: 512}, SortConfig{
+		MemoryLimit: 4096,
+		TempDir:     dir,
+	})
+	if err != nil {
+		t.Fatalf("NewSortingWriter: %v", err)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for _, i := range rnd.Perm(2 * N) {
+		if i < N {
+			err = w.AddRef(&refs[i])
+		} else {
+			err = w.AddLog(&logs[i-N])
+		}
+		if err != nil {
+			t.Fatalf("add %d: %v", i, err)
+		}
+	}
+	if len(w.runs) < 2 {
+		t.Fatalf("got %d runs, want several", len(w.runs))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if left, err := ioutil.ReadDir(dir); err != nil || len(left) > 0 {
+		t.Fatalf("temporary files left: %v, %v", left, err)
+	}
+
+	gotRefs, gotLogs := readSortedTable(t, buf.Bytes())
+
+	var wantRefs, wantLogs []record
+	for i := range refs {
+		wantRefs = append(wantRefs, &refs[i])
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].key() < logs[j].key() })
+	for i := range logs {
+		wantLogs = append(wantLogs, &logs[i])
+	}
+	if !reflect.DeepEqual(gotRefs, wantRefs) {
+		t.Errorf("got %d refs, want %d", len(gotRefs), len(wantRefs))
+	}
+	if !reflect.DeepEqual(gotLogs, wantLogs) {
+		t.Errorf("got %d logs, want %d", len(gotLogs), len(wantLogs))
+	}
+}
+
+func TestSortingWriterDuplicates(t *testing.T) {
+	for _, tc := range []struct {
+		policy DuplicatePolicy
+		want   int
+	}{
+		{DuplicateError, -1},
+		{DuplicateKeepFirst, 0},
+		{DuplicateKeepLast, 4},
+	} {
+		for _, limit := range []int64{1, 1 << 20} {
+			buf := &bytes.Buffer{}
+			w, err := NewSortingWriter(buf, &Config{}, SortConfig{
+				MemoryLimit: limit,
+				Duplicates:  tc.policy,
+			})
+			if err != nil {
+				t.Fatalf("NewSortingWriter: %v", err)
+			}
+
+			for i := 0; i < 5; i++ {
+				if err := w.AddRef(&RefRecord{
+					RefName:     "refs/heads/a",
+					UpdateIndex: 1,
+					Value:       testHash(i),
+				}); err != nil {
+					t.Fatalf("AddRef: %v", err)
+				}
+				if err := w.AddRef(&RefRecord{
+					RefName:     fmt.Sprintf("refs/heads/b%d", i),
+					UpdateIndex: 1,
+					Value:       testHash(i),
+				}); err != nil {
+					t.Fatalf("AddRef: %v", err)
+				}
+			}
+
+			err = w.Close()
+			if tc.want < 0 {
+				if err == nil {
+					t.Errorf("policy %d, limit %d: Close succeeded on duplicates", tc.policy, limit)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("policy %d, limit %d: Close: %v", tc.policy, limit, err)
+			}
+
+			refs, _ := readSortedTable(t, buf.Bytes())
+			if len(refs) != 6 {
+				t.Fatalf("got %d refs, want 6", len(refs))
+			}
+			if got := refs[0].(*RefRecord).Value; !bytes.Equal(got, testHash(tc.want)) {
+				t.Errorf("policy %d, limit %d: got value %x, want %x", tc.policy, limit, got, testHash(tc.want))
+			}
+		}
+	}
+}
+
+func TestSortingWriterMemSize(t *testing.T) {
+	w, err := NewSortingWriter(&bytes.Buffer{}, &Config{}, SortConfig{})
+	if err != nil {
+		t.Fatalf("NewSortingWriter: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := w.AddRef(&RefRecord{
+			RefName:     fmt.Sprintf("refs/heads/%d", i),
+			UpdateIndex: 1,
+			Value:       testHash(i),
+		}); err != nil {
+			t.Fatalf("AddRef: %v", err)
+		}
+	}
+
+	var used int64
+	for _, e := range w.mem {
+		used += int64(len(e.key)+cap(e.val)) + sortEntryOverhead
+	}
+	if used > w.memSize {
+		t.Errorf("records use %d bytes, but count as %d", used, w.memSize)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package sst
+
+import (
+	"encoding/binary"
+)
+
+// The encoding of entry keys, varints and restart tables is shared
+// with the v1 reftable format, which frames its blocks differently
+// but stores records the same way. It is exported for that format.
+
+// MaxRestarts is the number of restarts that a restart table can
+// count. Later entries of a block are not restarts.
+const MaxRestarts = (1 << 16) - 1
+
+// Key is a key, which the v1 reftable format keeps as a string.
+type Key interface {
+	~string | ~[]byte
+}
+
+// PutU24 stores i, which must be less than 1<<24, in 3 bytes.
+func PutU24(out []byte, i uint32) {
+	out[0] = byte(i >> 16)
+	out[1] = byte(i >> 8)
+	out[2] = byte(i)
+}
+
+// U24 reads a value stored by PutU24.
+func U24(in []byte) uint32 {
+	return uint32(in[0])<<16 | uint32(in[1])<<8 | uint32(in[2])
+}
+
+// AppendVarint appends the varint encoding of v, which is the offset
+// encoding of git packfiles.
+func AppendVarint(dst []byte, v uint64) []byte {
+	var buf [10]byte
+	i := len(buf) - 1
+	buf[i] = byte(v & 0x7f)
+	for v >>= 7; v != 0; v >>= 7 {
+		v--
+		i--
+		buf[i] = 0x80 | byte(v&0x7f)
+	}
+	return append(dst, buf[i:]...)
+}
+
+// Varint decodes a varint, returning its size, or -1.
+func Varint(buf []byte) (uint64, int) {
+	if len(buf) == 0 {
+		return 0, -1
+	}
+	ptr := 0
+	val := uint64(buf[ptr] & 0x7f)
+	for buf[ptr]&0x80 != 0 {
+		ptr++
+		if ptr >= len(buf) || ptr >= 10 {
+			return 0, -1
+		}
+		val = ((val + 1) << 7) | uint64(buf[ptr]&0x7f)
+	}
+	return val, ptr + 1
+}
+
+// CommonPrefixSize returns the number of leading bytes that a and b
+// share.
+func CommonPrefixSize[K Key](a, b K) int {
+	p := 0
+	for p < len(a) && p < len(b) && a[p] == b[p] {
+		p++
+	}
+	return p
+}
+
+// AppendKey appends the encoding of key, which follows prev in its
+// block, and which carries the lower 3 bits of extra:
+//
+//	varint(prefix) | varint(suffix length << 3 | extra) | suffix
+//
+// It returns whether key shares no prefix with prev, so that it can
+// be a restart.
+func AppendKey[K Key](dst []byte, prev, key K, extra uint8) ([]byte, bool) {
+	prefix := CommonPrefixSize(prev, key)
+	dst = AppendVarint(dst, uint64(prefix))
+	dst = AppendVarint(dst, uint64(len(key)-prefix)<<3|uint64(extra&0x7))
+	dst = append(dst, key[prefix:]...)
+	return dst, prefix == 0
+}
+
+// DecodeKey decodes a key written by AppendKey. It returns the size
+// of the prefix shared with the previous key, the suffix, the extra
+// bits and the size of the encoding, or -1 for the size if buf does
+// not start with a key.
+func DecodeKey(buf []byte) (prefix int, suffix []byte, extra uint8, n int) {
+	// Keys are no larger than their block, so neither are
+	// prefixes.
+	p, s := Varint(buf)
+	if s <= 0 || p > maxBlockSize {
+		return 0, nil, 0, -1
+	}
+	n = s
+	l, s := Varint(buf[n:])
+	if s <= 0 || l>>3 > uint64(len(buf)-n-s) {
+		return 0, nil, 0, -1
+	}
+	n += s
+	end := n + int(l>>3)
+	return int(p), buf[n:end:end], uint8(l & 0x7), end
+}
+
+// AppendRestarts appends the restart table of a block: the uint24
+// offsets of its restarts, followed by their uint16 count.
+func AppendRestarts(dst []byte, restarts []uint32) []byte {
+	for _, r := range restarts {
+		dst = append(dst, byte(r>>16), byte(r>>8), byte(r))
+	}
+	return binary.BigEndian.AppendUint16(dst, uint16(len(restarts)))
+}
+
+// SplitRestarts splits a block that ends in a restart table into its
+// entries and the offsets of the table, which Restart reads. It
+// returns false if the block is too short for its table.
+func SplitRestarts(block []byte) (entries, restarts []byte, ok bool) {
+	if len(block) < 2 {
+		return nil, nil, false
+	}
+	count := int(binary.BigEndian.Uint16(block[len(block)-2:]))
+	end := len(block) - 2 - 3*count
+	if end < 0 {
+		return nil, nil, false
+	}
+	return block[:end], block[end : len(block)-2], true
+}
+
+// Restart returns the i-th offset of a restart table.
+func Restart(restarts []byte, i int) uint32 {
+	return U24(restarts[3*i:])
+}
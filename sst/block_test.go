@@ -0,0 +1,93 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package sst
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestCommonPrefix(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"abc", "ab", 2},
+		{"", "abc", 0},
+		{"abc", "abd", 2},
+		{"abc", "pqr", 0},
+	} {
+		if got := CommonPrefixSize(c.a, c.b); got != c.want {
+			t.Fatalf("CommonPrefixSize(%q,%q): %d, want %d", c.a, c.b, got, c.want)
+		}
+		if got := CommonPrefixSize([]byte(c.a), []byte(c.b)); got != c.want {
+			t.Fatalf("CommonPrefixSize([]byte(%q),[]byte(%q)): %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestKeyRoundTrip(t *testing.T) {
+	keys := []string{"", "a", "abc", "abd", "b", "b/very/long/key/with/a/shared/prefix", "b/very/short"}
+	var buf []byte
+	var restarts []bool
+	prev := ""
+	for i, k := range keys {
+		var restart bool
+		buf, restart = AppendKey(buf, prev, k, uint8(i))
+		restarts = append(restarts, restart)
+		prev = k
+	}
+
+	var last []byte
+	for i, k := range keys {
+		prefix, suffix, extra, n := DecodeKey(buf)
+		if n <= 0 || prefix > len(last) {
+			t.Fatalf("%d: got prefix %d, size %d", i, prefix, n)
+		}
+		key := append(append([]byte{}, last[:prefix]...), suffix...)
+		if string(key) != k || extra != uint8(i)&0x7 || restarts[i] != (prefix == 0) {
+			t.Errorf("%d: got %q, extra %d, prefix %d, want %q", i, key, extra, prefix, k)
+		}
+		buf = buf[n:]
+		last = key
+	}
+	if len(buf) > 0 {
+		t.Errorf("%d bytes left", len(buf))
+	}
+
+	// The suffix must fit the buffer.
+	enc, _ := AppendKey(nil, "", "abc", 0)
+	if _, _, _, n := DecodeKey(enc[:len(enc)-1]); n != -1 {
+		t.Errorf("got size %d for a truncated key", n)
+	}
+}
+
+func TestRestarts(t *testing.T) {
+	entries := []byte("entries")
+	block := AppendRestarts(bytes.Clone(entries), []uint32{0, 3, 1 << 20})
+
+	got, restarts, ok := SplitRestarts(block)
+	if !ok || !bytes.Equal(got, entries) {
+		t.Fatalf("SplitRestarts: got %q, %v", got, ok)
+	}
+	var offs []uint32
+	for i := 0; i < len(restarts)/3; i++ {
+		offs = append(offs, Restart(restarts, i))
+	}
+	if want := []uint32{0, 3, 1 << 20}; !reflect.DeepEqual(offs, want) {
+		t.Errorf("got restarts %v, want %v", offs, want)
+	}
+
+	for _, bad := range [][]byte{nil, {0}, {0, 1}, {0, 0, 0, 0, 2}} {
+		if _, _, ok := SplitRestarts(bad); ok {
+			t.Errorf("SplitRestarts(%v) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+// Package sst implements sorted string tables: immutable files of
+// entries in ascending key order, where each entry has a byte key, 3
+// extra bits and a byte value. It is the container of the v2 reftable
+// format, as described in reftable-v2-proposal.md, and knows nothing
+// of git.
+//
+// Blocks are
+//
+//	uint8(compression) | uint24(size) | body
+//
+// where a zlib compressed body is preceded by its uint32 inflated
+// size. The body holds the entries, and the uint24 restart offsets
+// relative to the start of the body, followed by their uint16 count.
+// Entries are
+//
+//	varint(prefix) | varint(suffix length << 3 | extra) | suffix | varint(value length) | value
+//
+// where the key shares prefix bytes with the key before it, except
+// at restarts. The v1 reftable format encodes its keys and restarts
+// the same way, through AppendKey, DecodeKey, AppendRestarts and
+// SplitRestarts. All blocks are found through the index, whose entries
+// hold the last key of a block, and the varint offset of the block
+// as value. Their extra bits tell whether the block is another index
+// block. The top level of the index is a single block. The footer is
+//
+//	"SSTB" | uint8(1) | uint24(block size) | uint64(top index offset) | metadata |
+//	uint16(footer size) | "REFT" | uint32(CRC-32 of the footer)
+//
+// The metadata is up to the user of the table.
+package sst
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	sstMagic  = [4]byte{'S', 'S', 'T', 'B'}
+	reftMagic = [4]byte{'R', 'E', 'F', 'T'}
+)
+
+const (
+	version = 1
+
+	compressionNone = 0
+	compressionZlib = 1
+
+	// The extra bits of index entries.
+	childData  = 0
+	childIndex = 1
+
+	blockHeaderSize   = 4
+	footerHeaderSize  = 16
+	footerTrailerSize = 10
+
+	defaultBlockSize       = 4096
+	defaultRestartInterval = 16
+
+	// maxBlockSize is the largest size that fits the uint24 size
+	// fields. Inflated bodies are no larger than the block size
+	// they were written for, so they cannot exceed it either.
+	maxBlockSize = (1 << 24) - 1
+
+	// maxIndexDepth is far more index levels than any table has,
+	// and stops Seek on an index that refers to itself.
+	maxIndexDepth = 16
+)
+
+// ErrNotSST indicates that a file does not end in an SSTB footer.
+var ErrNotSST = errors.New("sst: not a sorted string table")
+
+// ErrKeyOrder indicates that entries were not added in ascending key
+// order.
+var ErrKeyOrder = errors.New("sst: keys must be ascending")
+
+// ErrTooLarge indicates that an entry does not fit in a block.
+var ErrTooLarge = errors.New("sst: entry too large for block size")
+
+// ErrEmpty indicates that a writer created a table without entries.
+var ErrEmpty = errors.New("sst: table is empty")
+
+// CorruptError is returned for tables that violate the format.
+type CorruptError struct {
+	Table string
+
+	// Offset of the offending block, or of the footer.
+	Offset uint64
+
+	Err error
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("sst: %s: corrupt table at 0x%x: %v", e.Table, e.Offset, e.Err)
+}
+
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
+var errFormat = errors.New("sst: format error")
+
+// Entry is a single entry of a table.
+type Entry struct {
+	Key   []byte
+	Extra uint8
+	Value []byte
+}
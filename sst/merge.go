@@ -0,0 +1,104 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package sst
+
+import (
+	"bytes"
+	"container/heap"
+)
+
+// Merge returns an iterator over the entries of its, in ascending key
+// order, or descending if reverse is set. The iterators must return
+// entries in that order. Of the entries with the same key, only the
+// one of the last iterator is returned, so tables later in a stack
+// shadow earlier ones.
+func Merge(reverse bool, its ...Iterator) Iterator {
+	return &mergedIterator{
+		its:     its,
+		heap:    mergeHeap{reverse: reverse},
+		pending: true,
+	}
+}
+
+type mergedIterator struct {
+	its  []Iterator
+	heap mergeHeap
+
+	// pending is set until the heap holds the first entry of each
+	// iterator.
+	pending bool
+}
+
+type mergeEntry struct {
+	e     Entry
+	index int
+}
+
+type mergeHeap struct {
+	reverse bool
+	entries []mergeEntry
+}
+
+func (h *mergeHeap) Len() int { return len(h.entries) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := &h.entries[i], &h.entries[j]
+	c := bytes.Compare(a.e.Key, b.e.Key)
+	if c == 0 {
+		return a.index > b.index
+	}
+	return (c < 0) != h.reverse
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+
+func (h *mergeHeap) Push(x any) { h.entries = append(h.entries, x.(mergeEntry)) }
+
+func (h *mergeHeap) Pop() any {
+	e := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return e
+}
+
+// advance pushes the next entry of iterator i, if there is one.
+func (m *mergedIterator) advance(i int) error {
+	e, ok, err := m.its[i].Next()
+	if err != nil || !ok {
+		return err
+	}
+	heap.Push(&m.heap, mergeEntry{e, i})
+	return nil
+}
+
+// Next implements the Iterator interface.
+func (m *mergedIterator) Next() (Entry, bool, error) {
+	if m.pending {
+		for i := range m.its {
+			if err := m.advance(i); err != nil {
+				return Entry{}, false, err
+			}
+		}
+		m.pending = false
+	}
+	if m.heap.Len() == 0 {
+		return Entry{}, false, nil
+	}
+
+	top := heap.Pop(&m.heap).(mergeEntry)
+	if err := m.advance(top.index); err != nil {
+		return Entry{}, false, err
+	}
+	for m.heap.Len() > 0 && bytes.Equal(m.heap.entries[0].e.Key, top.e.Key) {
+		shadowed := heap.Pop(&m.heap).(mergeEntry)
+		if err := m.advance(shadowed.index); err != nil {
+			return Entry{}, false, err
+		}
+	}
+	return top.e, true, nil
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package sst
+
+import (
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	tables := [][]Entry{{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("c"), Value: []byte("1")},
+		{Key: []byte("d"), Value: []byte("1")},
+	}, {
+		{Key: []byte("b"), Value: []byte("2")},
+		{Key: []byte("c"), Value: []byte("2")},
+	}, {
+		{Key: []byte("c"), Value: []byte("3")},
+		{Key: []byte("e"), Value: []byte("3")},
+	}}
+	want := "a1 b2 c3 d1 e3"
+	wantReverse := "e3 d1 c3 b2 a1"
+
+	var readers []*Reader
+	for _, entries := range tables {
+		_, table := writeTable(t, Config{}, BlockConfig{}, entries, nil)
+		r, err := NewReader(byteSource(table), "test")
+		if err != nil {
+			t.Fatalf("NewReader: %v", err)
+		}
+		readers = append(readers, r)
+	}
+
+	for _, reverse := range []bool{false, true} {
+		var its []Iterator
+		for _, r := range readers {
+			it, err := r.seek([]byte("z"), reverse)
+			if !reverse {
+				it, err = r.Seek(nil)
+			}
+			if err != nil {
+				t.Fatalf("seek: %v", err)
+			}
+			its = append(its, it)
+		}
+
+		entries, err := readAll(Merge(reverse, its...))
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		got := ""
+		for i, e := range entries {
+			if i > 0 {
+				got += " "
+			}
+			got += string(e.Key) + string(e.Value)
+		}
+
+		w := want
+		if reverse {
+			w = wantReverse
+		}
+		if got != w {
+			t.Errorf("reverse %v: got %q, want %q", reverse, got, w)
+		}
+	}
+
+	if entries, err := readAll(Merge(false)); err != nil || len(entries) != 0 {
+		t.Errorf("empty merge: got %v, %v", entries, err)
+	}
+}
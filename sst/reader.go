@@ -0,0 +1,499 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package sst
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"iter"
+	"sort"
+)
+
+// BlockSource is an interface for reading table bytes. The block
+// sources of the reftable package implement it.
+type BlockSource interface {
+	Size() uint64
+	ReadBlock(off uint64, size int) ([]byte, error)
+}
+
+// Reader reads a table. It is immutable, so it may be used from
+// several goroutines at once, provided its BlockSource supports
+// concurrent ReadBlock calls. Iterators must not be shared.
+type Reader struct {
+	src  BlockSource
+	name string
+
+	// size is where the footer starts.
+	size      uint64
+	blockSize uint32
+	indexOff  uint64
+	metadata  []byte
+}
+
+// NewReader creates a reader for the table in src. The name is used
+// in errors. If src does not end in an SSTB footer, it returns
+// ErrNotSST.
+func NewReader(src BlockSource, name string) (*Reader, error) {
+	fileSize := src.Size()
+	if fileSize < footerHeaderSize+footerTrailerSize {
+		return nil, ErrNotSST
+	}
+	trailer, err := src.ReadBlock(fileSize-footerTrailerSize, footerTrailerSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(trailer) != footerTrailerSize || [4]byte(trailer[2:6]) != reftMagic {
+		return nil, ErrNotSST
+	}
+
+	footerSize := uint64(binary.BigEndian.Uint16(trailer))
+	if footerSize < footerHeaderSize+footerTrailerSize || footerSize > fileSize {
+		return nil, ErrNotSST
+	}
+	footer, err := src.ReadBlock(fileSize-footerSize, int(footerSize))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(footer)) != footerSize || [4]byte(footer[:4]) != sstMagic {
+		return nil, ErrNotSST
+	}
+
+	r := &Reader{
+		src:  src,
+		name: name,
+		size: fileSize - footerSize,
+	}
+	if footer[4] != version {
+		return nil, fmt.Errorf("sst: unsupported version %d", footer[4])
+	}
+	if got, want := binary.BigEndian.Uint32(footer[footerSize-4:]), crc32.ChecksumIEEE(footer[:footerSize-4]); got != want {
+		return nil, r.corrupt(r.size, fmt.Errorf("got CRC %x, want CRC %x", got, want))
+	}
+	r.blockSize = U24(footer[5:])
+	r.indexOff = binary.BigEndian.Uint64(footer[8:])
+	r.metadata = footer[footerHeaderSize : footerSize-footerTrailerSize]
+	if r.indexOff >= r.size && r.indexOff != 0 {
+		return nil, r.corrupt(r.size, fmt.Errorf("index offset 0x%x beyond end", r.indexOff))
+	}
+	return r, nil
+}
+
+// Name returns the name passed to NewReader.
+func (r *Reader) Name() string {
+	return r.name
+}
+
+// Metadata returns the metadata stored in the footer.
+func (r *Reader) Metadata() []byte {
+	return r.metadata
+}
+
+// BlockSize returns the block size stored in the footer.
+func (r *Reader) BlockSize() uint32 {
+	return r.blockSize
+}
+
+// DataSize returns the size of the blocks, which is where the footer
+// starts.
+func (r *Reader) DataSize() uint64 {
+	return r.size
+}
+
+// Empty returns whether the table has no entries.
+func (r *Reader) Empty() bool {
+	return r.indexOff == 0
+}
+
+func (r *Reader) corrupt(off uint64, err error) error {
+	return &CorruptError{
+		Table:  r.name,
+		Offset: off,
+		Err:    err,
+	}
+}
+
+// block is a decoded block.
+type block struct {
+	off     uint64
+	entries []Entry
+}
+
+// search returns the index of the first entry with a key >= key.
+func (b *block) search(key []byte) int {
+	return sort.Search(len(b.entries), func(i int) bool {
+		return bytes.Compare(b.entries[i].Key, key) >= 0
+	})
+}
+
+// child returns the offset of the block an index entry points to,
+// and whether that is an index block.
+func (r *Reader) child(b *block, i int) (uint64, bool, error) {
+	e := &b.entries[i]
+	off, n := Varint(e.Value)
+	if n != len(e.Value) || off >= r.size || e.Extra > childIndex {
+		return 0, false, r.corrupt(b.off, fmt.Errorf("bad index entry for %q", e.Key))
+	}
+	return off, e.Extra == childIndex, nil
+}
+
+// Block returns the entries of the block at off. The offsets of data
+// blocks are in the Stats of the Writer, and in the BlockOffset of
+// iterators.
+func (r *Reader) Block(off uint64) ([]Entry, error) {
+	b, err := r.readBlock(off)
+	if err != nil {
+		return nil, err
+	}
+	return b.entries, nil
+}
+
+// readBlock reads and decodes the block at off.
+func (r *Reader) readBlock(off uint64) (*block, error) {
+	if off+blockHeaderSize > r.size {
+		return nil, r.corrupt(off, errors.New("block beyond end"))
+	}
+	guess := uint64(r.blockSize)
+	if guess < blockHeaderSize {
+		guess = defaultBlockSize
+	}
+	if off+guess > r.size {
+		guess = r.size - off
+	}
+	raw, err := r.src.ReadBlock(off, int(guess))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < blockHeaderSize {
+		return nil, r.corrupt(off, errors.New("block is truncated"))
+	}
+
+	size := uint64(U24(raw[1:]))
+	if size < blockHeaderSize || off+size > r.size {
+		return nil, r.corrupt(off, fmt.Errorf("bad block size %d", size))
+	}
+	if size > uint64(len(raw)) {
+		if raw, err = r.src.ReadBlock(off, int(size)); err != nil {
+			return nil, err
+		}
+		if uint64(len(raw)) < size {
+			return nil, r.corrupt(off, errors.New("block is truncated"))
+		}
+	}
+	raw = raw[:size]
+
+	var body []byte
+	switch raw[0] {
+	case compressionNone:
+		body = raw[blockHeaderSize:]
+	case compressionZlib:
+		if len(raw) < blockHeaderSize+4 {
+			return nil, r.corrupt(off, errors.New("block is truncated"))
+		}
+		sz := binary.BigEndian.Uint32(raw[blockHeaderSize:])
+		if sz > maxBlockSize {
+			return nil, r.corrupt(off, fmt.Errorf("inflated size %d exceeds the maximum block size", sz))
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(raw[blockHeaderSize+4:]))
+		if err != nil {
+			return nil, r.corrupt(off, err)
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, sz))
+		_, err = io.Copy(buf, io.LimitReader(zr, int64(sz)+1))
+		if err != nil {
+			return nil, r.corrupt(off, err)
+		}
+		if buf.Len() != int(sz) {
+			return nil, r.corrupt(off, fmt.Errorf("inflated to %d bytes, want %d", buf.Len(), sz))
+		}
+		body = buf.Bytes()
+	default:
+		return nil, r.corrupt(off, fmt.Errorf("unknown compression %d", raw[0]))
+	}
+
+	b, err := decodeBlock(body)
+	if err != nil {
+		return nil, r.corrupt(off, err)
+	}
+	b.off = off
+	return b, nil
+}
+
+// decodeBlock decodes the entries of a block body.
+func decodeBlock(body []byte) (*block, error) {
+	buf, _, ok := SplitRestarts(body)
+	if !ok {
+		return nil, errFormat
+	}
+
+	b := &block{}
+	var last []byte
+	for len(buf) > 0 {
+		prefix, suffix, extra, n := DecodeKey(buf)
+		if n <= 0 || prefix > len(last) {
+			return nil, errFormat
+		}
+		buf = buf[n:]
+
+		key := make([]byte, 0, prefix+len(suffix))
+		key = append(key, last[:prefix]...)
+		key = append(key, suffix...)
+
+		sz, n := Varint(buf)
+		if n <= 0 || sz > uint64(len(buf)-n) {
+			return nil, errFormat
+		}
+		buf = buf[n:]
+		b.entries = append(b.entries, Entry{key, extra, buf[:sz:sz]})
+		buf = buf[sz:]
+		last = key
+	}
+	return b, nil
+}
+
+// Iterator returns entries one at a time.
+type Iterator interface {
+	// Next returns the next entry, or false at the end.
+	Next() (Entry, bool, error)
+}
+
+// TableIterator walks the entries of a table in either direction. It
+// keeps the path of blocks from the top of the index to the current
+// data block.
+type TableIterator struct {
+	r       *Reader
+	reverse bool
+	path    []cursor
+	done    bool
+}
+
+// cursor is a position within a block. In index blocks, it is the
+// entry for the block on the next level of the path.
+type cursor struct {
+	b *block
+	i int
+}
+
+func (it *TableIterator) step() int {
+	if it.reverse {
+		return -1
+	}
+	return 1
+}
+
+// Seek returns an iterator in ascending key order, starting at the
+// first entry with a key >= key.
+func (r *Reader) Seek(key []byte) (*TableIterator, error) {
+	return r.seek(key, false)
+}
+
+// SeekReverse returns an iterator in descending key order, starting
+// at the last entry with a key <= key.
+func (r *Reader) SeekReverse(key []byte) (*TableIterator, error) {
+	return r.seek(key, true)
+}
+
+// Entries returns the entries with a key >= start, for use in range
+// loops. Iteration ends after the first error.
+func (r *Reader) Entries(start []byte) iter.Seq2[Entry, error] {
+	return func(yield func(Entry, error) bool) {
+		it, err := r.Seek(start)
+		if err != nil {
+			yield(Entry{}, err)
+			return
+		}
+		for {
+			e, ok, err := it.Next()
+			if err != nil {
+				yield(Entry{}, err)
+				return
+			}
+			if !ok || !yield(e, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (r *Reader) seek(key []byte, reverse bool) (*TableIterator, error) {
+	it := &TableIterator{r: r, reverse: reverse}
+	if r.indexOff == 0 {
+		it.done = true
+		return it, nil
+	}
+
+	off, isIndex := r.indexOff, true
+	for depth := 0; ; depth++ {
+		if depth >= maxIndexDepth {
+			return nil, r.corrupt(off, errors.New("index is too deep"))
+		}
+		b, err := r.readBlock(off)
+		if err != nil {
+			return nil, err
+		}
+
+		i := b.search(key)
+		if !isIndex {
+			if reverse && (i == len(b.entries) || !bytes.Equal(b.entries[i].Key, key)) {
+				i--
+			}
+			it.path = append(it.path, cursor{b, i})
+			return it, nil
+		}
+
+		if len(b.entries) == 0 {
+			return nil, r.corrupt(off, errors.New("empty index block"))
+		}
+		if i == len(b.entries) {
+			if !reverse {
+				it.done = true
+				return it, nil
+			}
+			i--
+		}
+		it.path = append(it.path, cursor{b, i})
+		if off, isIndex, err = r.child(b, i); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Next implements the Iterator interface.
+func (it *TableIterator) Next() (Entry, bool, error) {
+	for !it.done {
+		leaf := &it.path[len(it.path)-1]
+		if leaf.i >= 0 && leaf.i < len(leaf.b.entries) {
+			e := leaf.b.entries[leaf.i]
+			leaf.i += it.step()
+			return e, true, nil
+		}
+		if err := it.nextBlock(); err != nil {
+			return Entry{}, false, err
+		}
+	}
+	return Entry{}, false, nil
+}
+
+// BlockOffset returns the offset of the data block of the entry last
+// returned.
+func (it *TableIterator) BlockOffset() uint64 {
+	if len(it.path) == 0 {
+		return 0
+	}
+	return it.path[len(it.path)-1].b.off
+}
+
+// nextBlock moves to the adjacent data block.
+func (it *TableIterator) nextBlock() error {
+	lvl := len(it.path) - 2
+	for ; lvl >= 0; lvl-- {
+		c := &it.path[lvl]
+		c.i += it.step()
+		if c.i >= 0 && c.i < len(c.b.entries) {
+			break
+		}
+	}
+	if lvl < 0 {
+		it.done = true
+		return nil
+	}
+
+	it.path = it.path[:lvl+1]
+	for {
+		if len(it.path) > maxIndexDepth {
+			return it.r.corrupt(it.path[0].b.off, errors.New("index is too deep"))
+		}
+		c := it.path[len(it.path)-1]
+		off, isIndex, err := it.r.child(c.b, c.i)
+		if err != nil {
+			return err
+		}
+		b, err := it.r.readBlock(off)
+		if err != nil {
+			return err
+		}
+		if isIndex && len(b.entries) == 0 {
+			return it.r.corrupt(off, errors.New("empty index block"))
+		}
+
+		i := 0
+		if it.reverse {
+			i = len(b.entries) - 1
+		}
+		it.path = append(it.path, cursor{b, i})
+		if !isIndex {
+			return nil
+		}
+	}
+}
+
+// Verify walks all blocks through the index, and checks their
+// encoding, the key order, and the last keys recorded in the index.
+// If check is set, it is called for every entry, and its errors are
+// reported for the block of the entry. Verify returns all problems
+// found, or nil if the table is sound.
+func (r *Reader) Verify(check func(blockOff uint64, e Entry) error) []error {
+	if r.indexOff == 0 {
+		return nil
+	}
+
+	var errs []error
+	errorf := func(off uint64, format string, args ...interface{}) {
+		errs = append(errs, r.corrupt(off, fmt.Errorf(format, args...)))
+	}
+
+	var prevKey []byte
+	var walk func(off uint64, isIndex bool, depth int) ([]byte, bool)
+	walk = func(off uint64, isIndex bool, depth int) ([]byte, bool) {
+		if depth > maxIndexDepth {
+			errorf(off, "index is deeper than %d levels", maxIndexDepth)
+			return nil, false
+		}
+		b, err := r.readBlock(off)
+		if err != nil {
+			errs = append(errs, err)
+			return nil, false
+		}
+		if len(b.entries) == 0 {
+			errorf(off, "block is empty")
+			return nil, false
+		}
+
+		for i, e := range b.entries {
+			if isIndex {
+				childOff, childIsIndex, err := r.child(b, i)
+				if err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				if last, ok := walk(childOff, childIsIndex, depth+1); ok && !bytes.Equal(last, e.Key) {
+					errorf(off, "index has last key %q for block at 0x%x, which ends at %q", e.Key, childOff, last)
+				}
+				continue
+			}
+
+			if prevKey != nil && bytes.Compare(e.Key, prevKey) <= 0 {
+				errorf(off, "key %q follows %q", e.Key, prevKey)
+			}
+			prevKey = e.Key
+			if check != nil {
+				if err := check(off, e); err != nil {
+					errs = append(errs, r.corrupt(off, err))
+				}
+			}
+		}
+		return b.entries[len(b.entries)-1].Key, true
+	}
+	walk(r.indexOff, true, 0)
+	return errs
+}
@@ -0,0 +1,287 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+type byteSource []byte
+
+func (s byteSource) Size() uint64 {
+	return uint64(len(s))
+}
+
+func (s byteSource) ReadBlock(off uint64, sz int) ([]byte, error) {
+	return s[off : off+uint64(sz)], nil
+}
+
+func testEntries(n int) []Entry {
+	var entries []Entry
+	for i := 0; i < n; i++ {
+		entries = append(entries, Entry{
+			Key:   []byte(fmt.Sprintf("key/%05d", 2*i)),
+			Extra: uint8(i % 8),
+			Value: bytes.Repeat([]byte{byte(i)}, i%20),
+		})
+	}
+	return entries
+}
+
+func writeTable(t *testing.T, cfg Config, block BlockConfig, entries []Entry, metadata []byte) (*Writer, []byte) {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, &cfg)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if err := w.SetBlockConfig(block); err != nil {
+		t.Fatalf("SetBlockConfig: %v", err)
+	}
+	for _, e := range entries {
+		if err := w.Add(e.Key, e.Extra, e.Value); err != nil {
+			t.Fatalf("Add(%q): %v", e.Key, err)
+		}
+	}
+	if err := w.Close(metadata); err != nil && !(len(entries) == 0 && errors.Is(err, ErrEmpty)) {
+		t.Fatalf("Close: %v", err)
+	}
+	return w, buf.Bytes()
+}
+
+func readAll(it Iterator) ([]Entry, error) {
+	var entries []Entry
+	for {
+		e, ok, err := it.Next()
+		if err != nil || !ok {
+			return entries, err
+		}
+		entries = append(entries, e)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	entries := testEntries(1000)
+	for _, tc := range []struct {
+		cfg   Config
+		block BlockConfig
+	}{
+		{Config{}, BlockConfig{}},
+		{Config{BlockSize: 256}, BlockConfig{}},
+		{Config{BlockSize: 256, Unaligned: true}, BlockConfig{RestartInterval: 3}},
+		{Config{BlockSize: 256}, BlockConfig{Compress: true, Size: 1024}},
+		{Config{BlockSize: 128, Index: BlockConfig{Size: 64}}, BlockConfig{Size: 100}},
+	} {
+		meta := []byte("metadata")
+		w, table := writeTable(t, tc.cfg, tc.block, entries, meta)
+		if tc.block.Size == 0 && !tc.cfg.Unaligned && tc.cfg.BlockSize > 0 && w.Stats().Blocks > 1 {
+			// The blocks are padded, except for the last one.
+			if idx := w.Stats().Offset; idx%uint64(tc.cfg.BlockSize) != 0 {
+				t.Errorf("%+v: index at 0x%x is not aligned", tc, idx)
+			}
+		}
+
+		r, err := NewReader(byteSource(table), "test")
+		if err != nil {
+			t.Fatalf("%+v: NewReader: %v", tc, err)
+		}
+		if !bytes.Equal(r.Metadata(), meta) {
+			t.Errorf("%+v: got metadata %q", tc, r.Metadata())
+		}
+		if errs := r.Verify(nil); len(errs) > 0 {
+			t.Fatalf("%+v: Verify: %v", tc, errs)
+		}
+
+		it, err := r.Seek(nil)
+		if err != nil {
+			t.Fatalf("Seek: %v", err)
+		}
+		got, err := readAll(it)
+		if err != nil || !reflect.DeepEqual(got, entries) {
+			t.Fatalf("%+v: got %d entries, %v, want %d", tc, len(got), err, len(entries))
+		}
+
+		for i := 0; i < len(entries); i += 37 {
+			// Keys between entries.
+			key := append(append([]byte{}, entries[i].Key...), 'x')
+			it, err := r.Seek(key)
+			if err != nil {
+				t.Fatalf("Seek: %v", err)
+			}
+			got, err := readAll(it)
+			if err != nil || len(got) != len(entries)-i-1 || (len(got) > 0 && !reflect.DeepEqual(got, entries[i+1:])) {
+				t.Fatalf("%+v: Seek(%q): got %d entries, %v", tc, key, len(got), err)
+			}
+
+			rit, err := r.SeekReverse(key)
+			if err != nil {
+				t.Fatalf("SeekReverse: %v", err)
+			}
+			got, err = readAll(rit)
+			if err != nil || len(got) != i+1 || !reflect.DeepEqual(got[0], entries[i]) || !reflect.DeepEqual(got[i], entries[0]) {
+				t.Fatalf("%+v: SeekReverse(%q): got %d entries, %v", tc, key, len(got), err)
+			}
+
+			rit, err = r.SeekReverse(entries[i].Key)
+			if err != nil {
+				t.Fatalf("SeekReverse: %v", err)
+			}
+			if e, ok, err := rit.Next(); err != nil || !ok || !reflect.DeepEqual(e, entries[i]) {
+				t.Fatalf("%+v: SeekReverse(%q): %v, %v", tc, entries[i].Key, e, err)
+			}
+			block, err := r.Block(rit.BlockOffset())
+			if err != nil {
+				t.Fatalf("Block: %v", err)
+			}
+			found := false
+			for _, e := range block {
+				found = found || bytes.Equal(e.Key, entries[i].Key)
+			}
+			if !found {
+				t.Errorf("%+v: block at 0x%x lacks %q", tc, rit.BlockOffset(), entries[i].Key)
+			}
+		}
+
+		n := 0
+		for e, err := range r.Entries([]byte("key/01")) {
+			if err != nil {
+				t.Fatalf("Entries: %v", err)
+			}
+			if !bytes.HasPrefix(e.Key, []byte("key/01")) {
+				break
+			}
+			n++
+		}
+		if n != 500 {
+			t.Errorf("%+v: got %d entries with prefix, want 500", tc, n)
+		}
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	_, table := writeTable(t, Config{}, BlockConfig{}, nil, nil)
+	r, err := NewReader(byteSource(table), "test")
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	if !r.Empty() {
+		t.Errorf("table is not empty")
+	}
+	for _, reverse := range []bool{false, true} {
+		it, err := r.seek([]byte("key"), reverse)
+		if err != nil {
+			t.Fatalf("seek: %v", err)
+		}
+		if got, err := readAll(it); err != nil || len(got) != 0 {
+			t.Errorf("got %v, %v", got, err)
+		}
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	w, err := NewWriter(&bytes.Buffer{}, &Config{BlockSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add([]byte("b"), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := w.Add([]byte(key), 0, nil); !errors.Is(err, ErrKeyOrder) {
+			t.Errorf("Add(%q): got %v, want ErrKeyOrder", key, err)
+		}
+	}
+	if err := w.Add([]byte("c"), 0, make([]byte, 100)); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Add: got %v, want ErrTooLarge", err)
+	}
+	if err := w.Add([]byte("c"), 0, nil); err != nil {
+		t.Errorf("Add after error: %v", err)
+	}
+
+	for _, cfg := range []Config{
+		{BlockSize: 1 << 24},
+		{Index: BlockConfig{Size: 2}},
+		{Index: BlockConfig{Level: 10}},
+	} {
+		if _, err := NewWriter(&bytes.Buffer{}, &cfg); err == nil {
+			t.Errorf("%+v: got success, want error", cfg)
+		}
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	if _, err := NewReader(byteSource("REFT not a table at all, REFT"), "test"); !errors.Is(err, ErrNotSST) {
+		t.Errorf("got %v, want ErrNotSST", err)
+	}
+
+	_, table := writeTable(t, Config{BlockSize: 256}, BlockConfig{}, testEntries(100), nil)
+
+	corrupt := append([]byte{}, table...)
+	corrupt[len(corrupt)-12] ^= 0x01
+	var cerr *CorruptError
+	if _, err := NewReader(byteSource(corrupt), "test"); !errors.As(err, &cerr) {
+		t.Errorf("footer: got %v, want CorruptError", err)
+	}
+
+	corrupt = append([]byte{}, table...)
+	corrupt[0] = 7
+	r, err := NewReader(byteSource(corrupt), "test")
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	it, err := r.Seek(nil)
+	if err == nil {
+		_, err = readAll(it)
+	}
+	if !errors.As(err, &cerr) || cerr.Offset != 0 {
+		t.Errorf("block: got %v, want CorruptError at 0", err)
+	}
+	if errs := r.Verify(nil); len(errs) != 1 {
+		t.Errorf("Verify: got %v, want 1 error", errs)
+	}
+
+	_, ztable := writeTable(t, Config{BlockSize: 256}, BlockConfig{Compress: true, Size: 1024}, testEntries(100), nil)
+	corrupt = append([]byte{}, ztable...)
+	copy(corrupt[blockHeaderSize:], []byte{0xff, 0xff, 0xff, 0xff})
+	r, err = NewReader(byteSource(corrupt), "test")
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	it, err = r.Seek(nil)
+	if err == nil {
+		_, err = readAll(it)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > maxBlockSize {
+		t.Errorf("inflated size: allocated %d bytes", n)
+	}
+	if !errors.As(err, &cerr) || cerr.Offset != 0 {
+		t.Errorf("inflated size: got %v, want CorruptError at 0", err)
+	}
+
+	r, err = NewReader(byteSource(table), "test")
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	errs := r.Verify(func(off uint64, e Entry) error {
+		if bytes.Equal(e.Key, []byte("key/00010")) {
+			return errors.New("bad entry")
+		}
+		return nil
+	})
+	if len(errs) != 1 || !errors.As(errs[0], &cerr) || cerr.Offset != 0 {
+		t.Errorf("Verify: got %v, want 1 error at 0", errs)
+	}
+}
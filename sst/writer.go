@@ -0,0 +1,346 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package sst
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Config defines the options of a Writer.
+type Config struct {
+	// The block size recorded in the footer, if not set 4096.
+	// Uncompressed blocks of that size are padded to it.
+	BlockSize uint32
+
+	// If set, do not pad blocks to the block size.
+	Unaligned bool
+
+	// The configuration of the index blocks. Unset fields default
+	// as in SetBlockConfig.
+	Index BlockConfig
+}
+
+// BlockConfig configures the blocks of a stretch of keys.
+type BlockConfig struct {
+	// The maximum size of a block, including its header, if not
+	// set the block size of the table. For compressed blocks, this
+	// is the inflated size.
+	Size uint32
+
+	// Every RestartInterval entries, the key is written in full,
+	// for binary search within the block. If not set 16.
+	RestartInterval int
+
+	// If set, blocks are compressed with zlib at Level, or at the
+	// default level if Level is 0.
+	Compress bool
+	Level    int
+}
+
+// BlockStats provides write statistics of a stretch of blocks.
+type BlockStats struct {
+	Blocks   int
+	Entries  int
+	Restarts int
+
+	// Offset of the first block.
+	Offset uint64
+}
+
+// Writer writes a single table.
+type Writer struct {
+	out io.Writer
+	cfg Config
+
+	// next is the offset after the last block written, and
+	// padding is the padding owed to that block. It is only
+	// written if the next block is padded as well.
+	next    uint64
+	padding int
+
+	block    BlockConfig
+	buf      []byte
+	restarts []uint32
+	entries  int
+	blockKey []byte
+
+	stats BlockStats
+
+	count   int
+	lastKey []byte
+
+	// index holds the blocks of the level being written.
+	index []indexEntry
+
+	closed bool
+}
+
+type indexEntry struct {
+	lastKey []byte
+	off     uint64
+}
+
+// NewWriter creates a writer.
+func NewWriter(out io.Writer, cfg *Config) (*Writer, error) {
+	w := &Writer{
+		out: out,
+		cfg: *cfg,
+	}
+	if w.cfg.BlockSize == 0 {
+		w.cfg.BlockSize = defaultBlockSize
+	}
+	if w.cfg.BlockSize > maxBlockSize {
+		return nil, fmt.Errorf("sst: invalid block size %d", w.cfg.BlockSize)
+	}
+	if err := w.setDefaults(&w.cfg.Index); err != nil {
+		return nil, err
+	}
+	if err := w.SetBlockConfig(BlockConfig{}); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) setDefaults(cfg *BlockConfig) error {
+	if cfg.Size == 0 {
+		cfg.Size = w.cfg.BlockSize
+	}
+	if cfg.RestartInterval == 0 {
+		cfg.RestartInterval = defaultRestartInterval
+	}
+	if cfg.Level == 0 {
+		cfg.Level = zlib.DefaultCompression
+	}
+	if cfg.Size > maxBlockSize || cfg.Size < blockHeaderSize+2 {
+		return fmt.Errorf("sst: invalid block size %d", cfg.Size)
+	}
+	if cfg.Level < zlib.HuffmanOnly || cfg.Level > zlib.BestCompression {
+		return fmt.Errorf("sst: invalid zlib level %d", cfg.Level)
+	}
+	return nil
+}
+
+// SetBlockConfig ends the current block, and configures the blocks
+// for the entries added next. It resets the statistics.
+func (w *Writer) SetBlockConfig(cfg BlockConfig) error {
+	if err := w.setDefaults(&cfg); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	w.block = cfg
+	w.stats = BlockStats{}
+	return nil
+}
+
+// Stats returns the statistics of the blocks written since the last
+// SetBlockConfig. After Close, it returns those of the index.
+func (w *Writer) Stats() BlockStats {
+	return w.stats
+}
+
+// Offset returns the offset of the block that the next entry goes
+// to, unless that block is full.
+func (w *Writer) Offset() uint64 {
+	if w.padded() {
+		return w.next + uint64(w.padding)
+	}
+	return w.next
+}
+
+// padded returns whether blocks of the current configuration are
+// padded, and thus are preceded by the padding of the last block.
+func (w *Writer) padded() bool {
+	return !w.cfg.Unaligned && !w.block.Compress && w.block.Size == w.cfg.BlockSize
+}
+
+// Add adds an entry. Keys must be added in ascending order. Only the
+// lower 3 bits of extra are stored.
+func (w *Writer) Add(key []byte, extra uint8, val []byte) error {
+	if w.count > 0 && bytes.Compare(key, w.lastKey) <= 0 {
+		return fmt.Errorf("%w: got %q last %q", ErrKeyOrder, key, w.lastKey)
+	}
+	if err := w.add(key, extra, val); err != nil {
+		return err
+	}
+	w.count++
+	w.lastKey = append(w.lastKey[:0], key...)
+	return nil
+}
+
+// add adds an entry to the current block, starting a new one if it
+// does not fit.
+func (w *Writer) add(key []byte, extra uint8, val []byte) error {
+	if w.tryAdd(key, extra, val) {
+		return nil
+	}
+	if w.entries == 0 {
+		return fmt.Errorf("%w: key %q", ErrTooLarge, key)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if !w.tryAdd(key, extra, val) {
+		return fmt.Errorf("%w: key %q", ErrTooLarge, key)
+	}
+	return nil
+}
+
+func (w *Writer) tryAdd(key []byte, extra uint8, val []byte) bool {
+	prev := w.blockKey
+	if w.entries%w.block.RestartInterval == 0 {
+		prev = nil
+	}
+	start := len(w.buf)
+	var restart bool
+	w.buf, restart = AppendKey(w.buf, prev, key, extra)
+	restart = restart && len(w.restarts) < MaxRestarts
+	w.buf = AppendVarint(w.buf, uint64(len(val)))
+	w.buf = append(w.buf, val...)
+
+	rlen := len(w.restarts)
+	if restart {
+		rlen++
+	}
+	if blockHeaderSize+len(w.buf)+3*rlen+2 > int(w.block.Size) {
+		w.buf = w.buf[:start]
+		return false
+	}
+	if restart {
+		w.restarts = append(w.restarts, uint32(start))
+	}
+	w.entries++
+	w.blockKey = append(w.blockKey[:0], key...)
+	return true
+}
+
+// Flush writes the current block, if it has entries. The next entry
+// starts a new block.
+func (w *Writer) Flush() error {
+	if w.entries == 0 {
+		return nil
+	}
+
+	body := AppendRestarts(w.buf, w.restarts)
+
+	raw := make([]byte, blockHeaderSize, blockHeaderSize+len(body))
+	if w.block.Compress {
+		raw[0] = compressionZlib
+		raw = binary.BigEndian.AppendUint32(raw, uint32(len(body)))
+		buf := bytes.NewBuffer(raw)
+		zw, _ := zlib.NewWriterLevel(buf, w.block.Level)
+		if _, err := zw.Write(body); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		raw = buf.Bytes()
+	} else {
+		raw[0] = compressionNone
+		raw = append(raw, body...)
+	}
+	if len(raw) > maxBlockSize {
+		return fmt.Errorf("%w: block of %d bytes", ErrTooLarge, len(raw))
+	}
+	PutU24(raw[1:], uint32(len(raw)))
+
+	off := w.Offset()
+	if w.padded() && w.padding > 0 {
+		if _, err := w.out.Write(make([]byte, w.padding)); err != nil {
+			return err
+		}
+	}
+	if _, err := w.out.Write(raw); err != nil {
+		return err
+	}
+	w.padding = 0
+	if w.padded() {
+		w.padding = int(w.cfg.BlockSize) - len(raw)
+	}
+
+	if w.stats.Blocks == 0 {
+		w.stats.Offset = off
+	}
+	w.stats.Blocks++
+	w.stats.Entries += w.entries
+	w.stats.Restarts += len(w.restarts)
+
+	w.index = append(w.index, indexEntry{append([]byte(nil), w.blockKey...), off})
+	w.next = off + uint64(len(raw))
+
+	w.buf = w.buf[:0]
+	w.restarts = w.restarts[:0]
+	w.entries = 0
+	w.blockKey = w.blockKey[:0]
+	return nil
+}
+
+// Close writes the index and the footer, which holds the given
+// metadata. For a table without entries, it returns ErrEmpty.
+func (w *Writer) Close(metadata []byte) error {
+	if w.closed {
+		return fmt.Errorf("sst: writer is closed")
+	}
+	w.closed = true
+
+	if err := w.SetBlockConfig(w.cfg.Index); err != nil {
+		return err
+	}
+
+	var top uint64
+	child := uint8(childData)
+	for len(w.index) > 0 {
+		level := w.index
+		w.index = nil
+		for _, e := range level {
+			if err := w.add(e.lastKey, child, AppendVarint(nil, e.off)); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if len(w.index) == 1 {
+			top = w.index[0].off
+			break
+		}
+		if len(w.index) >= len(level) {
+			return fmt.Errorf("%w: index blocks hold a single key", ErrTooLarge)
+		}
+		child = childIndex
+	}
+
+	footerSize := footerHeaderSize + len(metadata) + footerTrailerSize
+	if footerSize >= 1<<16 {
+		return fmt.Errorf("sst: metadata of %d bytes is too large", len(metadata))
+	}
+	footer := append([]byte{}, sstMagic[:]...)
+	footer = append(footer, version, 0, 0, 0)
+	PutU24(footer[5:], w.cfg.BlockSize)
+	footer = binary.BigEndian.AppendUint64(footer, top)
+	footer = append(footer, metadata...)
+	footer = binary.BigEndian.AppendUint16(footer, uint16(footerSize))
+	footer = append(footer, reftMagic[:]...)
+	footer = binary.BigEndian.AppendUint32(footer, crc32.ChecksumIEEE(footer))
+	if _, err := w.out.Write(footer); err != nil {
+		return err
+	}
+
+	if top == 0 {
+		return ErrEmpty
+	}
+	return nil
+}
@@ -10,15 +10,16 @@ package reftable
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -34,16 +35,32 @@ type CompactionStats struct {
 }
 
 // Stack is an auto-compacting stack of reftables.
+//
+// A Stack may be used from several goroutines. Reads through Merged
+// or Acquire may run concurrently with each other and with Add,
+// NewAddition, AutoCompact and CompactAll. Writes within one process
+// are serialized like writes from different processes: while one
+// runs, Add, NewAddition and CompactAll fail with ErrLockFailure, and
+// AutoCompact does nothing.
 type Stack struct {
 	listFile    string
 	reftableDir string
 	cfg         Config
 
-	// mutable
-	stack              []*Reader
-	merged             *Merged
+	// writeLock holds a token while a write runs. It is the
+	// in-process counterpart of tables.list.lock.
+	writeLock chan struct{}
+
+	// mu protects stack and merged. They are only changed with
+	// writeLock held, so writers may read them without mu.
+	mu     sync.RWMutex
+	stack  []*Reader
+	merged *Merged
+
 	disableAutoCompact bool
 
+	// Stats is updated by writes. It must not be read while a
+	// write runs.
 	Stats CompactionStats
 }
 
@@ -56,13 +73,14 @@ func NewStack(dir string, cfg Config) (*Stack, error) {
 	switch cfg.HashID {
 	case SHA1ID, SHA256ID:
 	default:
-		return nil, fmt.Errorf("reftable: unknown hash ID %q", cfg.HashID)
+		return nil, fmt.Errorf("%w: unknown hash ID %q", ErrHashSize, cfg.HashID)
 	}
 
 	st := &Stack{
 		listFile:    listFile,
 		reftableDir: dir,
 		cfg:         cfg,
+		writeLock:   make(chan struct{}, 1),
 	}
 
 	if err := st.reload(true); err != nil {
@@ -73,6 +91,8 @@ func NewStack(dir string, cfg Config) (*Stack, error) {
 }
 
 func (st *Stack) String() string {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
 	var nms []string
 	for _, r := range st.stack {
 		nms = append(nms, r.Name())
@@ -100,18 +120,79 @@ func (st *Stack) readNames() ([]string, error) {
 	return res, nil
 }
 
-// Returns the merged stack. The stack is only valid until the next
-// write, as writes may trigger reloads
+// Returns the merged stack. It is only valid until the next write,
+// as writes may reload the stack and close the tables it replaces.
+// Use Acquire to read across writes.
 func (st *Stack) Merged() *Merged {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
 	return st.merged
 }
 
-// Close releases file descriptors associated with this stack.
+// Acquire returns the merged stack, and keeps its tables open until
+// release is called, even if writes replace them in the meantime.
+func (st *Stack) Acquire() (m *Merged, release func()) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	tabs := st.stack
+	for _, r := range tabs {
+		r.acquire()
+	}
+
+	var once sync.Once
+	return st.merged, func() {
+		once.Do(func() {
+			for _, r := range tabs {
+				r.Close()
+			}
+		})
+	}
+}
+
+// Close releases file descriptors associated with this stack. Tables
+// held through Acquire are closed when they are released.
 func (st *Stack) Close() {
-	for _, r := range st.stack {
+	st.mu.Lock()
+	tabs := st.stack
+	st.stack, st.merged = nil, nil
+	st.mu.Unlock()
+	for _, r := range tabs {
 		r.Close()
 	}
-	st.stack = nil
+}
+
+// tryLockWrite takes the in-process write lock, returning false if
+// another write holds it.
+func (st *Stack) tryLockWrite() bool {
+	select {
+	case st.writeLock <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (st *Stack) unlockWrite() {
+	<-st.writeLock
+}
+
+// openBlockSource opens a table file, honoring Config.Mmap and
+// Config.BlockCache.
+func (st *Stack) openBlockSource(name string) (BlockSource, error) {
+	var bs BlockSource
+	var err error
+	if st.cfg.Mmap {
+		bs, err = NewMmapBlockSource(name)
+	} else {
+		bs, err = NewFileBlockSource(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if st.cfg.BlockCache != nil {
+		bs = NewCachedBlockSource(bs, st.cfg.BlockCache, filepath.Base(name))
+	}
+	return bs, nil
 }
 
 func (st *Stack) reloadOnce(names []string, reuseOpen bool) error {
@@ -131,25 +212,42 @@ func (st *Stack) reloadOnce(names []string, reuseOpen bool) error {
 	for _, name := range names {
 		rd := cur[name]
 		if reuseOpen && rd != nil {
-			delete(cur, name)
+			rd.acquire()
 		} else {
-			bs, err := NewFileBlockSource(filepath.Join(st.reftableDir, name))
+			bs, err := st.openBlockSource(filepath.Join(st.reftableDir, name))
 			if err != nil {
 				return err
 			}
 
-			rd, err = NewReader(bs, name)
+			rd, err = NewReaderConfig(bs, name, &st.cfg)
 			if err != nil {
-				return fmt.Errorf("NewReader(%s): %v", name, err)
+				bs.Close()
+				return fmt.Errorf("NewReader(%s): %w", name, err)
 			}
 		}
 		newTables = append(newTables, rd)
 	}
 
-	// success. Swap.
-	st.stack = newTables
-	for _, v := range cur {
-		v.Close()
+	var tabs []Table
+	for _, r := range newTables {
+		tabs = append(tabs, r)
+	}
+
+	m, err := NewMerged(tabs, st.cfg.HashID)
+	if err != nil {
+		return err
+	}
+	m.suppressDeletions = true
+
+	// success. Swap, and drop the references of the old stack. The
+	// tables that were replaced are closed, unless Acquire holds
+	// them.
+	st.mu.Lock()
+	old := st.stack
+	st.stack, st.merged = newTables, m
+	st.mu.Unlock()
+	for _, r := range old {
+		r.Close()
 	}
 	newTables = nil
 	return nil
@@ -182,18 +280,6 @@ func (st *Stack) reload(reuseOpen bool) error {
 		// compaction changed name
 		delay = time.Millisecond*time.Duration(1+rand.Intn(1)) + 2*delay
 	}
-
-	var tabs []Table
-	for _, r := range st.stack {
-		tabs = append(tabs, r)
-	}
-
-	m, err := NewMerged(tabs, st.cfg.HashID)
-	if err != nil {
-		return err
-	}
-	m.suppressDeletions = true
-	st.merged = m
 	return nil
 }
 
@@ -207,6 +293,8 @@ func (st *Stack) UpToDate() (bool, error) {
 		return false, err
 	}
 
+	st.mu.RLock()
+	defer st.mu.RUnlock()
 	if len(names) != len(st.stack) {
 		return false, nil
 	}
@@ -221,20 +309,31 @@ func (st *Stack) UpToDate() (bool, error) {
 
 // Add a new reftable to stack, transactionally.
 func (st *Stack) Add(write func(w *Writer) error) error {
-	if err := st.add(write); err != nil {
-		if err == ErrLockFailure {
+	return st.AddContext(context.Background(), write)
+}
+
+// AddContext is like Add, but gives up with ctx.Err() once ctx is
+// done. If ctx is done after the table was committed, only the
+// following compaction is aborted.
+func (st *Stack) AddContext(ctx context.Context, write func(w *Writer) error) error {
+	if err := st.add(ctx, write); err != nil {
+		if err == ErrLockFailure && st.tryLockWrite() {
 			st.reload(true)
+			st.unlockWrite()
 		}
 		return err
 	}
 
 	if !st.disableAutoCompact {
-		return st.AutoCompact()
+		return st.AutoCompactContext(ctx)
 	}
 	return nil
 }
 
-func (st *Stack) add(write func(w *Writer) error) error {
+func (st *Stack) add(ctx context.Context, write func(w *Writer) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	tr, err := st.NewAddition()
 	if err != nil {
 		return err
@@ -243,6 +342,9 @@ func (st *Stack) add(write func(w *Writer) error) error {
 	if err := tr.Add(write); err != nil {
 		return err
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	return tr.Commit()
 }
@@ -253,24 +355,32 @@ type Addition struct {
 	lockFileName    string
 	lockFile        *os.File
 	stack           *Stack
+	locked          bool
 	names           []string
 	newTables       []string
 	nextUpdateIndex uint64
 }
 
 // NewAddition returns an Addition instance. As a side effect, this
-// takes a global filesystem lock on the ref database.
+// takes a global filesystem lock on the ref database, which is held
+// until Close.
 func (st *Stack) NewAddition() (*Addition, error) {
+	if !st.tryLockWrite() {
+		return nil, ErrLockFailure
+	}
 	tr := Addition{
 		stack:        st,
+		locked:       true,
 		lockFileName: st.listFile + ".lock",
 	}
 	var err error
 	tr.lockFile, err = os.OpenFile(tr.lockFileName, os.O_EXCL|os.O_CREATE|os.O_WRONLY, 0644)
 	if os.IsExist(err) {
+		tr.Close()
 		return nil, ErrLockFailure
 	}
 	if err != nil {
+		tr.Close()
 		return nil, err
 	}
 	for _, e := range st.stack {
@@ -350,6 +460,10 @@ func (tr *Addition) Close() {
 		os.Remove(tr.lockFileName)
 		tr.lockFileName = ""
 	}
+	if tr.locked {
+		tr.stack.unlockWrite()
+		tr.locked = false
+	}
 }
 
 // Commit commits the changes to the database, releasing the lock.
@@ -383,30 +497,22 @@ func (s *Stack) checkAddition(tabname string) error {
 	if s.cfg.SkipNameCheck {
 		return nil
 	}
-	bs, err := NewFileBlockSource(tabname)
+	bs, err := s.openBlockSource(tabname)
 	if err != nil {
 		return err
 	}
-	r, err := NewReader(bs, tabname)
+	r, err := NewReaderConfig(bs, tabname, &s.cfg)
 	if err != nil {
+		bs.Close()
 		return err
 	}
 	defer r.Close()
-	it, err := r.SeekRef("")
-	if err != nil {
-		return err
-	}
 
 	var recs []RefRecord
-	for {
-		var rec RefRecord
-		ok, err := it.NextRef(&rec)
+	for rec, err := range r.Refs("") {
 		if err != nil {
 			return err
 		}
-		if !ok {
-			break
-		}
 		recs = append(recs, rec)
 	}
 
@@ -419,6 +525,8 @@ func formatName(min, max uint64) string {
 
 // NextUpdateIndex returns the update index at which to write the next table.
 func (st *Stack) NextUpdateIndex() uint64 {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
 	if sz := len(st.stack); sz > 0 {
 		return st.stack[sz-1].MaxUpdateIndex() + 1
 	}
@@ -427,7 +535,7 @@ func (st *Stack) NextUpdateIndex() uint64 {
 
 // compactLocked writes the compacted version of tables [first,last]
 // into a temporary file, whose name is returned.
-func (st *Stack) compactLocked(first, last int, expiration *LogExpirationConfig) (string, error) {
+func (st *Stack) compactLocked(ctx context.Context, first, last int, expiration *LogExpirationConfig) (string, error) {
 	fn := formatName(st.stack[first].MinUpdateIndex(),
 		st.stack[last].MaxUpdateIndex())
 
@@ -448,7 +556,7 @@ func (st *Stack) compactLocked(first, last int, expiration *LogExpirationConfig)
 		return "", err
 	}
 
-	if err := st.writeCompact(wr, first, last, expiration); err != nil {
+	if err := st.writeCompact(ctx, wr, first, last, expiration); err != nil {
 		return "", err
 	}
 
@@ -464,7 +572,7 @@ func (st *Stack) compactLocked(first, last int, expiration *LogExpirationConfig)
 	return tmpTable.Name(), nil
 }
 
-func (st *Stack) writeCompact(wr *Writer, first, last int, expiration *LogExpirationConfig) error {
+func (st *Stack) writeCompact(ctx context.Context, wr *Writer, first, last int, expiration *LogExpirationConfig) error {
 	// do it.
 	wr.SetLimits(st.stack[first].MinUpdateIndex(),
 		st.stack[last].MaxUpdateIndex())
@@ -478,21 +586,14 @@ func (st *Stack) writeCompact(wr *Writer, first, last int, expiration *LogExpira
 	if err != nil {
 		return err
 	}
-	it, err := merged.SeekRef("")
-	if err != nil {
-		return err
-	}
-
 	var entries uint64
-	for {
-		var rec RefRecord
-		ok, err := it.NextRef(&rec)
+	for rec, err := range merged.Refs("") {
+		if err == nil {
+			err = ctx.Err()
+		}
 		if err != nil {
 			return err
 		}
-		if !ok {
-			break
-		}
 
 		if first == 0 && rec.IsDeletion() {
 			continue
@@ -504,19 +605,13 @@ func (st *Stack) writeCompact(wr *Writer, first, last int, expiration *LogExpira
 		entries++
 	}
 
-	it, err = merged.SeekLog("", math.MaxUint64)
-	if err != nil {
-		return err
-	}
-	for {
-		var rec LogRecord
-		ok, err := it.NextLog(&rec)
+	for rec, err := range merged.Logs("") {
+		if err == nil {
+			err = ctx.Err()
+		}
 		if err != nil {
 			return err
 		}
-		if !ok {
-			break
-		}
 
 		if expiration != nil {
 			if expiration.Time > 0 && rec.Time < expiration.Time {
@@ -537,19 +632,51 @@ func (st *Stack) writeCompact(wr *Writer, first, last int, expiration *LogExpira
 		entries++
 	}
 
+	// Custom records are carried over even if their type is not
+	// registered here. The log obj index points into the old
+	// tables, so the writer builds a new one instead.
+	types, err := merged.customTypesIn()
+	if err != nil {
+		return err
+	}
+	for _, typ := range types {
+		if typ == blockTypeLogObj {
+			continue
+		}
+		for rec, err := range customSeq(merged, typ, "") {
+			if err == nil {
+				err = ctx.Err()
+			}
+			if err != nil {
+				return err
+			}
+
+			if first == 0 && rec.IsDeletion() {
+				continue
+			}
+
+			if err := wr.addCustom(&rec); err != nil {
+				return err
+			}
+			entries++
+		}
+	}
+
 	st.Stats.EntriesWritten += entries
 	return nil
 }
 
-func (st *Stack) compactRangeStats(first, last int, expiration *LogExpirationConfig) (bool, error) {
-	ok, err := st.compactRange(first, last, expiration)
+func (st *Stack) compactRangeStats(ctx context.Context, first, last int, expiration *LogExpirationConfig) (bool, error) {
+	ok, err := st.compactRange(ctx, first, last, expiration)
 	if !ok {
 		st.Stats.Failures++
 	}
 	return ok, err
 }
 
-func (st *Stack) compactRange(first, last int, expiration *LogExpirationConfig) (bool, error) {
+// compactRange compacts the tables [first,last]. The caller must hold
+// the write lock.
+func (st *Stack) compactRange(ctx context.Context, first, last int, expiration *LogExpirationConfig) (bool, error) {
 	if first >= last && expiration == nil {
 		return true, nil
 	}
@@ -600,7 +727,7 @@ func (st *Stack) compactRange(first, last int, expiration *LogExpirationConfig)
 	}
 	lockFileName = ""
 
-	tmpTable, err := st.compactLocked(first, last, expiration)
+	tmpTable, err := st.compactLocked(ctx, first, last, expiration)
 	// Compaction + tombstones can create an empty table out of non-empty tables.
 	emptyTable := (err == ErrEmptyTable)
 	if emptyTable {
@@ -675,12 +802,12 @@ func (st *Stack) compactRange(first, last int, expiration *LogExpirationConfig)
 
 func (st *Stack) tableSizesForCompaction() []uint64 {
 	var res []uint64
-	version := 1
-	if st.cfg.HashID == SHA256ID {
-		version = 2
-	}
-	var overhead = uint64(headerSize(version) - 1)
 	for _, t := range st.stack {
+		// v2 tables have no file header.
+		var overhead uint64
+		if t.sst == nil {
+			overhead = uint64(headerSize(t.version) - 1)
+		}
 		res = append(res, t.size-overhead)
 	}
 	return res
@@ -768,12 +895,24 @@ func suggestCompactionSegment(sizes []uint64) *segment {
 	return &minSeg
 }
 
-// AutoCompact runs a compaction if the stack looks imbalanced.
+// AutoCompact runs a compaction if the stack looks imbalanced. It
+// does nothing if another write is running in this process.
 func (st *Stack) AutoCompact() error {
+	return st.AutoCompactContext(context.Background())
+}
+
+// AutoCompactContext is like AutoCompact, but aborts the compaction
+// with ctx.Err() once ctx is done.
+func (st *Stack) AutoCompactContext(ctx context.Context) error {
+	if !st.tryLockWrite() {
+		return nil
+	}
+	defer st.unlockWrite()
+
 	sizes := st.tableSizesForCompaction()
 	seg := suggestCompactionSegment(sizes)
 	if seg != nil {
-		_, err := st.compactRangeStats(seg.start, seg.end-1, nil)
+		_, err := st.compactRangeStats(ctx, seg.start, seg.end-1, nil)
 		return err
 	}
 	return nil
@@ -781,6 +920,17 @@ func (st *Stack) AutoCompact() error {
 
 // CompactAll compacts the entire stack. If expiration is given, expire log entries.
 func (st *Stack) CompactAll(expiration *LogExpirationConfig) error {
-	_, err := st.compactRange(0, len(st.stack)-1, expiration)
+	return st.CompactAllContext(context.Background(), expiration)
+}
+
+// CompactAllContext is like CompactAll, but aborts the compaction
+// with ctx.Err() once ctx is done.
+func (st *Stack) CompactAllContext(ctx context.Context, expiration *LogExpirationConfig) error {
+	if !st.tryLockWrite() {
+		return ErrLockFailure
+	}
+	defer st.unlockWrite()
+
+	_, err := st.compactRange(ctx, 0, len(st.stack)-1, expiration)
 	return err
 }
@@ -10,10 +10,15 @@ package reftable
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -498,3 +503,459 @@ func TestLogLine(t *testing.T) {
 		t.Errorf("got %q want %q", got, want)
 	}
 }
+
+func TestStackMmap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := NewStack(dir, Config{Mmap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := st.Add(func(w *Writer) error {
+			next := st.NextUpdateIndex()
+			w.SetLimits(next, next)
+			return w.AddRef(&RefRecord{
+				RefName:     fmt.Sprintf("branch%02d", i),
+				UpdateIndex: next,
+				Value:       testHash(i),
+			})
+		}); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("branch%02d", i)
+		r, err := ReadRef(st.Merged(), name)
+		if err != nil {
+			t.Fatalf("ReadRef(%s): %v", name, err)
+		}
+		if r == nil || !bytes.Equal(r.Value, testHash(i)) {
+			t.Fatalf("ReadRef(%s): got %v", name, r)
+		}
+	}
+}
+
+func TestStackSHA256(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{
+		HashID: SHA256ID,
+	}
+	st, err := NewStack(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	st.disableAutoCompact = true
+
+	N := 5
+	for i := 0; i < N; i++ {
+		if err := st.Add(func(w *Writer) error {
+			next := st.NextUpdateIndex()
+			w.SetLimits(next, next)
+			if err := w.AddRef(&RefRecord{
+				RefName:     fmt.Sprintf("branch%02d", i),
+				UpdateIndex: next,
+				Value:       testHash256(i % 2),
+			}); err != nil {
+				return err
+			}
+			return w.AddLog(&LogRecord{
+				RefName:     fmt.Sprintf("branch%02d", i),
+				UpdateIndex: next,
+				New:         testHash256(i % 2),
+				Old:         testHash256(2),
+				Message:     "message",
+			})
+		}); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+
+	check := func() {
+		m := st.Merged()
+		if got := m.HashID(); got != SHA256ID {
+			t.Fatalf("got hash ID %q", got)
+		}
+		for i := 0; i < N; i++ {
+			name := fmt.Sprintf("branch%02d", i)
+			r, err := ReadRef(m, name)
+			if err != nil {
+				t.Fatalf("ReadRef(%s): %v", name, err)
+			}
+			if r == nil || !bytes.Equal(r.Value, testHash256(i%2)) {
+				t.Fatalf("ReadRef(%s): got %v", name, r)
+			}
+
+			l, err := ReadLogAt(m, name, math.MaxUint64)
+			if err != nil {
+				t.Fatalf("ReadLogAt(%s): %v", name, err)
+			}
+			if l == nil || !bytes.Equal(l.New, testHash256(i%2)) {
+				t.Fatalf("ReadLogAt(%s): got %v", name, l)
+			}
+		}
+
+		it, err := m.RefsFor(testHash256(1))
+		if err != nil {
+			t.Fatalf("RefsFor: %v", err)
+		}
+		var names []string
+		for {
+			var ref RefRecord
+			ok, err := it.NextRef(&ref)
+			if err != nil {
+				t.Fatalf("NextRef: %v", err)
+			}
+			if !ok {
+				break
+			}
+			names = append(names, ref.RefName)
+		}
+		if want := []string{"branch01", "branch03"}; !reflect.DeepEqual(names, want) {
+			t.Fatalf("RefsFor: got %v, want %v", names, want)
+		}
+	}
+
+	check()
+	if err := st.CompactAll(nil); err != nil {
+		t.Fatalf("CompactAll: %v", err)
+	}
+	if len(st.stack) != 1 {
+		t.Fatalf("got stack %v after compaction", st)
+	}
+	check()
+
+	reopened, err := NewStack(dir, cfg)
+	if err != nil {
+		t.Fatalf("NewStack: %v", err)
+	}
+	reopened.Close()
+}
+
+func TestStackConcurrentReads(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mmap=%v", mmap), func(t *testing.T) {
+			testStackConcurrentReads(t, Config{Mmap: mmap})
+		})
+	}
+}
+
+func testStackConcurrentReads(t *testing.T, cfg Config) {
+	const N = 100
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := NewStack(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	// committed is the number of refs known to be in the stack.
+	var committed int32
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				want := int(atomic.LoadInt32(&committed))
+				m, release := st.Acquire()
+				it, err := m.SeekRef("")
+				if err != nil {
+					t.Errorf("SeekRef: %v", err)
+					release()
+					return
+				}
+				got, err := readIter(blockTypeRef, it.impl)
+				release()
+				if err != nil {
+					t.Errorf("readIter: %v", err)
+					return
+				}
+				if len(got) < want {
+					t.Errorf("got %d refs, want at least %d", len(got), want)
+					return
+				}
+				for i := 1; i < len(got); i++ {
+					if got[i-1].key() >= got[i].key() {
+						t.Errorf("refs out of order: %q >= %q", got[i-1].key(), got[i].key())
+						return
+					}
+				}
+
+				if want > 0 {
+					m, release := st.Acquire()
+					_, err := ReadRef(m, "branch0000")
+					release()
+					if err != nil {
+						t.Errorf("ReadRef: %v", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < N; i++ {
+		if err := st.Add(func(w *Writer) error {
+			r := RefRecord{
+				RefName:     fmt.Sprintf("branch%04d", i),
+				Value:       testHash(i),
+				UpdateIndex: st.NextUpdateIndex(),
+			}
+			w.SetLimits(r.UpdateIndex, r.UpdateIndex)
+			return w.AddRef(&r)
+		}); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		atomic.StoreInt32(&committed, int32(i+1))
+	}
+	if err := st.CompactAll(nil); err != nil {
+		t.Fatalf("CompactAll: %v", err)
+	}
+
+	close(done)
+	wg.Wait()
+
+	if got, err := ReadRef(st.Merged(), "branch0042"); err != nil || !bytes.Equal(got.Value, testHash(42)) {
+		t.Fatalf("ReadRef: %v, %v", got, err)
+	}
+}
+
+func TestStackAcquireOutlivesCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := NewStack(dir, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	st.disableAutoCompact = true
+
+	for i := 0; i < 3; i++ {
+		if err := st.Add(func(w *Writer) error {
+			r := RefRecord{
+				RefName:     fmt.Sprintf("branch%d", i),
+				Value:       testHash(i),
+				UpdateIndex: st.NextUpdateIndex(),
+			}
+			w.SetLimits(r.UpdateIndex, r.UpdateIndex)
+			return w.AddRef(&r)
+		}); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+
+	m, release := st.Acquire()
+	defer release()
+	if err := st.CompactAll(nil); err != nil {
+		t.Fatalf("CompactAll: %v", err)
+	}
+
+	// The compacted tables are gone from the stack, but remain
+	// readable through m.
+	for i := 0; i < 3; i++ {
+		got, err := ReadRef(m, fmt.Sprintf("branch%d", i))
+		if err != nil || !bytes.Equal(got.Value, testHash(i)) {
+			t.Fatalf("ReadRef %d: %v, %v", i, got, err)
+		}
+	}
+}
+
+func TestStackCloseReleasesTables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := NewStack(dir, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Add(func(w *Writer) error {
+		w.SetLimits(1, 1)
+		return w.AddRef(&RefRecord{RefName: "branch", Value: testHash(1), UpdateIndex: 1})
+	}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	tabs := st.stack
+	st.Close()
+	for _, r := range tabs {
+		if refs := atomic.LoadInt32(&r.refs); refs != 0 {
+			t.Errorf("%s: got %d references after Close, want 0", r.Name(), refs)
+		}
+	}
+}
+
+func TestStackReloadReleasesTables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := NewStack(dir, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	st.disableAutoCompact = true
+
+	for i := 0; i < 3; i++ {
+		if err := st.Add(func(w *Writer) error {
+			r := RefRecord{
+				RefName:     fmt.Sprintf("branch%d", i),
+				Value:       testHash(i),
+				UpdateIndex: st.NextUpdateIndex(),
+			}
+			w.SetLimits(r.UpdateIndex, r.UpdateIndex)
+			return w.AddRef(&r)
+		}); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+
+	tabs := st.stack
+	_, release := st.Acquire()
+	if err := st.CompactAll(nil); err != nil {
+		t.Fatalf("CompactAll: %v", err)
+	}
+	for _, r := range tabs {
+		if refs := atomic.LoadInt32(&r.refs); refs != 1 {
+			t.Errorf("%s: got %d references while acquired, want 1", r.Name(), refs)
+		}
+	}
+
+	// The compacted tables are closed with the last reference,
+	// without waiting for garbage collection.
+	release()
+	for _, r := range tabs {
+		if refs := atomic.LoadInt32(&r.refs); refs != 0 {
+			t.Errorf("%s: got %d references after release, want 0", r.Name(), refs)
+		}
+	}
+}
+
+func TestStackWriteLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := NewStack(dir, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	tr, err := st.NewAddition()
+	if err != nil {
+		t.Fatalf("NewAddition: %v", err)
+	}
+	if _, err := st.NewAddition(); err != ErrLockFailure {
+		t.Fatalf("got %v, want ErrLockFailure", err)
+	}
+	if err := st.CompactAll(nil); err != ErrLockFailure {
+		t.Fatalf("got %v, want ErrLockFailure", err)
+	}
+	tr.Close()
+
+	tr, err = st.NewAddition()
+	if err != nil {
+		t.Fatalf("NewAddition after Close: %v", err)
+	}
+	tr.Close()
+}
+
+func TestStackCompactAllContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := NewStack(dir, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	st.disableAutoCompact = true
+
+	for i := 0; i < 3; i++ {
+		if err := st.Add(func(w *Writer) error {
+			r := RefRecord{
+				RefName:     fmt.Sprintf("branch%d", i),
+				Value:       testHash(i),
+				UpdateIndex: st.NextUpdateIndex(),
+			}
+			w.SetLimits(r.UpdateIndex, r.UpdateIndex)
+			return w.AddRef(&r)
+		}); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := st.CompactAllContext(ctx, nil); err != context.Canceled {
+		t.Fatalf("CompactAllContext: got %v, want context.Canceled", err)
+	}
+	if err := st.AddContext(ctx, func(w *Writer) error {
+		t.Fatal("write called with canceled context")
+		return nil
+	}); err != context.Canceled {
+		t.Fatalf("AddContext: got %v, want context.Canceled", err)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 3 tables and tables.list.
+	if len(entries) != 4 {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Fatalf("got files %v", names)
+	}
+
+	if err := st.CompactAll(nil); err != nil {
+		t.Fatalf("CompactAll: %v", err)
+	}
+	if got := len(st.Merged().stack); got != 1 {
+		t.Fatalf("got %d tables after CompactAll", got)
+	}
+}
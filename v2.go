@@ -0,0 +1,566 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/google/reftable/sst"
+)
+
+// This file stores git data in the tables of the sst package, following
+// the git storage conventions of reftable-v2-proposal.md. Refs, objs
+// and logs are told apart by a key prefix. Custom records have the
+// prefix 'd' followed by their type. Values are encoded as in v1, and
+// the extra bits of the key hold the v1 value type.
+//
+// The metadata in the footer is
+//
+//	uint8(storage version) | uint64(min update index) | uint64(max update index)
+//
+// followed by the hash ID for storage version 3. Version 2 implies
+// SHA-1.
+
+// TableFormat selects the file format a Writer produces. Readers
+// detect the format.
+type TableFormat int
+
+const (
+	// FormatV1 is the reftable format that git reads.
+	FormatV1 TableFormat = iota
+
+	// FormatV2 is the experimental format of
+	// reftable-v2-proposal.md. It has no file header, and finds all
+	// blocks through a single index. It does not support ref
+	// filters, block checksums, codecs other than zlib, or
+	// concurrent log compression.
+	FormatV2
+)
+
+const (
+	v2KeyRef    = 'a'
+	v2KeyObj    = 'b'
+	v2KeyLog    = 'c'
+	v2KeyCustom = 'd'
+)
+
+const (
+	gitStorageSHA1   = 2
+	gitStorageHashID = 3
+
+	gitStorageSize = 17
+)
+
+// v2Prefix returns the key prefix of records of the given type.
+func v2Prefix(typ byte) []byte {
+	switch typ {
+	case blockTypeRef:
+		return []byte{v2KeyRef}
+	case blockTypeObj:
+		return []byte{v2KeyObj}
+	case blockTypeLog:
+		return []byte{v2KeyLog}
+	}
+	return []byte{v2KeyCustom, typ}
+}
+
+// v2Type returns the record type of a key, or 0.
+func v2Type(key []byte) byte {
+	if len(key) == 0 {
+		return 0
+	}
+	switch key[0] {
+	case v2KeyRef:
+		return blockTypeRef
+	case v2KeyObj:
+		return blockTypeObj
+	case v2KeyLog:
+		return blockTypeLog
+	case v2KeyCustom:
+		if len(key) > 1 && key[1] != blockTypeAny && !isBlockType(key[1]) {
+			return key[1]
+		}
+	}
+	return 0
+}
+
+// checkFormat returns an error for options that the format does not
+// support.
+func (cfg *Config) checkFormat() error {
+	switch cfg.Format {
+	case FormatV1:
+		return nil
+	case FormatV2:
+	default:
+		return fmt.Errorf("reftable: unknown format %d", cfg.Format)
+	}
+
+	if cfg.RefFilterBitsPerKey > 0 {
+		return errors.New("reftable: FormatV2 does not support ref filters")
+	}
+	if cfg.BlockChecksums {
+		return errors.New("reftable: FormatV2 does not support block checksums")
+	}
+	if cfg.LogCompressionWorkers > 1 {
+		return errors.New("reftable: FormatV2 does not support LogCompressionWorkers")
+	}
+	if _, ok := cfg.LogCodec.(zlibCodec); cfg.LogCodec != nil && cfg.LogCodec != NoCompression && !ok {
+		return fmt.Errorf("reftable: FormatV2 does not support codec ID 0x%02x", cfg.LogCodec.ID())
+	}
+	return nil
+}
+
+// encodeRecord returns the encoded value of rec.
+func encodeRecord(rec record, hashSize int) ([]byte, error) {
+	buf := make([]byte, 256)
+	for {
+		if n, ok := rec.encode(buf, hashSize); ok {
+			return buf[:n], nil
+		}
+		if len(buf) >= 1<<24 {
+			return nil, fmt.Errorf("%w: %v", ErrRecordTooLarge, rec)
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// sstError converts the errors of the sst package to those of this
+// package.
+func sstError(err error) error {
+	var c *sst.CorruptError
+	switch {
+	case errors.As(err, &c):
+		return &CorruptTableError{
+			Table:  c.Table,
+			Offset: c.Offset,
+			Err:    c.Err,
+		}
+	case errors.Is(err, sst.ErrKeyOrder):
+		return fmt.Errorf("%w: %v", ErrKeyOrder, err)
+	case errors.Is(err, sst.ErrTooLarge):
+		return fmt.Errorf("%w: %v", ErrRecordTooLarge, err)
+	case errors.Is(err, sst.ErrEmpty):
+		return ErrEmptyTable
+	}
+	return err
+}
+
+// setStats copies the statistics of a section from the sst writer.
+func setStats(dst *BlockStats, src sst.BlockStats) {
+	dst.Blocks = src.Blocks
+	dst.Entries = src.Entries
+	dst.Restarts = src.Restarts
+	dst.Offset = src.Offset
+}
+
+// sstBlockConfig returns the block configuration of a section.
+func (w *Writer) sstBlockConfig(typ byte) sst.BlockConfig {
+	cfg := sst.BlockConfig{
+		Size:            w.cfg.sectionBlockSize(typ),
+		RestartInterval: w.cfg.sectionRestartInterval(typ),
+	}
+	if typ == blockTypeLog && w.cfg.LogCodec != NoCompression {
+		cfg.Level = defaultCodec.level
+		if c, ok := w.cfg.LogCodec.(zlibCodec); ok {
+			cfg.Level = c.level
+		}
+		// For sst, level 0 is the default level.
+		cfg.Compress = cfg.Level != zlib.NoCompression
+	}
+	return cfg
+}
+
+// newSSTWriter sets up the writer for a v2 table.
+func (w *Writer) newSSTWriter() error {
+	var err error
+	w.sst, err = sst.NewWriter(w.out, &sst.Config{
+		BlockSize: w.cfg.BlockSize,
+		Unaligned: w.cfg.Unaligned,
+		Index:     w.sstBlockConfig(blockTypeIndex),
+	})
+	if err != nil {
+		return err
+	}
+	w.sstType = blockTypeRef
+	return w.sst.SetBlockConfig(w.sstBlockConfig(blockTypeRef))
+}
+
+// addSST adds a record to a v2 table.
+func (w *Writer) addSST(rec record) error {
+	val, err := encodeRecord(rec, w.cfg.HashID.Size())
+	if err != nil {
+		return err
+	}
+	key := append(v2Prefix(rec.typ()), rec.key()...)
+	if err := w.sst.Add(key, rec.valType(), val); err != nil {
+		return fmt.Errorf("%w (adding %v)", sstError(err), rec)
+	}
+	return nil
+}
+
+// finishSSTRefs ends the ref section of a v2 table. If the refs take
+// several blocks, it adds the obj entries, which list the ref blocks
+// for each object ID.
+func (w *Writer) finishSSTRefs() error {
+	if err := w.sst.Flush(); err != nil {
+		return err
+	}
+	setStats(&w.Stats.RefStats, w.sst.Stats())
+
+	if !w.cfg.SkipIndexObjects && w.Stats.RefStats.Blocks > 1 {
+		if err := w.sst.SetBlockConfig(w.sstBlockConfig(blockTypeObj)); err != nil {
+			return err
+		}
+		oids := make([]string, 0, len(w.objIndex))
+		for k := range w.objIndex {
+			oids = append(oids, k)
+		}
+		sort.Strings(oids)
+
+		for _, oid := range oids {
+			rec := &objRecord{[]byte(oid), w.objIndex[oid]}
+			err := w.addSST(rec)
+			if errors.Is(err, ErrRecordTooLarge) {
+				// Readers scan all refs for these.
+				rec.Offsets = nil
+				err = w.addSST(rec)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := w.sst.Flush(); err != nil {
+			return err
+		}
+		setStats(&w.Stats.ObjStats, w.sst.Stats())
+		w.Stats.ObjectIDLen = w.cfg.HashID.Size()
+	}
+
+	w.sstType = blockTypeLog
+	return w.sst.SetBlockConfig(w.sstBlockConfig(blockTypeLog))
+}
+
+// startSSTSection ends the current section of a v2 table, and starts
+// one for records of type typ.
+func (w *Writer) startSSTSection(typ byte) error {
+	if w.sstType == blockTypeRef {
+		if err := w.finishSSTRefs(); err != nil {
+			return err
+		}
+	} else {
+		if err := w.sst.Flush(); err != nil {
+			return err
+		}
+		setStats(w.getBlockStats(w.sstType), w.sst.Stats())
+	}
+	w.sstType = typ
+	return w.sst.SetBlockConfig(w.sstBlockConfig(typ))
+}
+
+// closeSST writes the index and footer of a v2 table.
+func (w *Writer) closeSST() error {
+	if w.sstType == blockTypeRef {
+		if err := w.finishSSTRefs(); err != nil {
+			return err
+		}
+	}
+	if err := w.sst.Flush(); err != nil {
+		return err
+	}
+	setStats(w.getBlockStats(w.sstType), w.sst.Stats())
+
+	meta := []byte{gitStorageSHA1}
+	if w.cfg.HashID == SHA256ID {
+		meta[0] = gitStorageHashID
+	}
+	meta = binary.BigEndian.AppendUint64(meta, w.minUpdateIndex)
+	meta = binary.BigEndian.AppendUint64(meta, w.maxUpdateIndex)
+	if meta[0] == gitStorageHashID {
+		meta = append(meta, w.cfg.HashID[:]...)
+	}
+
+	err := w.sst.Close(meta)
+	setStats(&w.Stats.idxStats, w.sst.Stats())
+	w.Stats.Blocks = w.Stats.RefStats.Blocks + w.Stats.ObjStats.Blocks +
+		w.Stats.LogStats.Blocks + w.Stats.idxStats.Blocks
+	for _, s := range w.Stats.CustomStats {
+		w.Stats.Blocks += s.Blocks
+	}
+	return sstError(err)
+}
+
+// newSSTReader creates a reader for a v2 table.
+func newSSTReader(s *sst.Reader, src BlockSource, name string) (*Reader, error) {
+	r := &Reader{
+		name:    name,
+		src:     src,
+		size:    s.DataSize(),
+		sst:     s,
+		offsets: map[byte]readerOffsets{},
+		refs:    1,
+	}
+
+	meta := s.Metadata()
+	if len(meta) < gitStorageSize {
+		return nil, r.corrupt(r.size, 0, fmt.Errorf("metadata has %d bytes", len(meta)))
+	}
+	r.header = header{
+		Magic:          magic,
+		BlockSize:      s.BlockSize(),
+		MinUpdateIndex: binary.BigEndian.Uint64(meta[1:]),
+		MaxUpdateIndex: binary.BigEndian.Uint64(meta[9:]),
+		HashID:         SHA1ID,
+	}
+	switch meta[0] {
+	case gitStorageSHA1:
+	case gitStorageHashID:
+		if len(meta) < gitStorageSize+4 {
+			return nil, r.corrupt(r.size, 0, errors.New("metadata lacks hash ID"))
+		}
+		r.header.HashID = HashID(meta[gitStorageSize:])
+	default:
+		return nil, fmt.Errorf("reftable: unsupported storage version %d", meta[0])
+	}
+
+	r.hashSize = r.header.HashID.Size()
+	if r.hashSize == 0 {
+		return nil, r.corrupt(r.size, 0, fmt.Errorf("%w: unknown hash ID %q", ErrHashSize, r.header.HashID))
+	}
+	return r, nil
+}
+
+// decodeSST decodes an entry of a v2 table into rec, which must be
+// of the type of the entry.
+func (r *Reader) decodeSST(e sst.Entry, rec record) error {
+	typ := rec.typ()
+	if v2Type(e.Key) != typ {
+		return fmt.Errorf("got key %q, want %c record", e.Key, typ)
+	}
+	if n, ok := rec.decode(e.Value, string(e.Key[len(v2Prefix(typ)):]), e.Extra, r.hashSize); !ok || n != len(e.Value) {
+		return fmt.Errorf("bad value for key %q", e.Key)
+	}
+	if ref, ok := rec.(*RefRecord); ok {
+		ref.UpdateIndex += r.header.MinUpdateIndex
+	}
+	return nil
+}
+
+// seekSST returns an iterator over the records of rec's type in a v2
+// table, starting at the key of rec.
+func (r *Reader) seekSST(rec record, reverse bool) (iterator, error) {
+	key := append(v2Prefix(rec.typ()), rec.key()...)
+	seek := r.sst.Seek
+	if reverse {
+		seek = r.sst.SeekReverse
+	}
+	it, err := seek(key)
+	if err != nil {
+		return nil, sstError(err)
+	}
+	return &sstRecordIter{r: r, it: it, typ: rec.typ()}, nil
+}
+
+// sstRecordIter returns records of a single type from a v2 table.
+type sstRecordIter struct {
+	r    *Reader
+	it   *sst.TableIterator
+	typ  byte
+	done bool
+}
+
+// Next implements the Iterator interface.
+func (i *sstRecordIter) Next(rec record) (bool, error) {
+	if rec.typ() != i.typ {
+		return false, fmt.Errorf("reftable: got %T, want record of type %c", rec, i.typ)
+	}
+	if i.done {
+		return false, nil
+	}
+
+	e, ok, err := i.it.Next()
+	if err != nil || !ok {
+		return false, sstError(err)
+	}
+	if v2Type(e.Key) != i.typ {
+		// The records of the other types come before or after.
+		i.done = true
+		return false, nil
+	}
+	if err := i.r.decodeSST(e, rec); err != nil {
+		return false, i.r.corrupt(i.it.BlockOffset(), i.typ, err)
+	}
+	return true, nil
+}
+
+// refsForSST returns the refs of a v2 table that point to oid, or, if
+// abbrev is set, to an object ID starting with oid. If the table has
+// obj entries, only the listed ref blocks are read.
+func (r *Reader) refsForSST(ctx context.Context, oid []byte, abbrev bool) (iterator, error) {
+	it, err := r.sst.Seek([]byte{v2KeyObj})
+	if err != nil {
+		return nil, sstError(err)
+	}
+	e, ok, err := it.Next()
+	if err != nil {
+		return nil, sstError(err)
+	}
+
+	if ok && v2Type(e.Key) == blockTypeObj {
+		want := append([]byte{v2KeyObj}, oid...)
+		if !bytes.HasPrefix(e.Key, want) {
+			if it, err = r.sst.Seek(want); err != nil {
+				return nil, sstError(err)
+			}
+			if e, ok, err = it.Next(); err != nil {
+				return nil, sstError(err)
+			}
+		}
+
+		// The keys hold full object IDs, so a prefix may match
+		// several entries.
+		var offsets []uint64
+		matches := 0
+		listed := true
+		for ok && bytes.HasPrefix(e.Key, want) {
+			var obj objRecord
+			if err := r.decodeSST(e, &obj); err != nil {
+				return nil, r.corrupt(it.BlockOffset(), blockTypeObj, err)
+			}
+			if len(obj.Offsets) == 0 {
+				listed = false
+				break
+			}
+			offsets = append(offsets, obj.Offsets...)
+			matches++
+			if e, ok, err = it.Next(); err != nil {
+				return nil, sstError(err)
+			}
+		}
+
+		if listed {
+			if matches == 0 {
+				return withContext(ctx, &emptyIterator{}), nil
+			}
+			if matches > 1 {
+				sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+				offsets = uniqOffsets(offsets)
+			}
+			return withContext(ctx, &sstIndexedRefIter{r: r, oid: oid, abbrev: abbrev, offsets: offsets}), nil
+		}
+	}
+
+	refs, err := r.seekSST(&RefRecord{}, false)
+	if err != nil {
+		return nil, err
+	}
+	return &filteringRefIterator{
+		tab:    r,
+		oid:    oid,
+		abbrev: abbrev,
+		it:     withContext(ctx, refs),
+	}, nil
+}
+
+// sstIndexedRefIter returns the refs pointing to oid, or to object IDs
+// starting with oid if abbrev is set, from the given ref blocks of a
+// v2 table.
+type sstIndexedRefIter struct {
+	r      *Reader
+	oid    []byte
+	abbrev bool
+
+	// offsets of the remaining blocks.
+	offsets []uint64
+
+	off     uint64
+	entries []sst.Entry
+}
+
+// Next implements the Iterator interface.
+func (i *sstIndexedRefIter) Next(rec record) (bool, error) {
+	ref := rec.(*RefRecord)
+	for {
+		for len(i.entries) > 0 {
+			e := i.entries[0]
+			i.entries = i.entries[1:]
+			if err := i.r.decodeSST(e, ref); err != nil {
+				return false, i.r.corrupt(i.off, blockTypeRef, err)
+			}
+			if pointsTo(ref, i.oid, i.abbrev) {
+				return true, nil
+			}
+		}
+		if len(i.offsets) == 0 {
+			return false, nil
+		}
+
+		i.off = i.offsets[0]
+		i.offsets = i.offsets[1:]
+		entries, err := i.r.sst.Block(i.off)
+		if err != nil {
+			return false, sstError(err)
+		}
+		i.entries = entries
+	}
+}
+
+// customTypesSST returns the types of the custom records of a v2
+// table, seeking to each type in turn.
+func (r *Reader) customTypesSST() ([]byte, error) {
+	var types []byte
+	next := []byte{v2KeyCustom}
+	for {
+		it, err := r.sst.Seek(next)
+		if err != nil {
+			return nil, sstError(err)
+		}
+		e, ok, err := it.Next()
+		if err != nil || !ok {
+			return types, sstError(err)
+		}
+		if len(e.Key) == 0 || e.Key[0] != v2KeyCustom {
+			return types, nil
+		}
+		typ := v2Type(e.Key)
+		if typ == 0 {
+			return nil, r.corrupt(it.BlockOffset(), 0, fmt.Errorf("key %q has unknown prefix", e.Key))
+		}
+		types = append(types, typ)
+		if typ == 0xff {
+			return types, nil
+		}
+		next = []byte{v2KeyCustom, typ + 1}
+	}
+}
+
+// verifySST checks the container of a v2 table, and the records of
+// its entries.
+func (v *verifier) verifySST() {
+	errs := v.r.sst.Verify(func(off uint64, e sst.Entry) error {
+		typ := v2Type(e.Key)
+		if typ == 0 {
+			return fmt.Errorf("key %q has unknown prefix", e.Key)
+		}
+		return v.r.decodeSST(e, newRecord(typ, ""))
+	})
+	for _, err := range errs {
+		var c *sst.CorruptError
+		if errors.As(err, &c) {
+			v.errorf(c.Offset, 0, "%v", c.Err)
+		} else {
+			v.errorf(0, 0, "%v", err)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func v2TestRecords(n int, genHash func(int) []byte) ([]RefRecord, []LogRecord) {
+	var refs []RefRecord
+	var logs []LogRecord
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("refs/heads/branch%04d", i)
+		ref := RefRecord{
+			RefName:     name,
+			UpdateIndex: 5 + uint64(i%3),
+			Value:       genHash(i / 4),
+		}
+		switch i % 5 {
+		case 1:
+			ref.TargetValue = genHash(1000 + i)
+		case 2:
+			ref.Value = nil
+			ref.Target = "refs/heads/main"
+		case 3:
+			ref.Value = nil
+		}
+		refs = append(refs, ref)
+
+		for j := uint64(2); j > 0; j-- {
+			logs = append(logs, LogRecord{
+				RefName:     name,
+				UpdateIndex: j,
+				Old:         genHash(i),
+				New:         genHash(i + 1),
+				Name:        "Jane Doe",
+				Email:       "jane@example.com",
+				Time:        1600000000 + j,
+				Message:     fmt.Sprintf("update %d %d\n", i, j),
+			})
+		}
+	}
+	return refs, logs
+}
+
+func TestTableV2RoundTrip(t *testing.T) {
+	for _, cfg := range []Config{
+		{BlockSize: 256},
+		{BlockSize: 256, Unaligned: true},
+		{BlockSize: 256, SkipIndexObjects: true},
+		{BlockSize: 256, LogBlockSize: 1024, IndexBlockSize: 512, RefRestartInterval: 4},
+		{BlockSize: 4096, LogCodec: ZlibCompression(1)},
+		{BlockSize: 256, LogCodec: NoCompression},
+		{BlockSize: 512, HashID: SHA256ID},
+	} {
+		cfg.Format = FormatV2
+		genHash := testHash
+		if cfg.HashID == SHA256ID {
+			genHash = testHash256
+		}
+		refs, logs := v2TestRecords(200, genHash)
+
+		w, reader := constructTestTable(t, refs, logs, cfg)
+		if reader.sst == nil {
+			t.Fatalf("%+v: table is not in the v2 format", cfg)
+		}
+		wantVersion := byte(gitStorageSHA1)
+		if cfg.HashID == SHA256ID {
+			wantVersion = gitStorageHashID
+		}
+		if got := reader.sst.Metadata()[0]; got != wantVersion {
+			t.Errorf("%+v: got storage version %d, want %d", cfg, got, wantVersion)
+		}
+		if got, want := reader.HashID(), cfg.HashID; want != NullHashID && got != want {
+			t.Errorf("%+v: got hash ID %q, want %q", cfg, got, want)
+		}
+		if reader.MinUpdateIndex() != 5 || reader.MaxUpdateIndex() != 7 {
+			t.Errorf("%+v: got limits %d, %d", cfg, reader.MinUpdateIndex(), reader.MaxUpdateIndex())
+		}
+		if errs := reader.Verify(); len(errs) > 0 {
+			t.Fatalf("%+v: Verify: %v", cfg, errs)
+		}
+		if w.Stats.RefStats.Entries != len(refs) || w.Stats.LogStats.Entries != len(logs) {
+			t.Errorf("%+v: got stats %+v", cfg, w.Stats)
+		}
+		if cfg.SkipIndexObjects != (w.Stats.ObjStats.Blocks == 0) {
+			t.Errorf("%+v: got %d obj blocks", cfg, w.Stats.ObjStats.Blocks)
+		}
+
+		it, err := reader.SeekRef("")
+		if err != nil {
+			t.Fatalf("SeekRef: %v", err)
+		}
+		got, err := readIter(blockTypeRef, it.impl)
+		if err != nil || len(got) != len(refs) {
+			t.Fatalf("%+v: got %d refs, %v, want %d", cfg, len(got), err, len(refs))
+		}
+		for i := range refs {
+			if !reflect.DeepEqual(got[i], &refs[i]) {
+				t.Fatalf("%+v: got %v, want %v", cfg, got[i], &refs[i])
+			}
+		}
+
+		it, err = reader.SeekLog("", math.MaxUint64)
+		if err != nil {
+			t.Fatalf("SeekLog: %v", err)
+		}
+		got, err = readIter(blockTypeLog, it.impl)
+		if err != nil || len(got) != len(logs) {
+			t.Fatalf("%+v: got %d logs, %v, want %d", cfg, len(got), err, len(logs))
+		}
+		for i := range logs {
+			if !reflect.DeepEqual(got[i], &logs[i]) {
+				t.Fatalf("%+v: got %v, want %v", cfg, got[i], &logs[i])
+			}
+		}
+
+		for i := 0; i < len(refs); i += 7 {
+			ref, err := ReadRef(reader, refs[i].RefName)
+			if err != nil || !reflect.DeepEqual(ref, &refs[i]) {
+				t.Fatalf("%+v: ReadRef(%q): %v, %v", cfg, refs[i].RefName, ref, err)
+			}
+
+			it, err := reader.SeekRefReverse(refs[i].RefName + "x")
+			if err != nil {
+				t.Fatalf("SeekRefReverse: %v", err)
+			}
+			got, err := readIter(blockTypeRef, it.impl)
+			if err != nil || len(got) != i+1 || !reflect.DeepEqual(got[0], &refs[i]) {
+				t.Fatalf("%+v: SeekRefReverse(%q): got %d refs, %v", cfg, refs[i].RefName, len(got), err)
+			}
+
+			it, err = reader.SeekLogReverse(refs[i].RefName, 1)
+			if err != nil {
+				t.Fatalf("SeekLogReverse: %v", err)
+			}
+			got, err = readIter(blockTypeLog, it.impl)
+			if err != nil || len(got) != 2*i+2 || !reflect.DeepEqual(got[0], &logs[2*i+1]) {
+				t.Fatalf("%+v: SeekLogReverse(%q): got %d logs, %v", cfg, refs[i].RefName, len(got), err)
+			}
+		}
+		if ref, err := ReadRef(reader, "refs/heads/missing"); err != nil || ref != nil {
+			t.Errorf("%+v: ReadRef(missing): %v, %v", cfg, ref, err)
+		}
+
+		for _, oid := range [][]byte{genHash(8), genHash(1001), genHash(5000)} {
+			var want []record
+			for i, r := range refs {
+				if bytes.Equal(r.Value, oid) || bytes.Equal(r.TargetValue, oid) {
+					want = append(want, &refs[i])
+				}
+			}
+			it, err := reader.RefsFor(oid)
+			if err != nil {
+				t.Fatalf("RefsFor: %v", err)
+			}
+			got, err := readIter(blockTypeRef, it.impl)
+			if err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("%+v: RefsFor(%x): got %v, %v, want %v", cfg, oid, got, err, want)
+			}
+		}
+	}
+}
+
+func TestTableV2Empty(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, &Config{Format: FormatV2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetLimits(1, 1)
+	if err := w.Close(); !errors.Is(err, ErrEmptyTable) {
+		t.Fatalf("Close: got %v, want ErrEmptyTable", err)
+	}
+
+	reader, err := NewReader(&ByteBlockSource{buf.Bytes()}, "buffer")
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	if n, err := countRecords(reader); err != nil || n != 0 {
+		t.Errorf("got %d records, %v", n, err)
+	}
+}
+
+func TestTableV2Corrupt(t *testing.T) {
+	refs, logs := v2TestRecords(50, testHash)
+	w, _ := constructTestTable(t, refs, logs, Config{BlockSize: 256, Format: FormatV2})
+	table := w.paddedWriter.out.(*bytes.Buffer).Bytes()
+
+	corrupt := append([]byte{}, table...)
+	corrupt[len(corrupt)-15] ^= 0x01
+	var cerr *CorruptTableError
+	if _, err := NewReader(&ByteBlockSource{corrupt}, "buffer"); !errors.As(err, &cerr) {
+		t.Errorf("footer: got %v, want CorruptTableError", err)
+	}
+
+	corrupt = append([]byte{}, table...)
+	corrupt[1] ^= 0x7f
+	r, err := NewReader(&ByteBlockSource{corrupt}, "buffer")
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	if _, err := countRecords(r); !errors.As(err, &cerr) {
+		t.Errorf("block: got %v, want CorruptTableError", err)
+	}
+	if errs := r.Verify(); len(errs) == 0 {
+		t.Errorf("Verify found no errors")
+	}
+}
+
+func TestWriterV2Errors(t *testing.T) {
+	for _, cfg := range []Config{
+		{Format: FormatV2, RefFilterBitsPerKey: 10},
+		{Format: FormatV2, BlockChecksums: true},
+		{Format: FormatV2, LogCompressionWorkers: 4},
+		{Format: FormatV2, LogCodec: SnappyCompression},
+		{Format: 3},
+	} {
+		if _, err := NewWriter(&bytes.Buffer{}, &cfg); err == nil {
+			t.Errorf("%+v: got success, want error", cfg)
+		}
+	}
+
+	w, err := NewWriter(&bytes.Buffer{}, &Config{Format: FormatV2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetLimits(1, 1)
+	if err := w.AddLog(&LogRecord{RefName: "b", UpdateIndex: 1, Message: "m"}); err != nil {
+		t.Fatalf("AddLog: %v", err)
+	}
+	if err := w.AddRef(&RefRecord{RefName: "a", UpdateIndex: 1}); !errors.Is(err, ErrKeyOrder) {
+		t.Errorf("AddRef after AddLog: got %v, want ErrKeyOrder", err)
+	}
+}
+
+func TestStackMixedFormats(t *testing.T) {
+	cfgs := []Config{
+		{BlockSize: 256},
+		{BlockSize: 256, Format: FormatV2},
+	}
+
+	// Compact with either format.
+	for _, cfg := range cfgs {
+		dir := t.TempDir()
+		refmap := map[string][]byte{}
+		const N = 20
+		for i := 0; i < N; i++ {
+			st, err := NewStack(dir, cfgs[i%2])
+			if err != nil {
+				t.Fatal(err)
+			}
+			st.disableAutoCompact = true
+			if err := st.Add(func(w *Writer) error {
+				idx := st.NextUpdateIndex()
+				w.SetLimits(idx, idx)
+				name := fmt.Sprintf("refs/heads/branch%02d", i%7)
+				refmap[name] = testHash(i)
+				if err := w.AddRef(&RefRecord{RefName: name, UpdateIndex: idx, Value: testHash(i)}); err != nil {
+					return err
+				}
+				return w.AddLog(&LogRecord{RefName: name, UpdateIndex: idx, New: testHash(i), Message: "update"})
+			}); err != nil {
+				t.Fatalf("Add %d: %v", i, err)
+			}
+			st.Close()
+		}
+
+		st, err := NewStack(dir, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer st.Close()
+		check := func() {
+			t.Helper()
+			m := st.Merged()
+			for name, val := range refmap {
+				ref, err := ReadRef(m, name)
+				if err != nil || ref == nil || !bytes.Equal(ref.Value, val) {
+					t.Fatalf("ReadRef(%q): %v, %v, want %x", name, ref, err, val)
+				}
+				it, err := m.RefsFor(val)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := readIter(blockTypeRef, it.impl)
+				if err != nil || len(got) != 1 || got[0].key() != name {
+					t.Fatalf("RefsFor(%x): %v, %v", val, got, err)
+				}
+			}
+			if n, err := countRecords(m); err != nil || n != len(refmap)+N {
+				t.Fatalf("got %d records, %v, want %d", n, err, len(refmap)+N)
+			}
+		}
+
+		check()
+		if err := st.CompactAll(nil); err != nil {
+			t.Fatalf("CompactAll: %v", err)
+		}
+		if len(st.stack) != 1 {
+			t.Fatalf("got %d tables after compaction", len(st.stack))
+		}
+		if got := st.stack[0].sst != nil; got != (cfg.Format == FormatV2) {
+			t.Errorf("compacted table v2 = %v, want format %d", got, cfg.Format)
+		}
+		check()
+	}
+}
@@ -0,0 +1,360 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"fmt"
+	"sort"
+)
+
+// VerifyError describes a structural problem in a table, found by
+// Reader.Verify.
+type VerifyError struct {
+	Table     string
+	Offset    uint64
+	BlockType byte
+	Msg       string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("reftable: %s: %q block at 0x%x: %s", e.Table, e.BlockType, e.Offset, e.Msg)
+}
+
+// verifier collects the problems found while walking a table.
+type verifier struct {
+	r    *Reader
+	errs []*VerifyError
+}
+
+func (v *verifier) errorf(off uint64, typ byte, format string, args ...interface{}) {
+	v.errs = append(v.errs, &VerifyError{
+		Table:     v.r.name,
+		Offset:    off,
+		BlockType: typ,
+		Msg:       fmt.Sprintf(format, args...),
+	})
+}
+
+// Verify walks every block of the table, and checks its structure:
+// block types, restart offsets, key order within and across blocks,
+// the indexes of each section, the object index and the ref filter
+// against the ref records, the inflated size of log blocks, the
+// custom sections, and the block checksums. It returns all
+// problems found, or nil if the table is sound.
+func (r *Reader) Verify() []*VerifyError {
+	v := &verifier{r: r}
+	if r.sst != nil {
+		v.verifySST()
+		return v.errs
+	}
+
+	var refHashes map[string][]uint64
+	types := append([]byte{blockTypeRef, blockTypeObj, blockTypeLog}, r.customTypes...)
+	for _, typ := range types {
+		offs := r.offsets[typ]
+		if !offs.Present {
+			continue
+		}
+
+		var onRecord func(off uint64, rec record)
+		var done func()
+		switch typ {
+		case blockTypeObj:
+			onRecord, done = v.objectChecker(refHashes)
+		case blockTypeRef:
+			refHashes = map[string][]uint64{}
+			onRecord = func(off uint64, rec record) {
+				ref := rec.(*RefRecord)
+				if r.refFilter != nil && !r.refFilter.mayContain(ref.RefName) {
+					v.errorf(off, typ, "ref %q is missing from the ref filter", ref.RefName)
+				}
+				for _, h := range [][]byte{ref.Value, ref.TargetValue} {
+					if h == nil {
+						continue
+					}
+					l := refHashes[string(h)]
+					if len(l) == 0 || l[len(l)-1] != off {
+						refHashes[string(h)] = append(l, off)
+					}
+				}
+			}
+		}
+		blocks := v.verifySection(typ, offs.Offset, onRecord)
+		if done != nil {
+			done()
+		}
+		if offs.IndexOffset > 0 {
+			v.verifyIndex(typ, offs.IndexOffset, blocks)
+		}
+	}
+
+	for _, c := range r.checksums {
+		off := r.blockStart(c)
+		if _, err := r.checkBlock(off, nil); err != nil {
+			v.errorf(off, 0, "%v", err)
+		}
+	}
+	return v.errs
+}
+
+// blockSummary holds the position and last key of a data block.
+type blockSummary struct {
+	off     uint64
+	lastKey string
+}
+
+// verifySection walks the data blocks of the given type starting at
+// off, and returns a summary of each block.
+func (v *verifier) verifySection(typ byte, off uint64, onRecord func(off uint64, rec record)) []blockSummary {
+	var blocks []blockSummary
+	lastKey := ""
+	for off < v.r.size {
+		br, err := v.r.newBlockReader(off, typ)
+		if err != nil {
+			v.errorf(off, typ, "%v", err)
+			break
+		}
+		if br == nil {
+			break
+		}
+
+		recs, ok := v.verifyBlock(off, br, lastKey)
+		if len(recs) > 0 {
+			lastKey = recs[len(recs)-1].key()
+			blocks = append(blocks, blockSummary{off, lastKey})
+		}
+		if onRecord != nil {
+			for _, rec := range recs {
+				onRecord(off, rec)
+			}
+		}
+		if !ok {
+			break
+		}
+		off += uint64(br.fullBlockSize)
+	}
+	return blocks
+}
+
+// verifyBlock decodes all records of a block, checking the restart
+// points and that keys are strictly increasing, starting beyond
+// prevKey. It returns the decoded records, and false if the block
+// could not be decoded entirely.
+func (v *verifier) verifyBlock(off uint64, br *blockReader, prevKey string) ([]record, bool) {
+	typ := br.getType()
+	first := br.headerOff + 4
+
+	var recs []record
+	starts := map[uint32]bool{}
+	bi := blockIter{}
+	br.start(&bi)
+	decoded := true
+	for {
+		start := bi.nextOffset
+		rec := newRecord(typ, "")
+		ok, err := bi.Next(rec)
+		if err != nil {
+			v.errorf(off, typ, "record at block offset %d: %v", start, err)
+			decoded = false
+			break
+		}
+		if !ok {
+			break
+		}
+		if typ == blockTypeRef {
+			if ref := rec.(*RefRecord); ref.UpdateIndex > v.r.header.MaxUpdateIndex-v.r.header.MinUpdateIndex {
+				v.errorf(off, typ, "ref %q has update index %d outside [%d, %d]", ref.RefName,
+					ref.UpdateIndex+v.r.header.MinUpdateIndex, v.r.header.MinUpdateIndex, v.r.header.MaxUpdateIndex)
+			}
+		}
+
+		if k := rec.key(); (len(recs) > 0 || prevKey != "") && k <= prevKey {
+			v.errorf(off, typ, "key %q at block offset %d does not sort after %q", k, start, prevKey)
+		}
+		prevKey = rec.key()
+		starts[start] = true
+		recs = append(recs, rec)
+	}
+
+	if len(recs) == 0 && decoded {
+		v.errorf(off, typ, "block has no records")
+	}
+
+	var lastRestart uint32
+	for i := 0; i < int(br.restartCount); i++ {
+		ro := br.restartOffset(i)
+		if ro < first || ro >= uint32(len(br.block)) {
+			v.errorf(off, typ, "restart %d at block offset %d is outside [%d, %d)", i, ro, first, len(br.block))
+			continue
+		}
+		if i > 0 && ro <= lastRestart {
+			v.errorf(off, typ, "restart %d at block offset %d does not follow %d", i, ro, lastRestart)
+		}
+		lastRestart = ro
+		if _, err := decodeRestartKey(br.block, ro); err != nil {
+			v.errorf(off, typ, "restart %d at block offset %d: key is prefix compressed", i, ro)
+		} else if decoded && !starts[ro] {
+			v.errorf(off, typ, "restart %d at block offset %d is not at a record boundary", i, ro)
+		}
+	}
+	if len(recs) > 0 && (br.restartCount == 0 || br.restartOffset(0) != first) {
+		v.errorf(off, typ, "first record is not a restart point")
+	}
+
+	return recs, decoded
+}
+
+// verifyIndex checks that the index for a section starting at idxOff
+// points at every block of the section in order, with the right last
+// keys.
+func (v *verifier) verifyIndex(typ byte, idxOff uint64, blocks []blockSummary) {
+	lastKeys := map[uint64]string{}
+	for _, b := range blocks {
+		lastKeys[b.off] = b.lastKey
+	}
+
+	var reached []uint64
+	var visit func(off uint64, depth int, prevKey string) ([]record, *blockReader)
+	checkTarget := func(idxBlock uint64, rec *indexRecord, depth int) {
+		if last, ok := lastKeys[rec.Offset]; ok {
+			reached = append(reached, rec.Offset)
+			if last != rec.LastKey {
+				v.errorf(idxBlock, blockTypeIndex, "index key %q for %c block at 0x%x, which ends in %q",
+					rec.LastKey, typ, rec.Offset, last)
+			}
+			return
+		}
+		if depth >= maxIndexDepth {
+			v.errorf(idxBlock, blockTypeIndex, "index exceeds %d levels", maxIndexDepth)
+			return
+		}
+		recs, br := visit(rec.Offset, depth+1, "")
+		if br == nil {
+			v.errorf(idxBlock, blockTypeIndex, "index key %q points to 0x%x, which is neither a %c nor an index block",
+				rec.LastKey, rec.Offset, typ)
+			return
+		}
+		if len(recs) > 0 && recs[len(recs)-1].key() != rec.LastKey {
+			v.errorf(idxBlock, blockTypeIndex, "index key %q for index block at 0x%x, which ends in %q",
+				rec.LastKey, rec.Offset, recs[len(recs)-1].key())
+		}
+	}
+
+	// visit checks a single index block and the blocks it points
+	// to. It returns the records of the block, or a nil
+	// blockReader if there is no index block at off.
+	visit = func(off uint64, depth int, prevKey string) ([]record, *blockReader) {
+		br, err := v.r.newBlockReader(off, blockTypeIndex)
+		if err != nil {
+			v.errorf(off, blockTypeIndex, "%v", err)
+			return nil, nil
+		}
+		if br == nil {
+			return nil, nil
+		}
+		recs, _ := v.verifyBlock(off, br, prevKey)
+		for _, rec := range recs {
+			checkTarget(off, rec.(*indexRecord), depth)
+		}
+		return recs, br
+	}
+
+	// The top level of the index may span several blocks.
+	off := idxOff
+	prevKey := ""
+	for off < v.r.size {
+		recs, br := visit(off, 0, prevKey)
+		if br == nil {
+			break
+		}
+		if len(recs) > 0 {
+			prevKey = recs[len(recs)-1].key()
+		}
+		off += uint64(br.fullBlockSize)
+	}
+	if off == idxOff {
+		v.errorf(idxOff, blockTypeIndex, "no index block for %c section", typ)
+		return
+	}
+
+	for i, b := range blocks {
+		if i >= len(reached) {
+			v.errorf(b.off, typ, "block is not reached from the index")
+			continue
+		}
+		if reached[i] != b.off {
+			v.errorf(b.off, typ, "index entry %d points to 0x%x, want 0x%x", i, reached[i], b.off)
+		}
+	}
+	if len(reached) > len(blocks) {
+		v.errorf(idxOff, blockTypeIndex, "index has %d entries for %d blocks", len(reached), len(blocks))
+	}
+}
+
+// objectChecker checks the 'o' section against the object IDs found
+// in the ref records. It returns the check for each obj record, and a
+// func reporting the objects that were not seen, to call once the
+// section was walked.
+func (v *verifier) objectChecker(refHashes map[string][]uint64) (onRecord func(off uint64, rec record), done func()) {
+	want := map[string][]uint64{}
+	for h, offs := range refHashes {
+		if len(h) < v.r.objectIDLen {
+			continue
+		}
+		p := h[:v.r.objectIDLen]
+		if _, ok := want[p]; ok {
+			v.errorf(v.r.offsets[blockTypeObj].Offset, blockTypeObj,
+				"object ID length %d does not make %x unique", v.r.objectIDLen, p)
+		}
+		want[p] = offs
+	}
+
+	got := map[string]bool{}
+	onRecord = func(off uint64, rec record) {
+		obj := rec.(*objRecord)
+		key := string(obj.HashPrefix)
+		got[key] = true
+		offs, ok := want[key]
+		if !ok {
+			v.errorf(off, blockTypeObj, "object %x is not referenced by any ref", obj.HashPrefix)
+			return
+		}
+
+		// The writer drops the offsets if they do not fit in a block.
+		if obj.Offsets != nil && !uint64sEqual(obj.Offsets, offs) {
+			v.errorf(off, blockTypeObj, "object %x has offsets %v, want %v", obj.HashPrefix, obj.Offsets, offs)
+		}
+	}
+
+	done = func() {
+		var missing []string
+		for k := range want {
+			if !got[k] {
+				missing = append(missing, k)
+			}
+		}
+		sort.Strings(missing)
+		for _, k := range missing {
+			v.errorf(v.r.offsets[blockTypeObj].Offset, blockTypeObj, "object %x is missing from the index", []byte(k))
+		}
+	}
+	return onRecord, done
+}
+
+func uint64sEqual(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
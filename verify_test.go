@@ -0,0 +1,240 @@
+/*
+Copyright 2020 Google LLC
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package reftable
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/google/reftable/sst"
+)
+
+func verifyTestRecords(n int) ([]RefRecord, []LogRecord) {
+	var refs []RefRecord
+	var logs []LogRecord
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("refs/heads/%04d/%s", i, strings.Repeat("x", 20))
+		refs = append(refs, RefRecord{
+			RefName: name,
+			Value:   testHash(i / 3),
+		})
+		logs = append(logs, LogRecord{
+			RefName: name,
+			New:     testHash(i),
+			Old:     testHash(i + 1),
+			Message: strings.Repeat("m", i%50),
+		})
+	}
+	return refs, logs
+}
+
+func TestVerifyClean(t *testing.T) {
+	for _, n := range []int{1, 10, 100, 1000} {
+		for _, cfg := range []Config{
+			{BlockSize: 256},
+			{BlockSize: 256, Unaligned: true},
+			{BlockSize: 4096},
+			{BlockSize: 256, SkipIndexObjects: true},
+		} {
+			refs, logs := verifyTestRecords(n)
+			w, r := constructTestTable(t, refs, logs, cfg)
+			if errs := r.Verify(); len(errs) > 0 {
+				t.Errorf("n=%d cfg %+v: got errors %v", n, cfg, errs)
+			}
+			if n == 1000 && cfg.BlockSize == 256 && w.Stats.RefStats.MaxIndexLevel < 2 {
+				t.Errorf("n=%d cfg %+v: got index level %d, want a multi-level index", n, cfg, w.Stats.RefStats.MaxIndexLevel)
+			}
+		}
+	}
+}
+
+// writeVerifyTable writes a table with 100 refs and logs, calling
+// tamper before the writer is closed.
+func writeVerifyTable(t *testing.T, tamper func(w *Writer)) (*Writer, []byte) {
+	refs, logs := verifyTestRecords(100)
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, &Config{BlockSize: 256})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	for _, r := range refs {
+		if err := w.AddRef(&r); err != nil {
+			t.Fatalf("AddRef: %v", err)
+		}
+	}
+	if tamper != nil {
+		tamper(w)
+	}
+	for _, l := range logs {
+		if err := w.AddLog(&l); err != nil {
+			t.Fatalf("AddLog: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return w, buf.Bytes()
+}
+
+func verifyBytes(t *testing.T, data []byte) []*VerifyError {
+	r, err := NewReader(&ByteBlockSource{data}, "buffer")
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	return r.Verify()
+}
+
+func wantVerifyError(t *testing.T, errs []*VerifyError, off uint64, typ byte, substr string) {
+	t.Helper()
+	for _, e := range errs {
+		if e.Offset == off && e.BlockType == typ && strings.Contains(e.Msg, substr) {
+			if e.Table != "buffer" {
+				t.Errorf("got table %q", e.Table)
+			}
+			return
+		}
+	}
+	t.Errorf("missing error %q for %c block at 0x%x; got %v", substr, typ, off, errs)
+}
+
+func TestVerifyBlockType(t *testing.T) {
+	_, data := writeVerifyTable(t, nil)
+	data[256] = 'x'
+	wantVerifyError(t, verifyBytes(t, data), 256, blockTypeRef, "format error")
+}
+
+func TestVerifyRestart(t *testing.T) {
+	_, data := writeVerifyTable(t, nil)
+	r, err := NewReader(&ByteBlockSource{data}, "buffer")
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	br, err := r.newBlockReader(256, blockTypeRef)
+	if err != nil {
+		t.Fatalf("newBlockReader: %v", err)
+	}
+	// The restart bytes alias data.
+	sst.PutU24(br.restartBytes, br.restartOffset(0)+1)
+	wantVerifyError(t, r.Verify(), 256, blockTypeRef, "restart 0")
+}
+
+func TestVerifyKeyOrder(t *testing.T) {
+	_, data := writeVerifyTable(t, func(w *Writer) {
+		w.blockWriter.add(&RefRecord{RefName: "refs/heads/0000"})
+	})
+	errs := verifyBytes(t, data)
+	found := false
+	for _, e := range errs {
+		if e.BlockType == blockTypeRef && strings.Contains(e.Msg, "does not sort after") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("got %v, want key order error", errs)
+	}
+}
+
+func TestVerifyIndex(t *testing.T) {
+	var idxOff uint64
+	w, data := writeVerifyTable(t, func(w *Writer) {
+		w.index[1].LastKey = w.index[0].LastKey + "~"
+	})
+	idxOff = w.Stats.RefStats.IndexOffset
+	if idxOff == 0 {
+		t.Fatalf("table has no ref index")
+	}
+
+	errs := verifyBytes(t, data)
+	found := false
+	for _, e := range errs {
+		if e.BlockType == blockTypeIndex && strings.Contains(e.Msg, fmt.Sprintf("block at 0x%x, which ends in", 256)) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("got %v, want index key error", errs)
+	}
+}
+
+func TestVerifyObjects(t *testing.T) {
+	w, data := writeVerifyTable(t, func(w *Writer) {
+		w.objIndex[string(testHash(1))] = []uint64{0}
+	})
+	wantVerifyError(t, verifyBytes(t, data), w.Stats.ObjStats.Offset, blockTypeObj, fmt.Sprintf("object %x", testHash(1)[:w.Stats.ObjectIDLen]))
+}
+
+func TestVerifyObjectsOnce(t *testing.T) {
+	w, data := writeVerifyTable(t, nil)
+	off := w.Stats.ObjStats.Offset
+	data[off] = 'x'
+	errs := verifyBytes(t, data)
+	n := 0
+	for _, e := range errs {
+		if e.BlockType == blockTypeObj && strings.Contains(e.Msg, "format error") {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("got %v, want one format error at 0x%x", errs, off)
+	}
+}
+
+func TestVerifyLogInflate(t *testing.T) {
+	w, data := writeVerifyTable(t, nil)
+	off := w.Stats.LogStats.Offset
+	for i := 6; i < 20; i++ {
+		data[off+uint64(i)] ^= 0xff
+	}
+	wantVerifyError(t, verifyBytes(t, data), off, blockTypeLog, "")
+}
+
+// verifyCorrupt runs Verify on data, turning a panic into an error.
+func verifyCorrupt(data []byte) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+
+	r, err := NewReader(&ByteBlockSource{data}, "corrupt")
+	if err != nil {
+		return nil
+	}
+	r.Verify()
+	return nil
+}
+
+func TestVerifyCorruptBytes(t *testing.T) {
+	refs, logs := verifyTestRecords(30)
+	for _, cfg := range []Config{
+		{BlockSize: 256},
+		{BlockSize: 256, Unaligned: true, LogCodec: NoCompression},
+		{BlockSize: 256, BlockChecksums: true, RefFilterBitsPerKey: 10, IndexLogObjects: true},
+		{BlockSize: 256, Format: FormatV2},
+	} {
+		w, _ := constructTestTable(t, refs, logs, cfg)
+		data := w.paddedWriter.out.(*bytes.Buffer).Bytes()
+
+		// Overwrite a few random bytes at a time, so that sizes,
+		// counts and offsets get arbitrary values together.
+		rnd := rand.New(rand.NewSource(1))
+		for i := 0; i < 500; i++ {
+			corrupt := append([]byte{}, data...)
+			for n := rnd.Intn(4) + 1; n > 0; n-- {
+				corrupt[rnd.Intn(len(corrupt))] = byte(rnd.Intn(256))
+			}
+			if err := verifyCorrupt(corrupt); err != nil {
+				t.Fatalf("%+v: case %d: %v", cfg, i, err)
+			}
+		}
+	}
+}
@@ -10,14 +10,18 @@ package reftable
 
 import (
 	"bytes"
+	"compress/zlib"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"log"
+	"reflect"
 	"sort"
 	"strings"
+
+	"github.com/google/reftable/sst"
 )
 
 type paddedWriter struct {
@@ -60,6 +64,19 @@ type Writer struct {
 	minUpdateIndex uint64
 	maxUpdateIndex uint64
 
+	// autoMax is set if maxUpdateIndex is computed from the
+	// records written. See SetMinUpdateIndex.
+	autoMax bool
+
+	// out is the output. If the header must be rewritten at Close,
+	// it is patched at outStart, if canPatch is set, or else the
+	// table is collected in buffered. canPatch needs an io.Seeker
+	// to find outStart.
+	out      io.Writer
+	outStart int64
+	canPatch bool
+	buffered *bytes.Buffer
+
 	// The current block writer, or nil if it was just flushed.
 	blockWriter *blockWriter
 	index       []indexRecord
@@ -67,6 +84,38 @@ type Writer struct {
 	// hash => block offset positions.
 	objIndex map[string][]uint64
 
+	// logObjIndex maps the object IDs of log records to the log
+	// blocks, if Config.IndexLogObjects is set. logBlockOffsets has
+	// the offsets of the log blocks written, by number.
+	logObjIndex     map[string][]uint64
+	logBlockOffsets []uint64
+
+	// refHashes are the filter hashes of the ref names, if
+	// Config.RefFilterBitsPerKey is set.
+	refHashes []uint64
+
+	// checksums are the checksums of the blocks written, if
+	// Config.BlockChecksums is set.
+	checksums []blockChecksum
+
+	// lastBlockType is the type of the last block written.
+	lastBlockType byte
+
+	// pending are the log blocks being compressed, in write order.
+	// See Config.LogCompressionWorkers.
+	pending []pendingBlock
+
+	// sst writes FormatV2 tables, in place of the block writers.
+	// sstType is the type of the current section.
+	sst     *sst.Writer
+	sstType byte
+
+	// customType is the type of the current custom section, or 0
+	// before the first. customStart is where the custom sections
+	// start.
+	customType  byte
+	customStart uint64
+
 	Stats Stats
 
 	header header
@@ -80,6 +129,58 @@ func (cfg *Config) setDefaults() {
 	if cfg.BlockSize == 0 {
 		cfg.BlockSize = defaultBlockSize
 	}
+
+	for _, sz := range []*uint32{&cfg.RefBlockSize, &cfg.LogBlockSize, &cfg.ObjBlockSize, &cfg.IndexBlockSize} {
+		if *sz == 0 {
+			*sz = cfg.BlockSize
+		}
+	}
+	for _, ri := range []*int{&cfg.RefRestartInterval, &cfg.LogRestartInterval, &cfg.ObjRestartInterval, &cfg.IndexRestartInterval} {
+		if *ri == 0 {
+			*ri = cfg.RestartInterval
+		}
+	}
+
+	// The header block size is where readers expect padded blocks
+	// to end, so it must not be smaller than any of them.
+	cfg.BlockSize = cfg.RefBlockSize
+	for _, sz := range []uint32{cfg.ObjBlockSize, cfg.IndexBlockSize} {
+		if sz > cfg.BlockSize {
+			cfg.BlockSize = sz
+		}
+	}
+}
+
+// sectionBlockSize returns the block size for blocks of type typ.
+func (cfg *Config) sectionBlockSize(typ byte) uint32 {
+	switch typ {
+	case blockTypeRef:
+		return cfg.RefBlockSize
+	case blockTypeLog:
+		return cfg.LogBlockSize
+	case blockTypeObj:
+		return cfg.ObjBlockSize
+	case blockTypeIndex:
+		return cfg.IndexBlockSize
+	}
+	// Custom records are laid out like refs.
+	return cfg.RefBlockSize
+}
+
+// sectionRestartInterval returns the restart interval for blocks of
+// type typ.
+func (cfg *Config) sectionRestartInterval(typ byte) int {
+	switch typ {
+	case blockTypeRef:
+		return cfg.RefRestartInterval
+	case blockTypeLog:
+		return cfg.LogRestartInterval
+	case blockTypeObj:
+		return cfg.ObjRestartInterval
+	case blockTypeIndex:
+		return cfg.IndexRestartInterval
+	}
+	return cfg.RefRestartInterval
 }
 
 // NewWriter creates a writer.
@@ -87,18 +188,55 @@ func NewWriter(out io.Writer, cfg *Config) (*Writer, error) {
 	o := *cfg
 	o.setDefaults()
 	w := &Writer{
-		cfg:   o,
-		block: make([]byte, o.BlockSize),
+		cfg: o,
 	}
 
-	if cfg.BlockSize >= (1 << 24) {
-		return nil, errors.New("reftable: invalid blocksize")
+	for _, sz := range []uint32{o.RefBlockSize, o.LogBlockSize, o.ObjBlockSize, o.IndexBlockSize} {
+		if sz >= (1 << 24) {
+			return nil, errors.New("reftable: invalid blocksize")
+		}
+	}
+	if o.HashID.Size() == 0 {
+		return nil, fmt.Errorf("%w: unknown hash ID %q", ErrHashSize, o.HashID)
+	}
+	if c, ok := o.LogCodec.(zlibCodec); ok && (c.level < zlib.HuffmanOnly || c.level > zlib.BestCompression) {
+		return nil, fmt.Errorf("reftable: invalid zlib level %d", c.level)
+	} else if o.LogCodec != nil && !ok {
+		// Readers find the codec by its ID, so it must be the
+		// one registered for it.
+		c := lookupCodec(o.LogCodec.ID())
+		if c == nil {
+			return nil, fmt.Errorf("reftable: codec ID 0x%02x is not registered", o.LogCodec.ID())
+		}
+		if reflect.TypeOf(c) != reflect.TypeOf(o.LogCodec) {
+			return nil, fmt.Errorf("reftable: codec ID 0x%02x is registered for %T, not %T", o.LogCodec.ID(), c, o.LogCodec)
+		}
+	}
+	if err := o.checkFormat(); err != nil {
+		return nil, err
 	}
 
+	w.out = out
 	w.paddedWriter.out = out
+	if s, ok := out.(io.Seeker); ok {
+		if off, err := s.Seek(0, io.SeekCurrent); err == nil {
+			w.outStart = off
+			w.canPatch = true
+		}
+	}
 	if !cfg.SkipIndexObjects {
 		w.objIndex = map[string][]uint64{}
 	}
+	if cfg.IndexLogObjects {
+		w.logObjIndex = map[string][]uint64{}
+	}
+
+	if o.Format == FormatV2 {
+		if err := w.newSSTWriter(); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
 
 	w.blockWriter = w.newBlockWriter(blockTypeRef)
 
@@ -106,38 +244,37 @@ func NewWriter(out io.Writer, cfg *Config) (*Writer, error) {
 }
 
 func (w *Writer) headerSize() int {
-	switch w.cfg.HashID {
-	case NullHashID, SHA1ID:
-		return headerSize(1)
-	case SHA256ID:
+	if w.cfg.HashID == SHA256ID {
 		return headerSize(2)
-	default:
-		panic("hash")
 	}
+	return headerSize(1)
 }
 
 func (w *Writer) footerSize() int {
-	switch w.cfg.HashID {
-	case NullHashID, SHA1ID:
-		return 68
-	case SHA256ID:
+	if w.cfg.HashID == SHA256ID {
 		return 72
-	default:
-		panic("hash")
 	}
+	return 68
 }
 
 // newBlockWriter creates a new blockWriter
 func (w *Writer) newBlockWriter(typ byte) *blockWriter {
-	block := w.block
+	size := w.cfg.sectionBlockSize(typ)
+	if uint32(cap(w.block)) < size {
+		w.block = make([]byte, size)
+	}
+	block := w.block[:size]
 
+	// Check the block count rather than w.next, which lags behind
+	// while log blocks are queued for compression.
 	var blockStart uint32
-	if w.next == 0 {
+	if w.Stats.Blocks == 0 {
 		blockStart = uint32(w.headerSize())
 	}
 
 	bw := newBlockWriter(typ, block, blockStart, w.cfg.HashID.Size())
-	bw.restartInterval = w.cfg.RestartInterval
+	bw.restartInterval = w.cfg.sectionRestartInterval(typ)
+	bw.codec = w.cfg.LogCodec
 	return bw
 }
 
@@ -165,6 +302,9 @@ func (w *Writer) indexHash(hash []byte) {
 		return
 	}
 	off := w.next
+	if w.sst != nil {
+		off = w.sst.Offset()
+	}
 	if hash == nil {
 		return
 	}
@@ -182,6 +322,35 @@ func (w *Writer) indexHash(hash []byte) {
 func (w *Writer) SetLimits(min, max uint64) {
 	w.minUpdateIndex = min
 	w.maxUpdateIndex = max
+	w.autoMax = false
+}
+
+// SetMinUpdateIndex sets the lower limit of the update indices of the
+// records to be written, and has the writer compute the upper limit
+// from the records. It should be called instead of SetLimits, before
+// calling AddRef or AddLog.
+//
+// The header is written before the upper limit is known, so Close
+// rewrites it. If the output is an io.Seeker, this seeks back, or
+// uses io.WriterAt if the output supports it too. Otherwise, the
+// table is buffered in memory, and only written to the output on
+// Close. An empty table is not written at all. FormatV2 tables keep
+// the limits in the footer, so they are never buffered.
+func (w *Writer) SetMinUpdateIndex(min uint64) {
+	w.minUpdateIndex = min
+	w.maxUpdateIndex = min
+	w.autoMax = true
+	if w.sst == nil && !w.canPatch && w.buffered == nil {
+		w.buffered = &bytes.Buffer{}
+		w.paddedWriter.out = w.buffered
+	}
+}
+
+// updateMax raises the upper limit to idx in the auto limit mode.
+func (w *Writer) updateMax(idx uint64) {
+	if w.autoMax && idx > w.maxUpdateIndex {
+		w.maxUpdateIndex = idx
+	}
 }
 
 // AddRef adds a RefRecord to the table. AddRef must be called in ascending order. AddRef cannot be called after AddLog is called.
@@ -189,17 +358,27 @@ func (w *Writer) AddRef(r *RefRecord) error {
 	if r.RefName == "" {
 		return fmt.Errorf("reftable: must specify RefName")
 	}
+	if w.customType != 0 {
+		return fmt.Errorf("%w: add %v after custom records", ErrKeyOrder, r)
+	}
 
-	if r.UpdateIndex < w.minUpdateIndex || r.UpdateIndex > w.maxUpdateIndex {
+	if r.UpdateIndex < w.minUpdateIndex || (r.UpdateIndex > w.maxUpdateIndex && !w.autoMax) {
 		return fmt.Errorf("reftable: UpdateIndex %d outside bounds [%d, %d]",
 			r.UpdateIndex, w.minUpdateIndex, w.maxUpdateIndex)
 	}
+	if err := checkHashSize(r, w.cfg.HashID.Size()); err != nil {
+		return err
+	}
 
 	cpy := *r
 	cpy.UpdateIndex -= w.minUpdateIndex
 	if err := w.add(&cpy); err != nil {
 		return err
 	}
+	w.updateMax(r.UpdateIndex)
+	if w.cfg.RefFilterBitsPerKey > 0 {
+		w.refHashes = append(w.refHashes, filterHash(r.RefName))
+	}
 	w.indexHash(r.Value)
 	w.indexHash(r.TargetValue)
 	return nil
@@ -211,6 +390,12 @@ func (w *Writer) AddLog(l *LogRecord) error {
 	if l.RefName == "" {
 		return fmt.Errorf("reftable: must specify RefName")
 	}
+	if w.customType != 0 {
+		return fmt.Errorf("%w: add %v after custom records", ErrKeyOrder, l)
+	}
+	if err := checkHashSize(l, w.cfg.HashID.Size()); err != nil {
+		return err
+	}
 
 	if !w.cfg.ExactLogMessage {
 		l.Message = strings.TrimSpace(l.Message)
@@ -222,31 +407,66 @@ func (w *Writer) AddLog(l *LogRecord) error {
 
 	if w.blockWriter != nil && w.blockWriter.getType() == blockTypeRef {
 		if err := w.finishPublicSection(); err != nil {
-			return nil
+			return err
+		}
+	} else if w.sst != nil && w.sstType == blockTypeRef {
+		if err := w.finishSSTRefs(); err != nil {
+			return err
 		}
 	}
 
-	w.next -= uint64(w.paddedWriter.pendingPadding)
-	w.paddedWriter.pendingPadding = 0
+	if w.sst == nil {
+		w.next -= uint64(w.paddedWriter.pendingPadding)
+		w.paddedWriter.pendingPadding = 0
+	}
 
-	return w.add(l)
+	if err := w.add(l); err != nil {
+		return err
+	}
+	w.updateMax(l.UpdateIndex)
+	w.indexLogHash(l.New)
+	w.indexLogHash(l.Old)
+	return nil
+}
+
+// checkHashSize returns ErrHashSize if rec holds object IDs of the
+// wrong size.
+func checkHashSize(rec record, hashSize int) error {
+	var ids [][]byte
+	switch r := rec.(type) {
+	case *RefRecord:
+		ids = [][]byte{r.Value, r.TargetValue}
+	case *LogRecord:
+		ids = [][]byte{r.Old, r.New}
+	}
+	for _, id := range ids {
+		if len(id) != 0 && len(id) != hashSize {
+			return fmt.Errorf("%w: %v has object ID of %d bytes, want %d", ErrHashSize, rec, len(id), hashSize)
+		}
+	}
+	return nil
 }
 
 func (w *Writer) add(rec record) error {
+	if w.sst != nil {
+		return w.addSST(rec)
+	}
+
 	k := rec.key()
 	if w.lastKey >= k {
-		log.Panicf("keys must be ascending: got %q last %q", rec, w.lastRec)
+		return fmt.Errorf("%w: got %q last %q", ErrKeyOrder, rec, w.lastRec)
 	}
-	w.lastKey = k
-	w.lastRec = rec.String()
 
 	if w.blockWriter == nil {
 		w.blockWriter = w.newBlockWriter(rec.typ())
 	}
 
 	if t := w.blockWriter.getType(); t != rec.typ() {
-		log.Panicf("add %c on block %c", rec.typ(), t)
+		return fmt.Errorf("%w: add %c on block %c", ErrKeyOrder, rec.typ(), t)
 	}
+	w.lastKey = k
+	w.lastRec = rec.String()
+
 	if w.blockWriter.add(rec) {
 		return nil
 	}
@@ -256,20 +476,42 @@ func (w *Writer) add(rec record) error {
 
 	w.blockWriter = w.newBlockWriter(rec.typ())
 	if !w.blockWriter.add(rec) {
-		return fmt.Errorf("reftable: record %v too large for block size", rec)
+		return fmt.Errorf("%w: %v", ErrRecordTooLarge, rec)
 	}
 	return nil
 }
 
 // Close writes the footer and flushes the table to disk.
 func (w *Writer) Close() error {
+	if err := w.writeLogObjIndex(); err != nil {
+		return err
+	}
+	if w.sst != nil {
+		return w.closeSST()
+	}
 	if err := w.finishPublicSection(); err != nil {
 		return err
 	}
+	w.next -= uint64(w.paddedWriter.pendingPadding)
 	w.paddedWriter.pendingPadding = 0
 
 	hb := w.headerBytes()
 	emptyTable := w.next == 0
+	if emptyTable && w.autoMax {
+		return ErrEmptyTable
+	}
+
+	if w.customType != 0 {
+		if err := w.writeCustomDirectory(); err != nil {
+			return err
+		}
+	}
+
+	if len(w.checksums) > 0 {
+		if err := w.writeChecksums(); err != nil {
+			return err
+		}
+	}
 
 	if emptyTable {
 		// Even an empty file needs a file header, separate
@@ -304,6 +546,17 @@ func (w *Writer) Close() error {
 		return err
 	}
 
+	if w.autoMax {
+		if err := w.patchHeader(hb[:w.headerSize()]); err != nil {
+			return err
+		}
+	}
+	if w.buffered != nil {
+		if _, err := w.out.Write(w.buffered.Bytes()); err != nil {
+			return err
+		}
+	}
+
 	if emptyTable {
 		return ErrEmptyTable
 	}
@@ -311,6 +564,33 @@ func (w *Writer) Close() error {
 	return nil
 }
 
+// patchHeader overwrites the header written with the first block,
+// which predates the final upper limit.
+func (w *Writer) patchHeader(hb []byte) error {
+	if w.buffered != nil {
+		copy(w.buffered.Bytes(), hb)
+		return nil
+	}
+	if wa, ok := w.out.(io.WriterAt); ok {
+		_, err := wa.WriteAt(hb, w.outStart)
+		return err
+	}
+
+	ws := w.out.(io.WriteSeeker)
+	end, err := ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := ws.Seek(w.outStart, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := ws.Write(hb); err != nil {
+		return err
+	}
+	_, err = ws.Seek(end, io.SeekStart)
+	return err
+}
+
 const debug = false
 
 func (w *Writer) getBlockStats(typ byte) *BlockStats {
@@ -324,8 +604,7 @@ func (w *Writer) getBlockStats(typ byte) *BlockStats {
 	case blockTypeIndex:
 		return &w.Stats.idxStats
 	}
-
-	panic(typ)
+	return w.customBlockStats(typ)
 }
 
 func (w *Writer) flushBlock() error {
@@ -336,42 +615,104 @@ func (w *Writer) flushBlock() error {
 		return nil
 	}
 	typ := w.blockWriter.getType()
+	if typ != blockTypeLog {
+		if err := w.flushPending(0); err != nil {
+			return err
+		}
+	}
+
 	blockStats := w.getBlockStats(typ)
 	// blockStats.Offset maybe 0 legitimately, so look at
 	// blockStats.Blocks instead
 	if blockStats.Blocks == 0 {
-		// Record where the first block of a type starts.
+		// Record where the first block of a type starts. Log
+		// blocks are only queued after the first one, so this
+		// is still accurate.
 		blockStats.Offset = w.next
 	}
-	raw := w.blockWriter.finish()
+
+	blockStats.Entries += w.blockWriter.entries
+	blockStats.Restarts += len(w.blockWriter.restarts)
+	blockStats.Blocks++
+	w.Stats.Blocks++
+
+	bw := w.blockWriter
+	w.blockWriter = nil
+	if typ == blockTypeLog && w.cfg.LogCompressionWorkers > 1 {
+		return w.queueLogBlock(bw)
+	}
+	return w.writeBlock(bw.finish(), typ, bw.lastKey)
+}
+
+// pendingBlock is a log block that is compressed concurrently.
+type pendingBlock struct {
+	lastKey string
+	done    chan []byte
+}
+
+// queueLogBlock compresses a log block on a new goroutine. If all
+// workers are busy, it first writes the oldest queued block.
+func (w *Writer) queueLogBlock(bw *blockWriter) error {
+	if err := w.flushPending(w.cfg.LogCompressionWorkers - 1); err != nil {
+		return err
+	}
+
+	// The block buffer is reused for the next block.
+	data := append([]byte(nil), bw.finishRaw()...)
+	p := pendingBlock{
+		lastKey: bw.lastKey,
+		done:    make(chan []byte, 1),
+	}
+	go func() {
+		p.done <- compressLogBlock(bw.codec, data, bw.headerOff)
+	}()
+	w.pending = append(w.pending, p)
+	return nil
+}
+
+// flushPending writes queued log blocks, oldest first, until at most
+// n remain.
+func (w *Writer) flushPending(n int) error {
+	for len(w.pending) > n {
+		p := w.pending[0]
+		w.pending = w.pending[1:]
+		if err := w.writeBlock(<-p.done, blockTypeLog, p.lastKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBlock writes a finished block, and adds it to the index.
+func (w *Writer) writeBlock(raw []byte, typ byte, lastKey string) error {
+	start := 0
 	if w.next == 0 {
 		copy(raw, w.headerBytes())
+		start = w.headerSize()
+	}
+	w.addChecksum(w.next+uint64(start), raw[start:])
+	w.lastBlockType = typ
+	if typ == blockTypeLog && w.logObjIndex != nil {
+		w.logBlockOffsets = append(w.logBlockOffsets, w.next)
 	}
 
 	padding := int(w.cfg.BlockSize) - len(raw)
-	if w.cfg.Unaligned || typ == blockTypeLog {
+	if w.cfg.Unaligned || typ == blockTypeLog || w.cfg.sectionBlockSize(typ) != w.cfg.BlockSize {
 		padding = 0
 	}
 
-	blockStats.Entries += w.blockWriter.entries
-	blockStats.Restarts += len(w.blockWriter.restarts)
-	blockStats.Blocks++
-	w.Stats.Blocks++
-
 	if debug {
-		log.Printf("block %c off %d sz %d (%d)",
-			w.blockWriter.getType(), w.next, len(raw), getU24(raw[w.blockWriter.headerOff+1:]))
+		log.Printf("block %c off %d sz %d", typ, w.next, len(raw))
 	}
 	n, err := w.paddedWriter.Write(raw, padding)
 	if err != nil {
 		return err
 	}
 	w.index = append(w.index, indexRecord{
-		w.blockWriter.lastKey,
+		lastKey,
 		w.next,
 	})
 	w.next += uint64(n)
-	w.blockWriter = nil
 	return nil
 }
 
@@ -385,6 +726,12 @@ func (w *Writer) finishPublicSection() error {
 		return err
 	}
 
+	if typ == blockTypeRef && len(w.refHashes) > 0 {
+		if err := w.writeRefFilter(); err != nil {
+			return err
+		}
+	}
+
 	if typ == blockTypeRef && !w.cfg.SkipIndexObjects && w.Stats.RefStats.IndexBlocks > 0 {
 		if err := w.dumpObjectIndex(); err != nil {
 			return err
@@ -395,15 +742,13 @@ func (w *Writer) finishPublicSection() error {
 	return nil
 }
 
-func commonPrefixSize(a, b string) int {
-	p := 0
-	for p < len(a) && p < len(b) {
-		if a[p] != b[p] {
-			break
-		}
-		p++
-	}
-	return p
+// writeRefFilter writes the ref filter, which must directly follow
+// the ref section.
+func (w *Writer) writeRefFilter() error {
+	f := newRefFilter(w.refHashes, w.cfg.RefFilterBitsPerKey)
+	w.refHashes = nil
+
+	return w.writeExtension(extensionRefFilter, f.encode())
 }
 
 func uniqSorted(ss []string) []string {
@@ -433,7 +778,7 @@ func (w *Writer) dumpObjectIndex() error {
 
 	last = ""
 	for _, k := range strs {
-		c := commonPrefixSize(last, k)
+		c := sst.CommonPrefixSize(last, k)
 		if c > maxCommon {
 			maxCommon = c
 		}
@@ -459,7 +804,7 @@ func (w *Writer) dumpObjectIndex() error {
 		if !w.blockWriter.add(rec) {
 			rec.Offsets = nil
 			if !w.blockWriter.add(rec) {
-				panic("truncated obj record does not fit in fresh block")
+				return fmt.Errorf("%w: truncated obj record %x", ErrRecordTooLarge, rec.HashPrefix)
 			}
 		}
 	}
@@ -472,6 +817,9 @@ func (w *Writer) finishSection() error {
 	if err := w.flushBlock(); err != nil {
 		return err
 	}
+	if err := w.flushPending(0); err != nil {
+		return err
+	}
 
 	var indexStart uint64
 	maxLevel := 0
@@ -498,14 +846,26 @@ func (w *Writer) finishSection() error {
 			}
 			w.blockWriter = w.newBlockWriter(blockTypeIndex)
 			if !w.blockWriter.add(&i) {
-				panic("fail on fresh block")
+				return fmt.Errorf("%w: index record for %q", ErrRecordTooLarge, i.LastKey)
 			}
 		}
+
+		// Flush the last block of this level, so the next
+		// level points to it too.
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+
+		// If keys are so large that index blocks hold a
+		// single entry, another level will not be smaller.
+		// Leave it to the reader to scan this level.
+		if len(w.index) >= len(idx) {
+			break
+		}
 	}
+	// The entries for the top-level index are not needed, and
+	// should not leak into the index of the next section.
 	w.index = nil
-	if err := w.flushBlock(); err != nil {
-		return err
-	}
 
 	blockStats := w.getBlockStats(typ)
 	blockStats.IndexBlocks = w.Stats.idxStats.Blocks - before